@@ -0,0 +1,854 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	trafficLatest   = "TRAFFIC_TARGET_ALLOCATION_TYPE_LATEST"
+	trafficRevision = "TRAFFIC_TARGET_ALLOCATION_TYPE_REVISION"
+)
+
+// using vars instead of consts so tests can override these
+var (
+	CloudRunAPIEndpoint = "https://run.googleapis.com"
+
+	apiPollInterval = 2 * time.Second
+)
+
+// APIBackend talks to the Cloud Run Admin API v2 directly instead of shelling out to gcloud,
+// see https://cloud.google.com/run/docs/reference/rest
+type APIBackend struct {
+	endpoint string
+	tokens   TokenSource
+
+	// masks the secrets in the logged plans
+	env *Env
+}
+
+func NewAPIBackend(e *Env, credentials string, impersonate []string) (*APIBackend, error) {
+	tokens, err := NewTokenSource(credentials)
+	if err != nil {
+		return nil, err
+	}
+	if len(impersonate) > 0 {
+		tokens = newImpersonatedTokenSource(tokens, impersonate)
+	}
+	return &APIBackend{endpoint: CloudRunAPIEndpoint, tokens: tokens, env: e}, nil
+}
+
+type apiError struct {
+	Code    int
+	Message string
+}
+
+func (e *apiError) Error() string {
+	return fmt.Sprintf("cloud run api error %d: %s", e.Code, e.Message)
+}
+
+func isNotFound(err error) bool {
+	apiErr, ok := err.(*apiError)
+	return ok && apiErr.Code == http.StatusNotFound
+}
+
+// call sends in as JSON body to the API path and decodes the response into out
+func (a *APIBackend) call(method, resource string, in, out interface{}) error {
+	var body []byte
+	if in != nil {
+		var err error
+		if body, err = json.Marshal(in); err != nil {
+			return err
+		}
+	}
+
+	req, err := http.NewRequest(method, a.endpoint+"/v2/"+resource, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	token, err := a.tokens.AccessToken()
+	if err != nil {
+		return fmt.Errorf("failed to get an access token: %s", err)
+	}
+	req.Header.Set("Authorization", bearer(token))
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := apiClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode >= 300 {
+		e := struct {
+			Error struct {
+				Message string `json:"message"`
+			} `json:"error"`
+		}{}
+		_ = json.Unmarshal(respBody, &e)
+		return &apiError{Code: resp.StatusCode, Message: e.Error.Message}
+	}
+
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(respBody, out)
+}
+
+type operation struct {
+	Name     string          `json:"name"`
+	Done     bool            `json:"done"`
+	Response json.RawMessage `json:"response"`
+	Error    *struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// wait polls the long-running operation until it's done
+func (a *APIBackend) wait(op *operation) error {
+	for !op.Done {
+		sleep(apiPollInterval)
+		if err := a.call(http.MethodGet, op.Name, nil, op); err != nil {
+			return err
+		}
+	}
+	if op.Error != nil {
+		return fmt.Errorf("operation %s failed: %s", op.Name, op.Error.Message)
+	}
+	return nil
+}
+
+// callAndWait starts a long-running operation and waits for it to finish
+func (a *APIBackend) callAndWait(method, resource string, in interface{}) (*operation, error) {
+	op := &operation{}
+	if err := a.call(method, resource, in, op); err != nil {
+		return nil, err
+	}
+	return op, a.wait(op)
+}
+
+func locationName(cfg *Config) (string, error) {
+	if cfg.Region == "" {
+		return "", fmt.Errorf("the %s backend needs a region", BackendAPI)
+	}
+	return fmt.Sprintf("projects/%s/locations/%s", cfg.Project, cfg.Region), nil
+}
+
+func serviceResource(cfg *Config, name string) (string, error) {
+	loc, err := locationName(cfg)
+	return loc + "/services/" + name, err
+}
+
+func jobResource(cfg *Config) (string, error) {
+	loc, err := locationName(cfg)
+	return loc + "/jobs/" + cfg.JobName, err
+}
+
+func (a *APIBackend) Logf(format string, args ...interface{}) {
+	a.env.Logf(format, args...)
+}
+
+func (a *APIBackend) Setup() error {
+	if _, err := a.tokens.AccessToken(); err != nil {
+		return fmt.Errorf("authenticating with the Cloud Run Admin API failed: %s", err)
+	}
+	a.Logf("Using the Cloud Run Admin API at %s", a.endpoint)
+	return nil
+}
+
+func (a *APIBackend) Execute(cfg *Config, plan []string) error {
+	ecfg, err := effectiveConfig(cfg)
+	if err != nil {
+		return err
+	}
+	a.Logf("Running via Cloud Run Admin API, gcloud equivalent: %s", strings.Join(plan, " "))
+
+	switch ecfg.Action {
+	case "deploy":
+		return a.deploy(ecfg)
+	case "update-traffic":
+		return a.updateTraffic(ecfg, ecfg.AdditionalFlags)
+	case "rollback":
+		return a.updateTraffic(ecfg, map[string]string{"to-revisions": ecfg.Revision + "=100"})
+	case "delete":
+		return a.delete(ecfg)
+	case "deploy-job":
+		return a.deployJob(ecfg)
+	case "execute-job":
+		return a.executeJob(ecfg)
+	}
+	return fmt.Errorf("action: %s isn't supported by the %s backend", ecfg.Action, BackendAPI)
+}
+
+// object returns m[key] as map, creating it if it doesn't exist yet
+func object(m map[string]interface{}, key string) map[string]interface{} {
+	if o, ok := m[key].(map[string]interface{}); ok {
+		return o
+	}
+	o := map[string]interface{}{}
+	m[key] = o
+	return o
+}
+
+// apiDuration converts gcloud style durations like "10m" or "300" into the API's "600s" format
+func apiDuration(s string) (string, error) {
+	if secs, err := strconv.Atoi(s); err == nil {
+		return fmt.Sprintf("%ds", secs), nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return "", fmt.Errorf("invalid duration: [%s]", s)
+	}
+	return fmt.Sprintf("%ds", int(d.Seconds())), nil
+}
+
+// setContainer applies image, env, secrets and resources to the first container of the template,
+// settings that aren't configured are left as they are
+func setContainer(cfg *Config, tmpl map[string]interface{}) {
+	containers, _ := tmpl["containers"].([]interface{})
+	if len(containers) == 0 {
+		containers = []interface{}{map[string]interface{}{}}
+	}
+	c, _ := containers[0].(map[string]interface{})
+	tmpl["containers"] = containers
+
+	c["image"] = cfg.ImageName
+
+	if cfg.Memory != "" {
+		object(object(c, "resources"), "limits")["memory"] = cfg.Memory
+	}
+
+	// like --set-env-vars and --set-secrets: replace the plain values and the secret references separately,
+	// with env_mode merge like --update-* and --remove-*: only the variables that are set or removed change
+	merge := cfg.EnvMode == EnvModeMerge
+	changed := map[string]bool{}
+	for _, kv := range cfg.EnvSecrets {
+		changed[strings.SplitN(kv, "=", 2)[0]] = true
+	}
+	for _, keys := range [][]string{sortedKeys(cfg.Environment), sortedKeys(cfg.Secrets), cfg.RemoveEnv, cfg.RemoveSecrets} {
+		for _, k := range keys {
+			changed[k] = true
+		}
+	}
+
+	env, _ := c["env"].([]interface{})
+	var keep []interface{}
+	for _, e := range env {
+		em, _ := e.(map[string]interface{})
+		_, isSecret := em["valueSource"]
+		if merge && !changed[fmt.Sprint(em["name"])] ||
+			!merge && ((isSecret && len(cfg.Secrets) == 0) || (!isSecret && len(cfg.Environment)+len(cfg.EnvSecrets) == 0)) {
+			keep = append(keep, e)
+		}
+	}
+
+	vars := append([]string{}, cfg.EnvSecrets...)
+	for k, v := range cfg.Environment {
+		vars = append(vars, k+"="+v)
+	}
+	sort.Strings(vars)
+	for _, kv := range vars {
+		s := strings.SplitN(kv, "=", 2)
+		keep = append(keep, map[string]interface{}{"name": s[0], "value": s[1]})
+	}
+
+	if len(cfg.Secrets) > 0 || (merge && len(cfg.RemoveSecrets) > 0) {
+		// drop the existing secret volumes and their mounts, or with env_mode merge only the ones of
+		// changed secrets, and keep everything else
+		mountPaths := map[interface{}]string{}
+		existing, _ := c["volumeMounts"].([]interface{})
+		for _, m := range existing {
+			mm, _ := m.(map[string]interface{})
+			mountPaths[mm["name"]] = fmt.Sprint(mm["mountPath"])
+		}
+
+		var volumes, mounts []interface{}
+		dropped := map[interface{}]bool{}
+		used := map[string]bool{}
+		existing, _ = tmpl["volumes"].([]interface{})
+		for _, v := range existing {
+			vm, _ := v.(map[string]interface{})
+			secret, isSecret := vm["secret"].(map[string]interface{})
+			drop := isSecret && !merge
+			if isSecret && merge {
+				items, _ := secret["items"].([]interface{})
+				for _, i := range items {
+					im, _ := i.(map[string]interface{})
+					drop = drop || changed[path.Join(mountPaths[vm["name"]], fmt.Sprint(im["path"]))]
+				}
+			}
+			if drop {
+				dropped[vm["name"]] = true
+				continue
+			}
+			volumes = append(volumes, v)
+			used[fmt.Sprint(vm["name"])] = true
+		}
+		existing, _ = c["volumeMounts"].([]interface{})
+		for _, m := range existing {
+			mm, _ := m.(map[string]interface{})
+			if !dropped[mm["name"]] {
+				mounts = append(mounts, m)
+			}
+		}
+
+		for i, k := range sortedKeys(cfg.Secrets) {
+			ref := strings.SplitN(cfg.Secrets[k], ":", 2)
+			version := "latest"
+			if len(ref) == 2 {
+				version = ref[1]
+			}
+
+			// same as gcloud: keys starting with "/" are mounted as files, everything else is an env var
+			if !strings.HasPrefix(k, "/") {
+				keep = append(keep, map[string]interface{}{
+					"name": k,
+					"valueSource": map[string]interface{}{
+						"secretKeyRef": map[string]interface{}{"secret": ref[0], "version": version},
+					},
+				})
+				continue
+			}
+
+			vol := fmt.Sprintf("secret-%d", i)
+			for n := i + 1; used[vol]; n++ {
+				vol = fmt.Sprintf("secret-%d", n)
+			}
+			used[vol] = true
+			volumes = append(volumes, map[string]interface{}{
+				"name": vol,
+				"secret": map[string]interface{}{
+					"secret": ref[0],
+					"items":  []interface{}{map[string]interface{}{"path": filepath.Base(k), "version": version}},
+				},
+			})
+			mounts = append(mounts, map[string]interface{}{"name": vol, "mountPath": filepath.Dir(k)})
+		}
+		tmpl["volumes"] = volumes
+		c["volumeMounts"] = mounts
+	}
+	c["env"] = keep
+}
+
+// revisionName returns a new revision name, Cloud Run requires it to start with the service name
+func revisionName(service string) string {
+	return service + "-" + strconv.FormatInt(time.Now().UnixNano(), 36)
+}
+
+type apiTrafficTarget struct {
+	Type     string `json:"type,omitempty"`
+	Revision string `json:"revision,omitempty"`
+	Percent  int    `json:"percent,omitempty"`
+	Tag      string `json:"tag,omitempty"`
+}
+
+func (a *APIBackend) getService(resource string) (map[string]interface{}, []apiTrafficTarget, error) {
+	svc := map[string]interface{}{}
+	if err := a.call(http.MethodGet, resource, nil, &svc); err != nil {
+		return nil, nil, err
+	}
+
+	var traffic []apiTrafficTarget
+	b, _ := json.Marshal(svc["traffic"])
+	if err := json.Unmarshal(b, &traffic); err != nil {
+		return nil, nil, fmt.Errorf("failed to parse traffic of %s: %s", resource, err)
+	}
+
+	// pin the traffic that follows the latest revision to the revision that is serving it right now
+	latest, _ := svc["latestReadyRevision"].(string)
+	latest = path.Base(latest)
+	for i := range traffic {
+		if traffic[i].Type == trafficLatest {
+			traffic[i] = apiTrafficTarget{Type: trafficRevision, Revision: latest, Percent: traffic[i].Percent, Tag: traffic[i].Tag}
+		}
+	}
+	return svc, traffic, nil
+}
+
+func (a *APIBackend) deploy(cfg *Config) error {
+	if len(cfg.AdditionalFlags) > 0 {
+		return fmt.Errorf("addl_flags aren't supported by the %s backend", BackendAPI)
+	}
+
+	resource, err := serviceResource(cfg, cfg.ServiceName)
+	if err != nil {
+		return err
+	}
+
+	svc, current, err := a.getService(resource)
+	isNew := isNotFound(err)
+	if isNew {
+		svc = map[string]interface{}{}
+	} else if err != nil {
+		return err
+	}
+	if isNew && cfg.NoTraffic {
+		return fmt.Errorf("no_traffic isn't possible when creating service %s", cfg.ServiceName)
+	}
+
+	tmpl := object(svc, "template")
+	// like --update-labels, on the service and its revisions
+	for k, v := range deployLabels(cfg) {
+		object(svc, "labels")[k] = v
+		object(tmpl, "labels")[k] = v
+	}
+
+	revision := revisionName(cfg.ServiceName)
+	if _, err := revisionSuffixArgs(cfg); err != nil {
+		return err
+	} else if cfg.RevisionSuffix != "" {
+		revision = cfg.ServiceName + "-" + cfg.RevisionSuffix
+	}
+	tmpl["revision"] = revision
+	setContainer(cfg, tmpl)
+
+	if cfg.SvcAccount != "" {
+		tmpl["serviceAccount"] = cfg.SvcAccount
+	}
+	if cfg.Concurrency != "" {
+		n, err := strconv.Atoi(cfg.Concurrency)
+		if err != nil {
+			return fmt.Errorf("invalid concurrency: [%s]", cfg.Concurrency)
+		}
+		tmpl["maxInstanceRequestConcurrency"] = n
+	}
+	if cfg.Timeout != "" {
+		d, err := apiDuration(cfg.Timeout)
+		if err != nil {
+			return err
+		}
+		tmpl["timeout"] = d
+	}
+
+	// existing tags stay, the traffic either stays where it is or goes to the latest revision
+	var traffic []apiTrafficTarget
+	for _, t := range current {
+		switch {
+		case cfg.NoTraffic:
+			traffic = append(traffic, t)
+		case t.Tag != "" && t.Tag != cfg.Tag:
+			traffic = append(traffic, apiTrafficTarget{Type: trafficRevision, Revision: t.Revision, Tag: t.Tag})
+		}
+	}
+	if !cfg.NoTraffic {
+		traffic = append(traffic, apiTrafficTarget{Type: trafficLatest, Percent: 100})
+	}
+	if cfg.Tag != "" {
+		traffic = append(traffic, apiTrafficTarget{Type: trafficRevision, Revision: revision, Tag: cfg.Tag})
+	}
+	svc["traffic"] = traffic
+
+	a.Logf("Deploying revision %s of service %s", revision, cfg.ServiceName)
+	if _, err := a.callAndWait(http.MethodPatch, resource+"?allowMissing=true", svc); err != nil {
+		return err
+	}
+
+	return a.setPublicInvoker(resource, cfg.AllowUnauthenticated)
+}
+
+// setPublicInvoker grants or revokes roles/run.invoker for allUsers,
+// the equivalent of gcloud's --[no-]allow-unauthenticated
+func (a *APIBackend) setPublicInvoker(resource string, public bool) error {
+	policy := map[string]interface{}{}
+	if err := a.call(http.MethodGet, resource+":getIamPolicy", nil, &policy); err != nil {
+		return err
+	}
+	if policy == nil {
+		policy = map[string]interface{}{}
+	}
+
+	bindings, _ := policy["bindings"].([]interface{})
+	found := false
+	var updated []interface{}
+	for _, b := range bindings {
+		bm, _ := b.(map[string]interface{})
+		if bm["role"] != "roles/run.invoker" {
+			updated = append(updated, b)
+			continue
+		}
+
+		members, _ := bm["members"].([]interface{})
+		var keep []interface{}
+		for _, m := range members {
+			if m == "allUsers" {
+				found = true
+			} else {
+				keep = append(keep, m)
+			}
+		}
+		if len(keep) > 0 {
+			bm["members"] = keep
+			updated = append(updated, bm)
+		}
+	}
+	if found == public {
+		return nil
+	}
+	if public {
+		updated = append(updated, map[string]interface{}{"role": "roles/run.invoker", "members": []interface{}{"allUsers"}})
+	}
+	policy["bindings"] = updated
+
+	return a.call(http.MethodPost, resource+":setIamPolicy", map[string]interface{}{"policy": policy}, nil)
+}
+
+// parseSplit parses "--to-revisions" / "--to-tags" style values like "rev-1=90,rev-2=10"
+func parseSplit(s string) (map[string]int, error) {
+	split := map[string]int{}
+	for _, kv := range strings.Split(s, ",") {
+		p := strings.SplitN(kv, "=", 2)
+		if len(p) != 2 {
+			return nil, fmt.Errorf("invalid traffic split: [%s]", s)
+		}
+		pct, err := strconv.Atoi(p[1])
+		if err != nil || pct < 0 || pct > 100 {
+			return nil, fmt.Errorf("invalid traffic percentage: [%s]", kv)
+		}
+		split[strings.TrimSpace(p[0])] = pct
+	}
+	return split, nil
+}
+
+// assignTraffic gives the revisions in split their percentage and scales the
+// remaining revisions serving traffic proportionally, like gcloud does
+func assignTraffic(current []apiTrafficTarget, split map[string]int) ([]apiTrafficTarget, error) {
+	remaining := 100
+	for _, pct := range split {
+		remaining -= pct
+	}
+	if remaining < 0 {
+		return nil, fmt.Errorf("traffic split adds up to more than 100%%")
+	}
+
+	others := map[string]int{}
+	othersTotal := 0
+	var tags []apiTrafficTarget
+	for _, t := range current {
+		if t.Tag != "" {
+			tags = append(tags, apiTrafficTarget{Type: trafficRevision, Revision: t.Revision, Tag: t.Tag})
+		}
+		if _, ok := split[t.Revision]; !ok && t.Percent > 0 {
+			others[t.Revision] += t.Percent
+			othersTotal += t.Percent
+		}
+	}
+	if remaining > 0 && othersTotal == 0 {
+		return nil, fmt.Errorf("traffic split adds up to %d%%, not 100%%", 100-remaining)
+	}
+
+	percents := map[string]int{}
+	for rev, pct := range split {
+		percents[rev] = pct
+	}
+	var names []string
+	for rev := range others {
+		names = append(names, rev)
+	}
+	sort.Strings(names)
+	assigned := 0
+	for _, rev := range names {
+		percents[rev] = others[rev] * remaining / othersTotal
+		assigned += percents[rev]
+	}
+	if len(names) > 0 {
+		// rounding leftovers go to the first revision
+		percents[names[0]] += remaining - assigned
+	}
+
+	var revs []string
+	for rev, pct := range percents {
+		if pct > 0 {
+			revs = append(revs, rev)
+		}
+	}
+	sort.Strings(revs)
+
+	var traffic []apiTrafficTarget
+	for _, rev := range revs {
+		if rev == "LATEST" {
+			traffic = append(traffic, apiTrafficTarget{Type: trafficLatest, Percent: percents[rev]})
+		} else {
+			traffic = append(traffic, apiTrafficTarget{Type: trafficRevision, Revision: rev, Percent: percents[rev]})
+		}
+	}
+	return append(traffic, tags...), nil
+}
+
+func (a *APIBackend) updateTraffic(cfg *Config, flags map[string]string) error {
+	resource, err := serviceResource(cfg, cfg.ServiceName)
+	if err != nil {
+		return err
+	}
+	svc, traffic, err := a.getService(resource)
+	if err != nil {
+		return err
+	}
+
+	for _, flag := range sortedKeys(flags) {
+		val := flags[flag]
+		switch flag {
+		case "to-latest":
+			traffic, err = assignTraffic(traffic, map[string]int{"LATEST": 100})
+
+		case "to-revisions":
+			var split map[string]int
+			if split, err = parseSplit(val); err == nil {
+				traffic, err = assignTraffic(traffic, split)
+			}
+
+		case "to-tags":
+			var split map[string]int
+			if split, err = parseSplit(val); err != nil {
+				break
+			}
+			revs := map[string]int{}
+			for tag, pct := range split {
+				rev := ""
+				for _, t := range traffic {
+					if t.Tag == tag {
+						rev = t.Revision
+					}
+				}
+				if rev == "" {
+					return fmt.Errorf("tag %s not found on service %s", tag, cfg.ServiceName)
+				}
+				revs[rev] = pct
+			}
+			traffic, err = assignTraffic(traffic, revs)
+
+		case "remove-tags":
+			remove := map[string]bool{}
+			for _, tag := range strings.Split(val, ",") {
+				remove[tag] = true
+			}
+			var kept []apiTrafficTarget
+			for _, t := range traffic {
+				if remove[t.Tag] {
+					t.Tag = ""
+				}
+				if t.Tag != "" || t.Percent > 0 {
+					kept = append(kept, t)
+				}
+			}
+			traffic = kept
+
+		default:
+			return fmt.Errorf("flag --%s isn't supported by the %s backend", flag, BackendAPI)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	svc["traffic"] = traffic
+	_, err = a.callAndWait(http.MethodPatch, resource, svc)
+	return err
+}
+
+func (a *APIBackend) delete(cfg *Config) error {
+	resource, err := serviceResource(cfg, cfg.ServiceName)
+	if err != nil {
+		return err
+	}
+	_, err = a.callAndWait(http.MethodDelete, resource, nil)
+	return err
+}
+
+func (a *APIBackend) deployJob(cfg *Config) error {
+	if len(cfg.AdditionalFlags) > 0 {
+		return fmt.Errorf("addl_flags aren't supported by the %s backend", BackendAPI)
+	}
+
+	resource, err := jobResource(cfg)
+	if err != nil {
+		return err
+	}
+
+	job := map[string]interface{}{}
+	if err := a.call(http.MethodGet, resource, nil, &job); err != nil && !isNotFound(err) {
+		return err
+	}
+
+	for k, v := range deployLabels(cfg) {
+		object(job, "labels")[k] = v
+	}
+
+	execTmpl := object(job, "template")
+	taskTmpl := object(execTmpl, "template")
+	setContainer(cfg, taskTmpl)
+
+	if cfg.SvcAccount != "" {
+		taskTmpl["serviceAccount"] = cfg.SvcAccount
+	}
+	for key, val := range map[string]string{"taskCount": cfg.Tasks, "parallelism": cfg.Parallelism} {
+		if val != "" {
+			execTmpl[key], _ = strconv.Atoi(val)
+		}
+	}
+	if cfg.MaxRetries != "" {
+		taskTmpl["maxRetries"], _ = strconv.Atoi(cfg.MaxRetries)
+	}
+	if cfg.TaskTimeout != "" {
+		d, err := apiDuration(cfg.TaskTimeout)
+		if err != nil {
+			return err
+		}
+		taskTmpl["timeout"] = d
+	}
+
+	_, err = a.callAndWait(http.MethodPatch, resource+"?allowMissing=true", job)
+	return err
+}
+
+// executeJob runs the job and waits for the execution to finish, like "gcloud run jobs execute --wait"
+func (a *APIBackend) executeJob(cfg *Config) error {
+	resource, err := jobResource(cfg)
+	if err != nil {
+		return err
+	}
+
+	op, err := a.callAndWait(http.MethodPost, resource+":run", map[string]interface{}{})
+	if err != nil {
+		return err
+	}
+
+	execution := struct {
+		Name           string `json:"name"`
+		SucceededCount int    `json:"succeededCount"`
+		FailedCount    int    `json:"failedCount"`
+	}{}
+	if len(op.Response) > 0 {
+		if err := json.Unmarshal(op.Response, &execution); err != nil {
+			return fmt.Errorf("failed to parse execution: %s", err)
+		}
+	}
+	if execution.FailedCount > 0 {
+		return fmt.Errorf("execution %s failed, %d task(s) failed, %d succeeded", execution.Name, execution.FailedCount, execution.SucceededCount)
+	}
+	return nil
+}
+
+func (a *APIBackend) DescribeService(cfg *Config, name string) (*Service, error) {
+	resource, err := serviceResource(cfg, name)
+	if err != nil {
+		return nil, err
+	}
+
+	data := struct {
+		URI                   string            `json:"uri"`
+		Labels                map[string]string `json:"labels"`
+		LatestReadyRevision   string            `json:"latestReadyRevision"`
+		LatestCreatedRevision string            `json:"latestCreatedRevision"`
+		TrafficStatuses       []struct {
+			Type     string `json:"type"`
+			Revision string `json:"revision"`
+			Percent  int    `json:"percent"`
+			Tag      string `json:"tag"`
+			URI      string `json:"uri"`
+		} `json:"trafficStatuses"`
+	}{}
+	if err := a.call(http.MethodGet, resource, nil, &data); err != nil {
+		return nil, fmt.Errorf("describing service %s failed: %s", name, err)
+	}
+
+	svc := &Service{}
+	svc.Metadata.Name = name
+	svc.Metadata.Labels = data.Labels
+	svc.Status.URL = data.URI
+	svc.Status.LatestReadyRevisionName = path.Base(data.LatestReadyRevision)
+	svc.Status.LatestCreatedRevisionName = path.Base(data.LatestCreatedRevision)
+	for _, t := range data.TrafficStatuses {
+		target := TrafficTarget{RevisionName: path.Base(t.Revision), Percent: t.Percent, Tag: t.Tag, URL: t.URI}
+		if t.Type == trafficLatest {
+			target.LatestRevision = true
+			target.RevisionName = svc.Status.LatestReadyRevisionName
+		}
+		svc.Status.Traffic = append(svc.Status.Traffic, target)
+	}
+	return svc, nil
+}
+
+func (a *APIBackend) ListRevisions(cfg *Config) ([]Revision, error) {
+	resource, err := serviceResource(cfg, cfg.ServiceName)
+	if err != nil {
+		return nil, err
+	}
+
+	var revisions []Revision
+	pageToken := ""
+	for {
+		page := struct {
+			Revisions []struct {
+				Name       string    `json:"name"`
+				CreateTime time.Time `json:"createTime"`
+				Conditions []struct {
+					Type  string `json:"type"`
+					State string `json:"state"`
+				} `json:"conditions"`
+			} `json:"revisions"`
+			NextPageToken string `json:"nextPageToken"`
+		}{}
+		if err := a.call(http.MethodGet, resource+"/revisions?pageToken="+url.QueryEscape(pageToken), nil, &page); err != nil {
+			return nil, fmt.Errorf("listing revisions of service %s failed: %s", cfg.ServiceName, err)
+		}
+
+		for _, r := range page.Revisions {
+			rev := Revision{}
+			rev.Metadata.Name = path.Base(r.Name)
+			rev.Metadata.CreationTimestamp = r.CreateTime
+			for _, c := range r.Conditions {
+				status := "False"
+				if c.State == "CONDITION_SUCCEEDED" {
+					status = "True"
+				}
+				rev.Status.Conditions = append(rev.Status.Conditions, RevisionCondition{Type: c.Type, Status: status})
+			}
+			revisions = append(revisions, rev)
+		}
+
+		if pageToken = page.NextPageToken; pageToken == "" {
+			return revisions, nil
+		}
+	}
+}
+
+func (a *APIBackend) ExportService(cfg *Config, name string) (map[string]interface{}, error) {
+	return nil, fmt.Errorf("exporting services isn't supported by the %s backend", BackendAPI)
+}
+
+func (a *APIBackend) AllowsUnauthenticated(cfg *Config, name string) (bool, error) {
+	resource, err := serviceResource(cfg, name)
+	if err != nil {
+		return false, err
+	}
+
+	policy := iamPolicy{}
+	if err := a.call(http.MethodGet, resource+":getIamPolicy", nil, &policy); err != nil {
+		return false, fmt.Errorf("getting the IAM policy of service %s failed: %s", name, err)
+	}
+	return policy.publicInvoker(), nil
+}
+
+func (a *APIBackend) IdentityToken(audience string) (string, error) {
+	return a.tokens.IdentityToken(audience)
+}
+
+func (a *APIBackend) AccessToken() (string, error) {
+	return a.tokens.AccessToken()
+}
@@ -0,0 +1,667 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+var (
+	testKeyOnce sync.Once
+	testKey     *rsa.PrivateKey
+)
+
+func testRSAKey(t *testing.T) *rsa.PrivateKey {
+	testKeyOnce.Do(func() {
+		var err error
+		if testKey, err = rsa.GenerateKey(rand.Reader, 2048); err != nil {
+			t.Fatalf("GenerateKey() err: %s", err)
+		}
+	})
+	return testKey
+}
+
+// testServiceAccountKey returns a service account key JSON whose token_uri points to tokenURI
+func testServiceAccountKey(t *testing.T, tokenURI string) string {
+	der, err := x509.MarshalPKCS8PrivateKey(testRSAKey(t))
+	if err != nil {
+		t.Fatalf("MarshalPKCS8PrivateKey() err: %s", err)
+	}
+	key, _ := json.Marshal(map[string]string{
+		"type":           "service_account",
+		"project_id":     "my-project",
+		"private_key_id": "key-1",
+		"private_key":    string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+		"client_email":   "deployer@my-project.iam.gserviceaccount.com",
+		"token_uri":      tokenURI,
+	})
+	return string(key)
+}
+
+// verifyJWT checks the signature of a JWT signed with the test key and returns its claims
+func verifyJWT(t *testing.T, jwt string) map[string]interface{} {
+	parts := strings.Split(jwt, ".")
+	if len(parts) != 3 {
+		t.Errorf("malformed jwt: %s", jwt)
+		return nil
+	}
+	sig, _ := base64.RawURLEncoding.DecodeString(parts[2])
+	hash := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(&testRSAKey(t).PublicKey, crypto.SHA256, hash[:], sig); err != nil {
+		t.Errorf("invalid jwt signature: %s", err)
+		return nil
+	}
+
+	claims := map[string]interface{}{}
+	payload, _ := base64.RawURLEncoding.DecodeString(parts[1])
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		t.Errorf("invalid jwt payload: %s", err)
+	}
+	return claims
+}
+
+// tokenHandler is a fake OAuth token endpoint for service account JWT assertions
+func tokenHandler(t *testing.T, tokenRequests *int) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		*tokenRequests++
+		claims := verifyJWT(t, r.FormValue("assertion"))
+		if r.FormValue("grant_type") != jwtBearerGrantType || claims == nil || claims["iss"] != "deployer@my-project.iam.gserviceaccount.com" {
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprint(w, `{"error":"invalid_grant"}`)
+			return
+		}
+		if aud, ok := claims["target_audience"]; ok {
+			fmt.Fprintf(w, `{"id_token":"id-token-for-%s"}`, aud)
+			return
+		}
+		fmt.Fprint(w, `{"access_token":"access-token","expires_in":3600}`)
+	}
+}
+
+// fakeCloudRunAPI keeps services, jobs and IAM policies in memory and
+// finishes every long-running operation on the first poll
+type fakeCloudRunAPI struct {
+	t             *testing.T
+	mu            sync.Mutex
+	services      map[string]map[string]interface{}
+	revisions     map[string][]string
+	jobs          map[string]map[string]interface{}
+	policies      map[string]map[string]interface{}
+	tokenRequests int
+	failedTasks   int
+	ops           int
+	calls         []string
+}
+
+func newFakeCloudRunAPI(t *testing.T) (*fakeCloudRunAPI, *httptest.Server) {
+	f := &fakeCloudRunAPI{
+		t:         t,
+		services:  map[string]map[string]interface{}{},
+		revisions: map[string][]string{},
+		jobs:      map[string]map[string]interface{}{},
+		policies:  map[string]map[string]interface{}{},
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/token", tokenHandler(t, &f.tokenRequests))
+	mux.HandleFunc("/v2/", f.handle)
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+
+	orig, origPoll := CloudRunAPIEndpoint, apiPollInterval
+	CloudRunAPIEndpoint, apiPollInterval = srv.URL, time.Millisecond
+	t.Cleanup(func() { CloudRunAPIEndpoint, apiPollInterval = orig, origPoll })
+	return f, srv
+}
+
+func (f *fakeCloudRunAPI) reply(w http.ResponseWriter, v interface{}) {
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		f.t.Errorf("Encode() err: %s", err)
+	}
+}
+
+func (f *fakeCloudRunAPI) operation(response interface{}) map[string]interface{} {
+	f.ops++
+	return map[string]interface{}{"name": fmt.Sprintf("operations/op-%d", f.ops), "done": false, "response": response}
+}
+
+func (f *fakeCloudRunAPI) handle(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if r.Header.Get("Authorization") != "Bearer access-token" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	resource := strings.TrimPrefix(r.URL.Path, "/v2/")
+	f.calls = append(f.calls, r.Method+" "+resource)
+
+	var body map[string]interface{}
+	if b, _ := ioutil.ReadAll(r.Body); len(b) > 0 {
+		if err := json.Unmarshal(b, &body); err != nil {
+			f.t.Errorf("invalid request body: %s", err)
+		}
+	}
+
+	switch {
+	case strings.HasPrefix(resource, "operations/"):
+		f.reply(w, map[string]interface{}{"name": resource, "done": true, "response": map[string]interface{}{
+			"name": "executions/my-job-abc", "failedCount": f.failedTasks, "succeededCount": 1,
+		}})
+
+	case strings.HasSuffix(resource, ":getIamPolicy"):
+		f.reply(w, f.policies[strings.TrimSuffix(resource, ":getIamPolicy")])
+
+	case strings.HasSuffix(resource, ":setIamPolicy"):
+		f.policies[strings.TrimSuffix(resource, ":setIamPolicy")] = body["policy"].(map[string]interface{})
+		f.reply(w, body["policy"])
+
+	case strings.HasSuffix(resource, ":run"):
+		f.reply(w, f.operation(nil))
+
+	case strings.HasSuffix(resource, "/revisions"):
+		// one revision per page, the page tokens need to be escaped in the query
+		i := 0
+		if token := r.URL.Query().Get("pageToken"); token != "" {
+			var err error
+			if i, err = strconv.Atoi(strings.TrimPrefix(token, "page+/=")); err != nil {
+				f.t.Errorf("invalid page token: [%s]", token)
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+		}
+		revs := f.revisions[strings.TrimSuffix(resource, "/revisions")]
+		page := map[string]interface{}{}
+		if i < len(revs) {
+			page["revisions"] = []interface{}{map[string]interface{}{
+				"name":       revs[i],
+				"createTime": time.Date(2023, 5, 1+i, 0, 0, 0, 0, time.UTC),
+				"conditions": []interface{}{map[string]interface{}{"type": "Ready", "state": "CONDITION_SUCCEEDED"}},
+			}}
+		}
+		if i+1 < len(revs) {
+			page["nextPageToken"] = "page+/=" + strconv.Itoa(i+1)
+		}
+		f.reply(w, page)
+
+	case strings.Contains(resource, "/jobs/"):
+		if r.Method == http.MethodPatch {
+			f.jobs[resource] = body
+			f.reply(w, f.operation(nil))
+		} else if job, ok := f.jobs[resource]; ok {
+			f.reply(w, job)
+		} else {
+			w.WriteHeader(http.StatusNotFound)
+		}
+
+	case strings.Contains(resource, "/services/"):
+		f.handleService(w, r, resource, body)
+
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (f *fakeCloudRunAPI) handleService(w http.ResponseWriter, r *http.Request, resource string, body map[string]interface{}) {
+	switch r.Method {
+	case http.MethodGet:
+		svc, ok := f.services[resource]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			f.reply(w, map[string]interface{}{"error": map[string]interface{}{"message": "service not found"}})
+			return
+		}
+		f.reply(w, svc)
+
+	case http.MethodPatch:
+		revs := f.revisions[resource]
+		if rev, _ := body["template"].(map[string]interface{})["revision"].(string); rev != "" && (len(revs) == 0 || revs[len(revs)-1] != rev) {
+			f.revisions[resource] = append(revs, rev)
+		}
+		body["uri"] = "https://" + resource[strings.LastIndex(resource, "/")+1:] + "-abc-uc.a.run.app"
+		body["latestReadyRevision"] = resource + "/revisions/" + f.revisions[resource][len(f.revisions[resource])-1]
+		body["latestCreatedRevision"] = body["latestReadyRevision"]
+
+		var statuses []interface{}
+		traffic, _ := body["traffic"].([]interface{})
+		for _, t := range traffic {
+			tm := t.(map[string]interface{})
+			status := map[string]interface{}{"type": tm["type"], "revision": tm["revision"], "percent": tm["percent"], "tag": tm["tag"]}
+			if tm["tag"] != nil {
+				status["uri"] = fmt.Sprintf("https://%s---%s", tm["tag"], body["uri"].(string)[len("https://"):])
+			}
+			statuses = append(statuses, status)
+		}
+		body["trafficStatuses"] = statuses
+		f.services[resource] = body
+		f.reply(w, f.operation(nil))
+
+	case http.MethodDelete:
+		delete(f.services, resource)
+		f.reply(w, f.operation(nil))
+	}
+}
+
+func (f *fakeCloudRunAPI) service(t *testing.T, name string) map[string]interface{} {
+	svc, ok := f.services["projects/my-project/locations/us-central1/services/"+name]
+	if !ok {
+		t.Fatalf("service %s doesn't exist", name)
+	}
+	return svc
+}
+
+func jsonString(v interface{}) string {
+	b, _ := json.Marshal(v)
+	return string(b)
+}
+
+func TestAPIBackendDeploy(t *testing.T) {
+	api, srv := newFakeCloudRunAPI(t)
+	GCloudCommand = "/bin/false"
+	defer func() { GCloudCommand = "gcloud" }()
+
+	cfg := &Config{
+		Action: "deploy", Backend: BackendAPI, Token: testServiceAccountKey(t, srv.URL+"/token"),
+		ServiceName: "my-service", ImageName: "my-image:v1", Project: "my-project", Region: "us-central1", Runtime: "managed",
+		SvcAccount: "runtime@my-project.iam.gserviceaccount.com", AllowUnauthenticated: true,
+		Memory: "512Mi", Concurrency: "80", Timeout: "10m",
+		Environment: map[string]string{"VAR_1": "var01"},
+		EnvSecrets:  []string{"API_KEY=secret"},
+		Secrets:     map[string]string{"DB_PASS": "db-pass:2", "/mnt/config/app.json": "app-config"},
+		Labels:      map[string]string{"team": "payments"},
+		BuildLabels: map[string]string{LabelBuild: "42"},
+
+		RevisionSuffix: "d0c13cb-42",
+	}
+	if err := runConfig(cfg); err != nil {
+		t.Fatalf("runConfig() err: %s", err)
+	}
+
+	svc := jsonString(api.service(t, "my-service"))
+	for _, expected := range []string{
+		`"image":"my-image:v1"`,
+		`"serviceAccount":"runtime@my-project.iam.gserviceaccount.com"`,
+		`"maxInstanceRequestConcurrency":80`,
+		`"timeout":"600s"`,
+		`"limits":{"memory":"512Mi"}`,
+		`{"name":"API_KEY","value":"secret"}`,
+		`{"name":"VAR_1","value":"var01"}`,
+		`{"name":"DB_PASS","valueSource":{"secretKeyRef":{"secret":"db-pass","version":"2"}}}`,
+		`"secret":{"items":[{"path":"app.json","version":"latest"}],"secret":"app-config"}`,
+		`"mountPath":"/mnt/config"`,
+		`"traffic":[{"percent":100,"type":"TRAFFIC_TARGET_ALLOCATION_TYPE_LATEST"}]`,
+		`"labels":{"drone-build":"42","team":"payments"}`,
+		`"revision":"my-service-d0c13cb-42"`,
+	} {
+		if !strings.Contains(svc, expected) {
+			t.Errorf("expected %s in service: %s", expected, svc)
+		}
+	}
+
+	policy := jsonString(api.policies["projects/my-project/locations/us-central1/services/my-service"])
+	if !strings.Contains(policy, `"members":["allUsers"],"role":"roles/run.invoker"`) {
+		t.Errorf("expected public invoker binding, got: %s", policy)
+	}
+
+	if api.tokenRequests != 1 {
+		t.Errorf("expected the access token to be reused, got %d token requests", api.tokenRequests)
+	}
+
+	// a second deploy with --no-allow-unauthenticated revokes public access again
+	cfg.AllowUnauthenticated = false
+	if err := runConfig(cfg); err != nil {
+		t.Fatalf("runConfig() err: %s", err)
+	}
+	if policy := jsonString(api.policies["projects/my-project/locations/us-central1/services/my-service"]); strings.Contains(policy, "allUsers") {
+		t.Errorf("expected public invoker binding to be removed, got: %s", policy)
+	}
+}
+
+func TestAPIBackendRedactedLogs(t *testing.T) {
+	_, srv := newFakeCloudRunAPI(t)
+	GCloudCommand = "/bin/false"
+	defer func() { GCloudCommand = "gcloud" }()
+
+	logs := &bytes.Buffer{}
+	log.SetOutput(logs)
+	defer log.SetOutput(os.Stderr)
+
+	cfg := &Config{
+		Action: "deploy", Backend: BackendAPI, Token: testServiceAccountKey(t, srv.URL+"/token"),
+		ServiceName: "my-service", ImageName: "my-image:v1", Project: "my-project", Region: "us-central1", Runtime: "managed",
+		EnvSecrets:  []string{"API_KEY=s3cr3t-api-key"},
+		Environment: map[string]string{"PUBLIC": "visible-value"},
+	}
+	if err := runConfig(cfg); err != nil {
+		t.Fatalf("runConfig() err: %s", err)
+	}
+
+	if strings.Contains(logs.String(), "s3cr3t-api-key") {
+		t.Errorf("found the env_secret value in log: %s", logs.String())
+	}
+	if !strings.Contains(logs.String(), "API_KEY="+RedactedValue) || !strings.Contains(logs.String(), "PUBLIC=visible-value") {
+		t.Errorf("expected the masked plan in log, got: %s", logs.String())
+	}
+}
+
+func TestAPIBackendCanaryAndRollback(t *testing.T) {
+	api, srv := newFakeCloudRunAPI(t)
+	sleep = func(time.Duration) {}
+	defer func() { sleep = time.Sleep }()
+
+	token := testServiceAccountKey(t, srv.URL+"/token")
+	cfg := &Config{
+		Action: "deploy", Backend: BackendAPI, Token: token,
+		ServiceName: "my-service", ImageName: "my-image:v1", Project: "my-project", Region: "us-central1", Runtime: "managed",
+	}
+	if err := runConfig(cfg); err != nil {
+		t.Fatalf("runConfig() err: %s", err)
+	}
+	canary := *cfg
+	canary.Action = "canary"
+	canary.ImageName = "my-image:v2"
+	canary.Tag = "canary"
+	canary.CanarySteps = []int{10, 50}
+	if err := runConfig(&canary); err != nil {
+		t.Fatalf("runConfig() err: %s", err)
+	}
+
+	revs := api.revisions["projects/my-project/locations/us-central1/services/my-service"]
+	if len(revs) != 2 {
+		t.Fatalf("expected 2 revisions, got: %v", revs)
+	}
+	traffic := jsonString(api.service(t, "my-service")["traffic"])
+	expected := fmt.Sprintf(`[{"percent":50,"revision":"%s","type":"TRAFFIC_TARGET_ALLOCATION_TYPE_REVISION"},{"percent":50,"revision":"%s","type":"TRAFFIC_TARGET_ALLOCATION_TYPE_REVISION"},{"revision":"%s","tag":"canary","type":"TRAFFIC_TARGET_ALLOCATION_TYPE_REVISION"}]`, revs[0], revs[1], revs[1])
+	if traffic != expected {
+		t.Errorf("unexpected traffic after canary\nexpected: %s\ngot:      %s", expected, traffic)
+	}
+
+	rollback := *cfg
+	rollback.Action = "rollback"
+	if err := runConfig(&rollback); err != nil {
+		t.Fatalf("runConfig() err: %s", err)
+	}
+	traffic = jsonString(api.service(t, "my-service")["traffic"])
+	if !strings.HasPrefix(traffic, fmt.Sprintf(`[{"percent":100,"revision":"%s"`, revs[0])) {
+		t.Errorf("expected all traffic on %s after rollback, got: %s", revs[0], traffic)
+	}
+}
+
+func TestAPIBackendJobs(t *testing.T) {
+	api, srv := newFakeCloudRunAPI(t)
+
+	cfg := &Config{
+		Action: "deploy-job", Backend: BackendAPI, Token: testServiceAccountKey(t, srv.URL+"/token"),
+		JobName: "my-job", ImageName: "my-image", Project: "my-project", Region: "us-central1",
+		Tasks: "10", Parallelism: "2", MaxRetries: "3", TaskTimeout: "30m",
+	}
+	if err := runConfig(cfg); err != nil {
+		t.Fatalf("runConfig() err: %s", err)
+	}
+	job := jsonString(api.jobs["projects/my-project/locations/us-central1/jobs/my-job"])
+	for _, expected := range []string{`"taskCount":10`, `"parallelism":2`, `"maxRetries":3`, `"timeout":"1800s"`, `"image":"my-image"`} {
+		if !strings.Contains(job, expected) {
+			t.Errorf("expected %s in job: %s", expected, job)
+		}
+	}
+
+	cfg.Action = "execute-job"
+	if err := runConfig(cfg); err != nil {
+		t.Fatalf("runConfig() err: %s", err)
+	}
+
+	api.failedTasks = 1
+	if err := runConfig(cfg); err == nil {
+		t.Errorf("expected failed execution to fail the step")
+	}
+}
+
+func TestAPIBackendErrors(t *testing.T) {
+	api, srv := newFakeCloudRunAPI(t)
+	token := testServiceAccountKey(t, srv.URL+"/token")
+
+	for _, cfg := range []*Config{
+		// no region
+		{Action: "deploy", Backend: BackendAPI, Token: token, ServiceName: "my-service", ImageName: "my-image", Project: "my-project"},
+		// addl_flags can't be translated
+		{Action: "deploy", Backend: BackendAPI, Token: token, ServiceName: "my-service", ImageName: "my-image", Project: "my-project", Region: "us-central1",
+			AdditionalFlags: map[string]string{"add-cloudsql-instances": "db"}},
+		// no traffic for a new service
+		{Action: "deploy", Backend: BackendAPI, Token: token, ServiceName: "my-service", ImageName: "my-image", Project: "my-project", Region: "us-central1", NoTraffic: true},
+		// key can't get a token
+		{Action: "deploy", Backend: BackendAPI, Token: testServiceAccountKey(t, srv.URL+"/missing"), ServiceName: "my-service", ImageName: "my-image", Project: "my-project", Region: "us-central1"},
+		// not a service account key
+		{Action: "deploy", Backend: BackendAPI, Token: validGCPKey, ServiceName: "my-service", ImageName: "my-image", Project: "my-project", Region: "us-central1"},
+	} {
+		if err := runConfig(cfg); err == nil {
+			t.Errorf("expected runConfig(%#v) to fail", cfg)
+		}
+	}
+	if len(api.services) != 0 {
+		t.Errorf("expected no services to be created, got: %v", api.services)
+	}
+}
+
+func TestAPIBackendIdentityToken(t *testing.T) {
+	_, srv := newFakeCloudRunAPI(t)
+	b, err := NewAPIBackend(NewEnv("/tmp", nil, os.Stdout, os.Stderr, false), testServiceAccountKey(t, srv.URL+"/token"), nil)
+	if err != nil {
+		t.Fatalf("NewAPIBackend() err: %s", err)
+	}
+	if token, err := b.IdentityToken("https://my-service.a.run.app"); err != nil || token != "id-token-for-https://my-service.a.run.app" {
+		t.Errorf("unexpected identity token: %s, err: %v", token, err)
+	}
+}
+
+// fakeWorkloadIdentity is a fake security token service and IAM credentials API for
+// workload identity federation with service account impersonation
+func fakeWorkloadIdentity(t *testing.T) (credCfg string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/sts", func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("grant_type") != tokenExchangeGrantType || r.FormValue("subject_token") != "oidc-token" ||
+			r.FormValue("audience") != "//iam.googleapis.com/projects/123456/locations/global/workloadIdentityPools/drone/providers/drone" {
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprint(w, `{"error":"invalid_grant"}`)
+			return
+		}
+		fmt.Fprint(w, `{"access_token":"federated-token","expires_in":3600}`)
+	})
+	mux.HandleFunc("/v1/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer federated-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		body := map[string]interface{}{}
+		_ = json.NewDecoder(r.Body).Decode(&body)
+		switch {
+		case strings.HasSuffix(r.URL.Path, ":generateAccessToken"):
+			fmt.Fprintf(w, `{"accessToken":"access-token","expireTime":"%s"}`, time.Now().Add(time.Hour).Format(time.RFC3339))
+		case strings.HasSuffix(r.URL.Path, ":generateIdToken"):
+			fmt.Fprintf(w, `{"token":"id-token-for-%s"}`, body["audience"])
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	})
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+
+	return jsonString(map[string]interface{}{
+		"type":                              "external_account",
+		"audience":                          "//iam.googleapis.com/projects/123456/locations/global/workloadIdentityPools/drone/providers/drone",
+		"subject_token_type":                "urn:ietf:params:oauth:token-type:jwt",
+		"token_url":                         srv.URL + "/sts",
+		"service_account_impersonation_url": srv.URL + "/v1/projects/-/serviceAccounts/deployer@my-project.iam.gserviceaccount.com:generateAccessToken",
+		"credential_source":                 map[string]interface{}{"url": srv.URL + "/unused"},
+	})
+}
+
+func TestAPIBackendWorkloadIdentity(t *testing.T) {
+	api, _ := newFakeCloudRunAPI(t)
+	GCloudCommand = "/bin/false"
+	defer func() { GCloudCommand = "gcloud" }()
+
+	cfg := &Config{
+		Action: "deploy", Backend: BackendAPI, CredentialConfig: fakeWorkloadIdentity(t), OIDCToken: "oidc-token",
+		ServiceName: "my-service", ImageName: "my-image:v1", Project: "my-project", Region: "us-central1", Runtime: "managed",
+	}
+	if err := runConfig(cfg); err != nil {
+		t.Fatalf("runConfig() err: %s", err)
+	}
+	if svc := jsonString(api.service(t, "my-service")); !strings.Contains(svc, `"image":"my-image:v1"`) {
+		t.Errorf("unexpected service: %s", svc)
+	}
+
+	creds, err := NewCredentials(cfg)
+	if err != nil {
+		t.Fatalf("NewCredentials() err: %s", err)
+	}
+	defer creds.Cleanup()
+
+	ts, err := NewTokenSource(creds.Content)
+	if err != nil {
+		t.Fatalf("NewTokenSource() err: %s", err)
+	}
+	if token, err := ts.IdentityToken("https://my-service.a.run.app"); err != nil || token != "id-token-for-https://my-service.a.run.app" {
+		t.Errorf("unexpected identity token: %s, err: %v", token, err)
+	}
+
+	// without impersonation the federated token is used as is, it can't mint identity tokens though
+	ts, err = NewTokenSource(strings.Replace(creds.Content, "service_account_impersonation_url", "unused", 1))
+	if err != nil {
+		t.Fatalf("NewTokenSource() err: %s", err)
+	}
+	if token, err := ts.AccessToken(); err != nil || token != "federated-token" {
+		t.Errorf("unexpected access token: %s, err: %v", token, err)
+	}
+	if _, err := ts.IdentityToken("https://my-service.a.run.app"); err == nil {
+		t.Errorf("expected identity token to fail without impersonation")
+	}
+}
+
+type staticTokenSource string
+
+func (s staticTokenSource) AccessToken() (string, error) { return string(s), nil }
+func (s staticTokenSource) IdentityToken(string) (string, error) {
+	return "", fmt.Errorf("not supported")
+}
+
+func TestImpersonatedTokenSource(t *testing.T) {
+	var requests []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body := map[string]interface{}{}
+		_ = json.NewDecoder(r.Body).Decode(&body)
+		requests = append(requests, r.URL.Path+" "+jsonString(body["delegates"]))
+
+		switch {
+		case r.Header.Get("Authorization") != "Bearer ci-token":
+			w.WriteHeader(http.StatusUnauthorized)
+		case strings.HasSuffix(r.URL.Path, ":generateAccessToken"):
+			fmt.Fprintf(w, `{"accessToken":"deployer-token","expireTime":"%s"}`, time.Now().Add(time.Hour).Format(time.RFC3339))
+		case strings.HasSuffix(r.URL.Path, ":generateIdToken"):
+			fmt.Fprintf(w, `{"token":"id-token-for-%s"}`, body["audience"])
+		}
+	}))
+	defer srv.Close()
+	orig := IAMCredentialsEndpoint
+	IAMCredentialsEndpoint = srv.URL
+	defer func() { IAMCredentialsEndpoint = orig }()
+
+	ts := newImpersonatedTokenSource(staticTokenSource("ci-token"), []string{"delegate@my-project.iam.gserviceaccount.com", "deployer@my-project.iam.gserviceaccount.com"})
+	for i := 0; i < 2; i++ {
+		if token, err := ts.AccessToken(); err != nil || token != "deployer-token" {
+			t.Errorf("unexpected access token: %s, err: %v", token, err)
+		}
+	}
+	if token, err := ts.IdentityToken("https://my-service.a.run.app"); err != nil || token != "id-token-for-https://my-service.a.run.app" {
+		t.Errorf("unexpected identity token: %s, err: %v", token, err)
+	}
+
+	expected := []string{
+		`/v1/projects/-/serviceAccounts/deployer@my-project.iam.gserviceaccount.com:generateAccessToken ["projects/-/serviceAccounts/delegate@my-project.iam.gserviceaccount.com"]`,
+		`/v1/projects/-/serviceAccounts/deployer@my-project.iam.gserviceaccount.com:generateIdToken ["projects/-/serviceAccounts/delegate@my-project.iam.gserviceaccount.com"]`,
+	}
+	if strings.Join(requests, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("unexpected requests: %v", requests)
+	}
+
+	// a single service account has no delegates
+	ts = newImpersonatedTokenSource(staticTokenSource("other-token"), []string{"deployer@my-project.iam.gserviceaccount.com"})
+	if _, err := ts.AccessToken(); err == nil || !strings.Contains(err.Error(), "impersonating deployer@my-project.iam.gserviceaccount.com failed") {
+		t.Errorf("expected impersonation to fail, got: %v", err)
+	}
+	if last := requests[len(requests)-1]; !strings.HasSuffix(last, " null") {
+		t.Errorf("expected no delegates, got: %s", last)
+	}
+}
+
+func TestAssignTraffic(t *testing.T) {
+	current := []apiTrafficTarget{
+		{Type: trafficRevision, Revision: "rev-1", Percent: 60},
+		{Type: trafficRevision, Revision: "rev-2", Percent: 30, Tag: "blue"},
+		{Type: trafficRevision, Revision: "rev-3", Percent: 10},
+		{Type: trafficRevision, Revision: "rev-4", Tag: "canary"},
+	}
+
+	for _, tst := range []struct {
+		split      map[string]int
+		expected   string
+		expectedOk bool
+	}{
+		{
+			split:      map[string]int{"rev-4": 50},
+			expected:   "rev-1=30 rev-2=15 rev-3=5 rev-4=50 tag:blue=rev-2 tag:canary=rev-4",
+			expectedOk: true,
+		},
+		{
+			split:      map[string]int{"rev-1": 100},
+			expected:   "rev-1=100 tag:blue=rev-2 tag:canary=rev-4",
+			expectedOk: true,
+		},
+		{
+			split:      map[string]int{"LATEST": 100},
+			expected:   "LATEST=100 tag:blue=rev-2 tag:canary=rev-4",
+			expectedOk: true,
+		},
+		{split: map[string]int{"rev-1": 70, "rev-4": 40}},
+	} {
+		traffic, err := assignTraffic(current, tst.split)
+		if err != nil {
+			if tst.expectedOk {
+				t.Errorf("assignTraffic(%v) err: %s", tst.split, err)
+			}
+			continue
+		}
+		var got []string
+		for _, tt := range traffic {
+			switch {
+			case tt.Tag != "":
+				got = append(got, "tag:"+tt.Tag+"="+tt.Revision)
+			case tt.Type == trafficLatest:
+				got = append(got, fmt.Sprintf("LATEST=%d", tt.Percent))
+			default:
+				got = append(got, fmt.Sprintf("%s=%d", tt.Revision, tt.Percent))
+			}
+		}
+		if strings.Join(got, " ") != tst.expected {
+			t.Errorf("assignTraffic(%v) expected: %s   got: %s", tst.split, tst.expected, strings.Join(got, " "))
+		}
+	}
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	BackendGCloud = "gcloud"
+	BackendAPI    = "api"
+)
+
+// Backend carries out execution plans and the lookups the actions need, either by
+// shelling out to gcloud or by talking to the Cloud Run Admin API directly
+type Backend interface {
+	// Setup checks the backend is usable and authenticates it
+	Setup() error
+
+	// Execute carries out the plan CreateExecutionPlan() created for cfg
+	Execute(cfg *Config, plan []string) error
+
+	DescribeService(cfg *Config, name string) (*Service, error)
+	ListRevisions(cfg *Config) ([]Revision, error)
+
+	// ExportService returns the service as Knative manifest, like "gcloud run services describe --format=export"
+	ExportService(cfg *Config, name string) (map[string]interface{}, error)
+
+	// AllowsUnauthenticated reports whether allUsers may invoke the service
+	AllowsUnauthenticated(cfg *Config, name string) (bool, error)
+
+	// IdentityToken returns an OIDC identity token of the deploying identity for the audience
+	IdentityToken(audience string) (string, error)
+
+	// AccessToken returns an OAuth access token of the deploying identity
+	AccessToken() (string, error)
+
+	// Logf logs a line of the plugin like the backend's commands are logged, see Env.Logf()
+	Logf(format string, args ...interface{})
+}
+
+func NewBackend(cfg *Config, e *Env, creds *Credentials) (Backend, error) {
+	switch cfg.Backend {
+	case BackendAPI:
+		return NewAPIBackend(e, creds.Content, cfg.ImpersonateServiceAccount)
+	default:
+		return &GCloudBackend{env: e, creds: creds, impersonate: cfg.ImpersonateServiceAccount}, nil
+	}
+}
+
+// Service is the subset of the "gcloud run services describe --format=json" output the plugin uses
+type Service struct {
+	Metadata struct {
+		Name   string            `json:"name"`
+		Labels map[string]string `json:"labels"`
+	} `json:"metadata"`
+	Status struct {
+		URL                     string `json:"url"`
+		LatestReadyRevisionName string `json:"latestReadyRevisionName"`
+
+		// differs from LatestReadyRevisionName while the latest revision isn't, or never gets, ready
+		LatestCreatedRevisionName string          `json:"latestCreatedRevisionName"`
+		Traffic                   []TrafficTarget `json:"traffic"`
+	} `json:"status"`
+}
+
+type TrafficTarget struct {
+	RevisionName   string `json:"revisionName,omitempty"`
+	Percent        int    `json:"percent,omitempty"`
+	Tag            string `json:"tag,omitempty"`
+	URL            string `json:"url,omitempty"`
+	LatestRevision bool   `json:"latestRevision,omitempty"`
+}
+
+// TagURL returns the URL of the traffic target with the given tag
+func (s *Service) TagURL(tag string) string {
+	for _, t := range s.Status.Traffic {
+		if t.Tag == tag {
+			return t.URL
+		}
+	}
+	return ""
+}
+
+// Revision is the subset of the "gcloud run revisions list --format=json" output the plugin uses
+type Revision struct {
+	Metadata struct {
+		Name              string    `json:"name"`
+		CreationTimestamp time.Time `json:"creationTimestamp"`
+	} `json:"metadata"`
+	Status struct {
+		Conditions []RevisionCondition `json:"conditions"`
+	} `json:"status"`
+}
+
+type RevisionCondition struct {
+	Type   string `json:"type"`
+	Status string `json:"status"`
+}
+
+func (r *Revision) Ready() bool {
+	for _, c := range r.Status.Conditions {
+		if c.Type == "Ready" {
+			return c.Status == "True"
+		}
+	}
+	return false
+}
+
+// GCloudBackend runs the plans with the gcloud CLI
+type GCloudBackend struct {
+	env   *Env
+	creds *Credentials
+
+	// delegation chain passed to every command after authenticating
+	impersonate []string
+}
+
+func (g *GCloudBackend) Logf(format string, args ...interface{}) {
+	g.env.Logf(format, args...)
+}
+
+func (g *GCloudBackend) Setup() error {
+	if err := g.env.Run(GCloudCommand, "version"); err != nil {
+		return err
+	}
+
+	if g.creds.External {
+		return g.env.Run(GCloudCommand, "auth", "login", "--cred-file", g.creds.KeyFile)
+	}
+	return g.env.Run(GCloudCommand, "auth", "activate-service-account", "--key-file", g.creds.KeyFile)
+}
+
+func (g *GCloudBackend) Execute(cfg *Config, plan []string) error {
+	return g.env.Run(GCloudCommand, g.withImpersonation(plan)...)
+}
+
+// withImpersonation adds the impersonation flag to the args of an authenticated command
+func (g *GCloudBackend) withImpersonation(args []string) []string {
+	if len(g.impersonate) == 0 {
+		return args
+	}
+	return append(args[:len(args):len(args)], "--impersonate-service-account", strings.Join(g.impersonate, ","))
+}
+
+// commandArgs returns the arguments of a read-only "gcloud run" command with JSON output
+func commandArgs(cfg *Config, cmd ...string) []string {
+	return formatArgs(cfg, "json", cmd...)
+}
+
+// formatArgs returns the arguments of a read-only "gcloud run" command with the given output format
+func formatArgs(cfg *Config, format string, cmd ...string) []string {
+	args := []string{"--quiet"}
+	if cfg.Variant == "alpha" || cfg.Variant == "beta" {
+		args = append(args, cfg.Variant)
+	}
+	args = append(args, "run")
+	args = append(args, cmd...)
+	args = append(args, "--format", format)
+	return append(args, locationArgs(cfg)...)
+}
+
+func (g *GCloudBackend) DescribeService(cfg *Config, name string) (*Service, error) {
+	out, err := g.env.Output(GCloudCommand, g.withImpersonation(commandArgs(cfg, "services", "describe", name))...)
+	if err != nil {
+		return nil, fmt.Errorf("describing service %s failed: %s", name, err)
+	}
+
+	svc := &Service{}
+	if err := json.Unmarshal(out, svc); err != nil {
+		return nil, fmt.Errorf("failed to parse description of service %s: %s", name, err)
+	}
+	return svc, nil
+}
+
+func (g *GCloudBackend) ListRevisions(cfg *Config) ([]Revision, error) {
+	out, err := g.env.Output(GCloudCommand, g.withImpersonation(commandArgs(cfg, "revisions", "list", "--service", cfg.ServiceName))...)
+	if err != nil {
+		return nil, fmt.Errorf("listing revisions of service %s failed: %s", cfg.ServiceName, err)
+	}
+
+	var revisions []Revision
+	if err := json.Unmarshal(out, &revisions); err != nil {
+		return nil, fmt.Errorf("failed to parse revisions of service %s: %s", cfg.ServiceName, err)
+	}
+	return revisions, nil
+}
+
+func (g *GCloudBackend) ExportService(cfg *Config, name string) (map[string]interface{}, error) {
+	out, err := g.env.Output(GCloudCommand, g.withImpersonation(formatArgs(cfg, "export", "services", "describe", name))...)
+	if err != nil {
+		return nil, fmt.Errorf("exporting service %s failed: %s", name, err)
+	}
+
+	v, err := parseYAML(out)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse export of service %s: %s", name, err)
+	}
+	svc, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("failed to parse export of service %s: not a Knative service", name)
+	}
+	return svc, nil
+}
+
+func (g *GCloudBackend) AllowsUnauthenticated(cfg *Config, name string) (bool, error) {
+	out, err := g.env.Output(GCloudCommand, g.withImpersonation(commandArgs(cfg, "services", "get-iam-policy", name))...)
+	if err != nil {
+		return false, fmt.Errorf("getting the IAM policy of service %s failed: %s", name, err)
+	}
+
+	policy := iamPolicy{}
+	if err := json.Unmarshal(out, &policy); err != nil {
+		return false, fmt.Errorf("failed to parse the IAM policy of service %s: %s", name, err)
+	}
+	return policy.publicInvoker(), nil
+}
+
+// iamPolicy is the subset of a Cloud Run IAM policy the plugin uses
+type iamPolicy struct {
+	Bindings []struct {
+		Role    string   `json:"role"`
+		Members []string `json:"members"`
+	} `json:"bindings"`
+}
+
+// publicInvoker reports whether the policy grants roles/run.invoker to allUsers
+func (p *iamPolicy) publicInvoker() bool {
+	for _, b := range p.Bindings {
+		if b.Role != "roles/run.invoker" {
+			continue
+		}
+		for _, m := range b.Members {
+			if m == "allUsers" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (g *GCloudBackend) IdentityToken(audience string) (string, error) {
+	args := []string{"auth", "print-identity-token", "--audiences", audience}
+	if len(g.impersonate) > 0 {
+		// identity tokens of impersonated service accounts only carry the email when asked to
+		args = append(args, "--include-email")
+	}
+	out, err := g.env.Output(GCloudCommand, g.withImpersonation(args)...)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+func (g *GCloudBackend) AccessToken() (string, error) {
+	out, err := g.env.Output(GCloudCommand, g.withImpersonation([]string{"auth", "print-access-token"})...)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(out)), nil
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultCanaryTag      = "canary"
+	DefaultCanarySteps    = "5,25,50,100"
+	DefaultCanaryInterval = time.Minute
+)
+
+func parseCanaryConfig(cfg *Config) error {
+	if cfg.Tag == "" {
+		cfg.Tag = DefaultCanaryTag
+	}
+
+	stepsStr := os.Getenv("PLUGIN_CANARY_STEPS")
+	if stepsStr == "" {
+		stepsStr = DefaultCanarySteps
+	}
+	prev := 0
+	for _, s := range strings.Split(stepsStr, ",") {
+		pct, err := strconv.Atoi(strings.TrimSpace(s))
+		if err != nil || pct <= prev || pct > 100 {
+			return fmt.Errorf("invalid canary_steps: [%s], expected increasing percentages between 1 and 100", stepsStr)
+		}
+		cfg.CanarySteps = append(cfg.CanarySteps, pct)
+		prev = pct
+	}
+
+	cfg.CanaryInterval = DefaultCanaryInterval
+	if s := os.Getenv("PLUGIN_CANARY_INTERVAL"); s != "" {
+		d, err := time.ParseDuration(s)
+		if err != nil || d < 0 {
+			return fmt.Errorf("invalid canary_interval: [%s]", s)
+		}
+		cfg.CanaryInterval = d
+	}
+	return nil
+}
+
+// trafficConfig returns the config of an update-traffic call with the given traffic flag, e.g. to-tags=canary=5
+func trafficConfig(cfg *Config, flag, value string) *Config {
+	tcfg := *cfg
+	tcfg.Action = "update-traffic"
+	tcfg.AdditionalFlags = map[string]string{flag: value}
+	return &tcfg
+}
+
+// trafficSplit formats the revisions serving traffic as "--to-revisions" value, e.g. "rev-1=90,rev-2=10"
+func trafficSplit(traffic []TrafficTarget) string {
+	percents := map[string]int{}
+	for _, t := range traffic {
+		if t.Percent > 0 && t.RevisionName != "" {
+			percents[t.RevisionName] += t.Percent
+		}
+	}
+
+	var split []string
+	for rev, pct := range percents {
+		split = append(split, fmt.Sprintf("%s=%d", rev, pct))
+	}
+	sort.Strings(split)
+	return strings.Join(split, ",")
+}
+
+// runCanary deploys the tagged no-traffic revision and then shifts traffic to it step by step.
+// If a step or the verification after it fails, all traffic goes back to the revisions that served it before the rollout.
+func runCanary(b Backend, cfg *Config, deployPlan []string) error {
+	svc, err := b.DescribeService(cfg, cfg.ServiceName)
+	if err != nil {
+		return fmt.Errorf("canary rollouts need an existing service: %s", err)
+	}
+	prior := trafficSplit(svc.Status.Traffic)
+	if prior == "" {
+		return fmt.Errorf("canary rollouts need a service that is serving traffic, service %s isn't", cfg.ServiceName)
+	}
+
+	if err := ExecutePlan(b, cfg, deployPlan); err != nil {
+		return err
+	}
+
+	// check the tagged revision before it gets any traffic, nothing to revert yet
+	if err := verifyDeployment(b, cfg); err != nil {
+		return err
+	}
+
+	for i, pct := range cfg.CanarySteps {
+		b.Logf("Canary step %d/%d: routing %d%% of traffic to tag %s", i+1, len(cfg.CanarySteps), pct, cfg.Tag)
+
+		// the last step switches to --to-latest so the service keeps following future deploys
+		tcfg := trafficConfig(cfg, "to-tags", fmt.Sprintf("%s=%d", cfg.Tag, pct))
+		if pct == 100 {
+			tcfg = trafficConfig(cfg, "to-latest", "")
+		}
+		err := runPlan(b, tcfg)
+		if err == nil {
+			err = verifyDeployment(b, cfg)
+		}
+		if err != nil {
+			return revertTraffic(b, cfg, prior, fmt.Errorf("canary step %d%% failed: %s", pct, err))
+		}
+
+		if i < len(cfg.CanarySteps)-1 {
+			sleep(cfg.CanaryInterval)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	describeTwoRevisions = `{"status":{"url":"https://my-service-abc-uc.a.run.app","traffic":[
+		{"revisionName":"my-service-00001","percent":90},
+		{"revisionName":"my-service-00002","percent":10},
+		{"revisionName":"my-service-00002","tag":"old"}]}}`
+)
+
+func TestTrafficSplit(t *testing.T) {
+	traffic := []TrafficTarget{
+		{RevisionName: "rev-2", Percent: 10},
+		{RevisionName: "rev-1", Percent: 60},
+		{RevisionName: "rev-1", Percent: 30, Tag: "stable"},
+		{RevisionName: "rev-3", Tag: "unused"},
+	}
+	if s := trafficSplit(traffic); s != "rev-1=90,rev-2=10" {
+		t.Errorf("unexpected split: %s", s)
+	}
+}
+
+func TestRunCanary(t *testing.T) {
+	var slept []time.Duration
+	sleep = func(d time.Duration) { slept = append(slept, d) }
+	defer func() { sleep = time.Sleep }()
+
+	cfg := &Config{
+		Action: "canary", ServiceName: "my-service", ImageName: "my-image", Project: "my-project", Runtime: "managed",
+		Tag: "canary", CanarySteps: []int{5, 50, 100}, CanaryInterval: time.Second,
+	}
+
+	t.Run("success", func(t *testing.T) {
+		slept = nil
+		logFile := fakeGCloud(t, fakeResponse{match: "services describe", output: describeTwoRevisions})
+
+		if err := runConfig(cfg); err != nil {
+			t.Fatalf("runConfig() err: %s", err)
+		}
+
+		calls := strings.Join(readCalls(t, logFile), "\n")
+		for _, expected := range []string{
+			"run deploy my-service --image my-image",
+			"--tag canary --no-traffic",
+			"services update-traffic my-service --project my-project --platform managed --to-tags=canary=5",
+			"--to-tags=canary=50",
+			"--to-latest",
+		} {
+			if !strings.Contains(calls, expected) {
+				t.Errorf("expected call with [%s], got:\n%s", expected, calls)
+			}
+		}
+		if strings.Contains(calls, "--to-revisions") {
+			t.Errorf("didn't expect a revert, got:\n%s", calls)
+		}
+		if len(slept) != 2 {
+			t.Errorf("expected to wait between the 3 steps, waited %d times", len(slept))
+		}
+	})
+
+	t.Run("failed-step-reverts", func(t *testing.T) {
+		logFile := fakeGCloud(t,
+			fakeResponse{match: "services describe", output: describeTwoRevisions},
+			fakeResponse{match: "canary=50", exit: 1},
+		)
+
+		err := runConfig(cfg)
+		if err == nil || !strings.Contains(err.Error(), "canary step 50% failed") {
+			t.Fatalf("expected failed canary step, got err: %v", err)
+		}
+
+		calls := readCalls(t, logFile)
+		if last := calls[len(calls)-1]; !strings.Contains(last, "--to-revisions=my-service-00001=90,my-service-00002=10") {
+			t.Errorf("expected traffic revert as last call, got: %s", last)
+		}
+	})
+
+	t.Run("missing-service", func(t *testing.T) {
+		logFile := fakeGCloud(t, fakeResponse{match: "services describe", exit: 1})
+
+		if err := runConfig(cfg); err == nil {
+			t.Fatalf("expected canary of a missing service to fail")
+		}
+		for _, c := range readCalls(t, logFile) {
+			if strings.Contains(c, "run deploy") {
+				t.Errorf("shouldn't deploy without an existing service, got: %s", c)
+			}
+		}
+	})
+}
+
+func TestParseCanaryConfig(t *testing.T) {
+	os.Clearenv()
+	cfg := &Config{}
+	if err := parseCanaryConfig(cfg); err != nil {
+		t.Fatalf("parseCanaryConfig() err: %s", err)
+	}
+	if cfg.Tag != DefaultCanaryTag || cfg.CanaryInterval != DefaultCanaryInterval || fmt.Sprint(cfg.CanarySteps) != "[5 25 50 100]" {
+		t.Errorf("unexpected defaults: %#v", cfg)
+	}
+
+	os.Setenv("PLUGIN_CANARY_STEPS", "10, 100")
+	os.Setenv("PLUGIN_CANARY_INTERVAL", "30s")
+	cfg = &Config{Tag: "next"}
+	if err := parseCanaryConfig(cfg); err != nil {
+		t.Fatalf("parseCanaryConfig() err: %s", err)
+	}
+	if cfg.Tag != "next" || cfg.CanaryInterval != 30*time.Second || fmt.Sprint(cfg.CanarySteps) != "[10 100]" {
+		t.Errorf("unexpected config: %#v", cfg)
+	}
+
+	for _, steps := range []string{"0,100", "50,50", "10,120", "ten"} {
+		os.Setenv("PLUGIN_CANARY_STEPS", steps)
+		if err := parseCanaryConfig(&Config{}); err == nil {
+			t.Errorf("expected canary_steps %s to fail", steps)
+		}
+	}
+}
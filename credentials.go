@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"syscall"
+)
+
+// Credentials is the private per-run directory holding the key file or the workload identity
+// federation credential config and the gcloud config dir (CLOUDSDK_CONFIG) with gcloud's auth state
+type Credentials struct {
+	Dir       string
+	KeyFile   string
+	ConfigDir string
+
+	// Content is what got written to KeyFile
+	Content string
+
+	// External is set for workload identity federation ("external_account") credentials
+	External bool
+
+	cleanup sync.Once
+}
+
+func NewCredentials(cfg *Config) (*Credentials, error) {
+	dir, err := ioutil.TempDir("", "drone-cloud-run-")
+	if err != nil {
+		return nil, fmt.Errorf("error creating credentials dir: %s", err)
+	}
+
+	c := &Credentials{
+		Dir:       dir,
+		KeyFile:   filepath.Join(dir, "token.json"),
+		ConfigDir: filepath.Join(dir, "gcloud"),
+		Content:   cfg.Token,
+	}
+
+	if err := os.Mkdir(c.ConfigDir, 0700); err != nil {
+		c.Cleanup()
+		return nil, fmt.Errorf("error creating gcloud config dir: %s", err)
+	}
+
+	if cfg.CredentialConfig != "" {
+		c.External = true
+		c.KeyFile = filepath.Join(dir, "credential-config.json")
+		if c.Content, err = c.externalAccountConfig(cfg); err != nil {
+			c.Cleanup()
+			return nil, err
+		}
+	}
+
+	if err := ioutil.WriteFile(c.KeyFile, []byte(c.Content), 0600); err != nil {
+		c.Cleanup()
+		return nil, fmt.Errorf("error writing token file: %s", err)
+	}
+
+	return c, nil
+}
+
+// externalAccountConfig returns the credential config, pointed at a file with the
+// OIDC token if the token is passed in via the oidc_token setting
+func (c *Credentials) externalAccountConfig(cfg *Config) (string, error) {
+	if cfg.OIDCToken == "" {
+		return cfg.CredentialConfig, nil
+	}
+
+	tokenFile := filepath.Join(c.Dir, "oidc-token")
+	if err := ioutil.WriteFile(tokenFile, []byte(cfg.OIDCToken), 0600); err != nil {
+		return "", fmt.Errorf("error writing oidc token file: %s", err)
+	}
+
+	credCfg := map[string]interface{}{}
+	if err := json.Unmarshal([]byte(cfg.CredentialConfig), &credCfg); err != nil {
+		return "", fmt.Errorf("failed to parse credential_config: %s", err)
+	}
+	credCfg["credential_source"] = map[string]interface{}{
+		"file":   tokenFile,
+		"format": map[string]string{"type": "text"},
+	}
+
+	b, err := json.Marshal(credCfg)
+	return string(b), err
+}
+
+type externalAccountConfig struct {
+	Type                           string `json:"type"`
+	Audience                       string `json:"audience"`
+	SubjectTokenType               string `json:"subject_token_type"`
+	TokenURL                       string `json:"token_url"`
+	ServiceAccountImpersonationURL string `json:"service_account_impersonation_url"`
+	CredentialSource               struct {
+		File    string            `json:"file"`
+		URL     string            `json:"url"`
+		Headers map[string]string `json:"headers"`
+		Format  struct {
+			Type                  string `json:"type"`
+			SubjectTokenFieldName string `json:"subject_token_field_name"`
+		} `json:"format"`
+	} `json:"credential_source"`
+}
+
+func validateCredentialConfig(credCfg string) error {
+	c := externalAccountConfig{}
+	if err := json.Unmarshal([]byte(credCfg), &c); err != nil {
+		return fmt.Errorf("failed to parse credential_config: %s", err)
+	}
+	if c.Type != "external_account" {
+		return fmt.Errorf("credential_config has type [%s], expected external_account", c.Type)
+	}
+	if c.Audience == "" || c.TokenURL == "" || c.SubjectTokenType == "" {
+		return fmt.Errorf("credential_config is missing audience, token_url or subject_token_type")
+	}
+	return nil
+}
+
+var (
+	impersonatedProjectRe = regexp.MustCompile(`serviceAccounts/[^@/]+@([a-z0-9-]+)\.iam\.gserviceaccount\.com`)
+	audienceProjectRe     = regexp.MustCompile(`/projects/([0-9]+)/locations/`)
+)
+
+// getProjectFromCredentialConfig returns the project of the impersonated service account or,
+// if there is none, the project number from the workload identity pool audience
+func getProjectFromCredentialConfig(credCfg string) string {
+	c := externalAccountConfig{}
+	if err := json.Unmarshal([]byte(credCfg), &c); err != nil {
+		return ""
+	}
+	if m := impersonatedProjectRe.FindStringSubmatch(c.ServiceAccountImpersonationURL); m != nil {
+		return m[1]
+	}
+	if m := audienceProjectRe.FindStringSubmatch(c.Audience); m != nil {
+		return m[1]
+	}
+	return ""
+}
+
+// Env returns the environment variables pointing gcloud to the private config dir
+func (c *Credentials) Env() []string {
+	return []string{"CLOUDSDK_CONFIG=" + c.ConfigDir}
+}
+
+// Cleanup removes the key file and the gcloud config dir, it's safe to call more than once
+func (c *Credentials) Cleanup() {
+	c.cleanup.Do(func() {
+		if err := os.RemoveAll(c.Dir); err != nil {
+			log.Printf("Error removing credentials dir: %s", err)
+		}
+	})
+}
+
+// removeOnSignal removes the credentials and exits if the plugin gets interrupted or
+// terminated, e.g. when a build is cancelled. The returned func stops watching for signals.
+func removeOnSignal(c *Credentials) (stop func()) {
+	sigs := make(chan os.Signal, 1)
+	done := make(chan struct{})
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+
+	go func() {
+		select {
+		case sig := <-sigs:
+			log.Printf("Received %s, removing credentials", sig)
+			c.Cleanup()
+			os.Exit(1)
+		case <-done:
+		}
+	}()
+
+	return func() {
+		signal.Stop(sigs)
+		close(done)
+	}
+}
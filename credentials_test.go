@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestNewCredentials(t *testing.T) {
+	c, err := NewCredentials(&Config{Token: validGCPKey})
+	if err != nil {
+		t.Fatalf("NewCredentials() err: %s", err)
+	}
+
+	fi, err := os.Stat(c.KeyFile)
+	if err != nil {
+		t.Fatalf("Stat() err: %s", err)
+	}
+	if fi.Mode().Perm() != 0600 {
+		t.Errorf("expected key file to be private, got mode: %s", fi.Mode())
+	}
+	if b, _ := ioutil.ReadFile(c.KeyFile); string(b) != validGCPKey {
+		t.Errorf("unexpected key file content: %s", b)
+	}
+	if env := c.Env(); len(env) != 1 || env[0] != "CLOUDSDK_CONFIG="+c.ConfigDir {
+		t.Errorf("unexpected env: %v", env)
+	}
+
+	c.Cleanup()
+	c.Cleanup()
+	if _, err := os.Stat(c.Dir); !os.IsNotExist(err) {
+		t.Errorf("expected credentials dir to be removed, got err: %v", err)
+	}
+}
+
+func TestRunConfigRemovesCredentials(t *testing.T) {
+	for _, exitCode := range []string{"0", "1"} {
+		t.Run("exit-"+exitCode, func(t *testing.T) {
+			dir := t.TempDir()
+			logFile := filepath.Join(dir, "calls.log")
+
+			// records where the key file and config dir are and checks that they exist during the run
+			script := `#!/bin/sh
+if [ "$2" = "activate-service-account" ]; then
+  test -f "$4" || exit 2
+  test -d "$CLOUDSDK_CONFIG" || exit 3
+  echo "$4 $CLOUDSDK_CONFIG" >> ` + logFile + `
+fi
+case "$*" in *" deploy "*) exit ` + exitCode + ` ;; esac
+`
+			cmd := filepath.Join(dir, "gcloud")
+			if err := ioutil.WriteFile(cmd, []byte(script), 0700); err != nil {
+				t.Fatalf("WriteFile() err: %s", err)
+			}
+			GCloudCommand = cmd
+			defer func() { GCloudCommand = "gcloud" }()
+
+			cfg := &Config{Action: "deploy", ServiceName: "my-service", ImageName: "my-image", Project: "my-project", Runtime: "managed", Token: validGCPKey}
+			err := runConfig(cfg)
+			if exitCode == "0" && err != nil {
+				t.Fatalf("runConfig() err: %s", err)
+			} else if exitCode != "0" && err == nil {
+				t.Fatalf("runConfig() should have failed")
+			}
+
+			calls := readCalls(t, logFile)
+			paths := strings.Fields(calls[0])
+			if len(paths) != 2 || !strings.HasSuffix(paths[0], "token.json") {
+				t.Fatalf("unexpected key file and config dir: %v", calls)
+			}
+			for _, p := range paths {
+				if _, err := os.Stat(p); !os.IsNotExist(err) {
+					t.Errorf("expected %s to be removed, got err: %v", p, err)
+				}
+			}
+		})
+	}
+}
+
+func TestWorkloadIdentityCredentials(t *testing.T) {
+	dir := t.TempDir()
+	logFile := filepath.Join(dir, "calls.log")
+
+	// records the credential config gcloud logs in with
+	script := `#!/bin/sh
+if [ "$2" = "login" ]; then
+  cat "$4" >> ` + logFile + `
+fi
+`
+	cmd := filepath.Join(dir, "gcloud")
+	if err := ioutil.WriteFile(cmd, []byte(script), 0700); err != nil {
+		t.Fatalf("WriteFile() err: %s", err)
+	}
+	GCloudCommand = cmd
+	defer func() { GCloudCommand = "gcloud" }()
+
+	cfg := &Config{
+		Action: "deploy", ServiceName: "my-service", ImageName: "my-image", Project: "my-project", Runtime: "managed",
+		CredentialConfig: validCredentialConfig, OIDCToken: "oidc-token",
+	}
+	if err := runConfig(cfg); err != nil {
+		t.Fatalf("runConfig() err: %s", err)
+	}
+
+	calls := readCalls(t, logFile)
+	c := externalAccountConfig{}
+	if err := json.Unmarshal([]byte(strings.Join(calls, "\n")), &c); err != nil {
+		t.Fatalf("gcloud didn't log in with the credential config, got: %v", calls)
+	}
+	if !strings.HasSuffix(c.CredentialSource.File, "oidc-token") || c.CredentialSource.Format.Type != "text" {
+		t.Errorf("expected credential source to point at the oidc token file, got: %+v", c.CredentialSource)
+	}
+	if c.ServiceAccountImpersonationURL == "" {
+		t.Errorf("expected the rest of the credential config to be kept")
+	}
+	if _, err := os.Stat(c.CredentialSource.File); !os.IsNotExist(err) {
+		t.Errorf("expected oidc token file to be removed, got err: %v", err)
+	}
+}
+
+func TestImpersonateServiceAccount(t *testing.T) {
+	logFile := fakeGCloud(t, fakeResponse{match: "services describe", output: describeTwoRevisions})
+
+	cfg := &Config{
+		Action: "deploy", ServiceName: "my-service", ImageName: "my-image", Project: "my-project", Runtime: "managed", Token: validGCPKey,
+		ImpersonateServiceAccount: []string{"delegate@my-project.iam.gserviceaccount.com", "deployer@my-project.iam.gserviceaccount.com"},
+		RollbackOnFailure:         true,
+	}
+	if err := runConfig(cfg); err != nil {
+		t.Fatalf("runConfig() err: %s", err)
+	}
+
+	calls := readCalls(t, logFile)
+	if len(calls) != 4 {
+		t.Fatalf("expected version, auth, describe and deploy calls, got: %v", calls)
+	}
+	flag := "--impersonate-service-account delegate@my-project.iam.gserviceaccount.com,deployer@my-project.iam.gserviceaccount.com"
+	for i, call := range calls {
+		if authenticated := i >= 2; strings.HasSuffix(call, flag) != authenticated {
+			t.Errorf("unexpected impersonation in call: %s", call)
+		}
+	}
+}
@@ -0,0 +1,32 @@
+//go:build go1.18
+// +build go1.18
+
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func FuzzListArg(f *testing.F) {
+	for _, seed := range [][2]string{
+		{"1", "2"},
+		{"a:||:b", ":||"},
+		{"line one\nline two", "ünïcödé,=😀"},
+		{strings.Join(listDelimiters, ""), ""},
+	} {
+		f.Add(seed[0], seed[1])
+	}
+
+	f.Fuzz(func(t *testing.T, a, b string) {
+		items := []string{"A=" + a, "B=" + b}
+		arg, err := listArg(items)
+		if err != nil {
+			return
+		}
+		if split := splitListArg(t, arg); !reflect.DeepEqual(split, items) {
+			t.Errorf("expected: %q, got: %q from: %q", items, split, arg)
+		}
+	})
+}
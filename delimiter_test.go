@@ -0,0 +1,102 @@
+package main
+
+import (
+	"math/rand"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/quick"
+)
+
+// splitListArg parses a list argument the way gcloud does, see "gcloud topic escaping"
+func splitListArg(t *testing.T, arg string) []string {
+	if !strings.HasPrefix(arg, "^") {
+		return strings.Split(arg, ",")
+	}
+	end := strings.Index(arg[1:], "^")
+	if end < 1 {
+		t.Fatalf("invalid delimiter in: %q", arg)
+	}
+	return strings.Split(arg[end+2:], arg[1:end+1])
+}
+
+func TestListArg(t *testing.T) {
+	for _, tst := range []struct {
+		items       []string
+		expectedSep string
+	}{
+		{items: []string{"A=1", "B=2"}, expectedSep: ":||:"},
+		{items: []string{"A=a:||:b", "B=2"}, expectedSep: "@@"},
+		// ":||" followed by the delimiter contains a delimiter that starts too early
+		{items: []string{"A=:||", "B=2"}, expectedSep: "@@"},
+		{items: []string{"A=:||:@@##", "B=~~"}, expectedSep: ";;"},
+		{items: []string{"A=line one\nline two, with commas", "B=ünïcödé=😀"}, expectedSep: ":||:"},
+	} {
+		arg, err := listArg(tst.items)
+		if err != nil {
+			t.Fatalf("listArg() err: %s", err)
+		}
+		if !strings.HasPrefix(arg, "^"+tst.expectedSep+"^") {
+			t.Errorf("expected delimiter %s, got: %q", tst.expectedSep, arg)
+		}
+		if split := splitListArg(t, arg); !reflect.DeepEqual(split, tst.items) {
+			t.Errorf("expected: %q, got: %q", tst.items, split)
+		}
+	}
+
+	if _, err := listArg([]string{"A=" + strings.Join(listDelimiters, "")}); err == nil {
+		t.Errorf("expected an error when every delimiter appears in a value")
+	}
+
+	cfg := &Config{Action: "deploy", ServiceName: "my-service", ImageName: "my-image", Environment: map[string]string{"A": strings.Join(listDelimiters, "")}}
+	if _, err := CreateExecutionPlan(cfg); err == nil || !strings.Contains(err.Error(), "env vars") {
+		t.Errorf("expected the plan to fail naming the env vars, got: %v", err)
+	}
+}
+
+// delimiterHeavyString generates values made of delimiter fragments and other
+// characters that commonly break list parsing
+type delimiterHeavyString string
+
+func (delimiterHeavyString) Generate(r *rand.Rand, size int) reflect.Value {
+	parts := []string{":", "|", "@", "#", "~", ";", "%", "!", "&", "*", "+", ",", "=", "^", "\n", " ", "a", "ü", "😀", "\x00"}
+	var b strings.Builder
+	for i := r.Intn(size + 1); i > 0; i-- {
+		b.WriteString(parts[r.Intn(len(parts))])
+	}
+	return reflect.ValueOf(delimiterHeavyString(b.String()))
+}
+
+func TestListArgRoundTrip(t *testing.T) {
+	roundTrips := func(values []delimiterHeavyString) bool {
+		items := make([]string, len(values))
+		for i, v := range values {
+			items[i] = "KEY=" + string(v)
+		}
+		arg, err := listArg(items)
+		if err != nil {
+			// only acceptable if no delimiter can work
+			for _, sep := range listDelimiters {
+				if splitsInto(strings.Join(items, sep), sep, items) {
+					return false
+				}
+			}
+			return true
+		}
+		return reflect.DeepEqual(splitListArg(t, arg), items)
+	}
+	if err := quick.Check(roundTrips, &quick.Config{MaxCount: 2000}); err != nil {
+		t.Error(err)
+	}
+	if err := quick.Check(func(values []string) bool { return roundTrips(toDelimiterHeavy(values)) }, nil); err != nil {
+		t.Error(err)
+	}
+}
+
+func toDelimiterHeavy(values []string) []delimiterHeavyString {
+	converted := make([]delimiterHeavyString, len(values))
+	for i, v := range values {
+		converted[i] = delimiterHeavyString(v)
+	}
+	return converted
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	settingAdded   = "+"
+	settingRemoved = "-"
+	settingChanged = "~"
+)
+
+// settingChange is a setting whose live value differs from the configured one
+type settingChange struct {
+	op      string
+	setting string
+	live    string
+	desired string
+}
+
+func (c settingChange) String() string {
+	switch c.op {
+	case settingAdded:
+		return fmt.Sprintf("+ %s: %s", c.setting, c.desired)
+	case settingRemoved:
+		return fmt.Sprintf("- %s: %s", c.setting, c.live)
+	}
+	return fmt.Sprintf("~ %s: %s -> %s", c.setting, c.live, c.desired)
+}
+
+// desiredSettings returns what deploying cfg sets, keyed like liveSettings(). Settings that aren't
+// configured are left alone by a deploy and aren't compared. It also returns the live settings a
+// deploy removes: the env vars and secrets of remove_env and remove_secrets and, unless env_mode is
+// merge, all env vars and secrets that aren't set, as the prefixes ending in ".".
+func desiredSettings(cfg *Config) (map[string]string, []string, error) {
+	settings := map[string]string{
+		"allow_unauthenticated": strconv.FormatBool(cfg.AllowUnauthenticated),
+	}
+	var removed []string
+	merge := cfg.EnvMode == EnvModeMerge
+
+	if cfg.ImageName != "" {
+		settings["image"] = cfg.ImageName
+	}
+	if cfg.Memory != "" {
+		settings["memory"] = cfg.Memory
+	}
+	if cfg.Concurrency != "" {
+		n, err := strconv.Atoi(cfg.Concurrency)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid concurrency: [%s]", cfg.Concurrency)
+		}
+		settings["concurrency"] = strconv.Itoa(n)
+	}
+	if cfg.Timeout != "" {
+		d, err := apiDuration(cfg.Timeout)
+		if err != nil {
+			return nil, nil, err
+		}
+		settings["timeout"] = d
+	}
+	if cfg.SvcAccount != "" {
+		settings["svc_account"] = cfg.SvcAccount
+	}
+
+	if len(cfg.EnvSecrets)+len(cfg.Environment) > 0 {
+		if !merge {
+			removed = append(removed, "env.")
+		}
+		for _, kv := range cfg.EnvSecrets {
+			s := strings.SplitN(kv, "=", 2)
+			settings["env."+s[0]] = s[1]
+		}
+		for k, v := range cfg.Environment {
+			settings["env."+k] = v
+		}
+	}
+
+	if len(cfg.Secrets) > 0 {
+		if !merge {
+			removed = append(removed, "secrets.")
+		}
+		for k, v := range cfg.Secrets {
+			ref := strings.SplitN(v, ":", 2)
+			if len(ref) == 1 {
+				ref = append(ref, "latest")
+			}
+			settings["secrets."+k] = ref[0] + ":" + ref[1]
+		}
+	}
+	for _, k := range cfg.RemoveEnv {
+		removed = append(removed, "env."+k)
+	}
+	for _, k := range cfg.RemoveSecrets {
+		removed = append(removed, "secrets."+k)
+	}
+	return settings, removed, nil
+}
+
+// liveSettings returns the settings of an exported Knative service, keyed like desiredSettings()
+func liveSettings(svc map[string]interface{}, public bool) map[string]string {
+	settings := map[string]string{
+		"allow_unauthenticated": strconv.FormatBool(public),
+	}
+	set := func(setting string, v interface{}) {
+		if v != nil && v != "" {
+			settings[setting] = fmt.Sprint(v)
+		}
+	}
+
+	spec := object(object(object(svc, "spec"), "template"), "spec")
+	set("concurrency", spec["containerConcurrency"])
+	if v, ok := spec["timeoutSeconds"]; ok {
+		set("timeout", fmt.Sprintf("%vs", v))
+	}
+	set("svc_account", spec["serviceAccountName"])
+
+	containers, _ := spec["containers"].([]interface{})
+	if len(containers) == 0 {
+		return settings
+	}
+	c, _ := containers[0].(map[string]interface{})
+	if c == nil {
+		return settings
+	}
+	set("image", c["image"])
+	set("memory", object(object(c, "resources"), "limits")["memory"])
+
+	env, _ := c["env"].([]interface{})
+	for _, e := range env {
+		em, _ := e.(map[string]interface{})
+		name := fmt.Sprint(em["name"])
+		if ref, ok := object(object(em, "valueFrom"), "secretKeyRef")["name"]; ok {
+			settings["secrets."+name] = fmt.Sprintf("%v:%v", ref, object(object(em, "valueFrom"), "secretKeyRef")["key"])
+			continue
+		}
+		// env vars with an empty value are exported without one
+		settings["env."+name] = ""
+		if v, ok := em["value"]; ok && v != nil {
+			settings["env."+name] = fmt.Sprint(v)
+		}
+	}
+
+	// secrets mounted as files, keyed by their path like in the secrets setting
+	mountPaths := map[string]string{}
+	mounts, _ := c["volumeMounts"].([]interface{})
+	for _, m := range mounts {
+		mm, _ := m.(map[string]interface{})
+		mountPaths[fmt.Sprint(mm["name"])] = fmt.Sprint(mm["mountPath"])
+	}
+	volumes, _ := spec["volumes"].([]interface{})
+	for _, v := range volumes {
+		vm, _ := v.(map[string]interface{})
+		secret, ok := vm["secret"].(map[string]interface{})
+		mountPath, mounted := mountPaths[fmt.Sprint(vm["name"])]
+		if !ok || !mounted {
+			continue
+		}
+		items, _ := secret["items"].([]interface{})
+		for _, i := range items {
+			im, _ := i.(map[string]interface{})
+			settings["secrets."+path.Join(mountPath, fmt.Sprint(im["path"]))] = fmt.Sprintf("%v:%v", secret["secretName"], im["key"])
+		}
+	}
+	return settings
+}
+
+// diffSettings returns the changes a deploy would make, sorted by setting
+func diffSettings(live, desired map[string]string, removed []string) []settingChange {
+	var changes []settingChange
+	for setting, d := range desired {
+		switch l, ok := live[setting]; {
+		case !ok:
+			changes = append(changes, settingChange{op: settingAdded, setting: setting, desired: d})
+		case l != d:
+			changes = append(changes, settingChange{op: settingChanged, setting: setting, live: l, desired: d})
+		}
+	}
+	for setting, l := range live {
+		if _, ok := desired[setting]; ok {
+			continue
+		}
+		for _, r := range removed {
+			if setting == r || strings.HasSuffix(r, ".") && strings.HasPrefix(setting, r) {
+				changes = append(changes, settingChange{op: settingRemoved, setting: setting, live: l})
+				break
+			}
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].setting < changes[j].setting })
+	return changes
+}
+
+// serviceDrift compares the live service with the settings of cfg, the values of
+// env_secret_* settings are masked on both sides
+func serviceDrift(b Backend, cfg *Config) ([]settingChange, error) {
+	desired, removed, err := desiredSettings(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	svc, err := b.ExportService(cfg, cfg.ServiceName)
+	if err != nil {
+		return nil, err
+	}
+	public, err := b.AllowsUnauthenticated(cfg, cfg.ServiceName)
+	if err != nil {
+		return nil, err
+	}
+
+	changes := diffSettings(liveSettings(svc, public), desired, removed)
+	for _, kv := range cfg.EnvSecrets {
+		setting := "env." + strings.SplitN(kv, "=", 2)[0]
+		for i := range changes {
+			if changes[i].setting != setting {
+				continue
+			}
+			changes[i].live, changes[i].desired = RedactedValue, RedactedValue
+		}
+	}
+	return changes, nil
+}
+
+// reportDrift logs the drift of the service and returns how many settings changed
+func reportDrift(b Backend, cfg *Config) (int, error) {
+	changes, err := serviceDrift(b, cfg)
+	if err != nil {
+		return 0, err
+	}
+	if len(changes) == 0 {
+		b.Logf("No drift, service %s matches the settings", cfg.ServiceName)
+		return 0, nil
+	}
+
+	lines := make([]string, len(changes))
+	for i, c := range changes {
+		lines[i] = "  " + c.String()
+	}
+	b.Logf("Drift of service %s, live -> settings:\n%s", cfg.ServiceName, strings.Join(lines, "\n"))
+	return len(changes), nil
+}
+
+// runDiff reports the drift of the service and, with fail_on_drift set, fails if there is any
+func runDiff(b Backend, cfg *Config) error {
+	n, err := reportDrift(b, cfg)
+	if err != nil {
+		return err
+	}
+	if n > 0 && cfg.FailOnDrift {
+		return fmt.Errorf("service %s drifted from the settings, %d changed", cfg.ServiceName, n)
+	}
+	return nil
+}
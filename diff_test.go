@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLiveSettings(t *testing.T) {
+	v, err := parseYAML([]byte(exportedService))
+	if err != nil {
+		t.Fatalf("parseYAML() err: %s", err)
+	}
+
+	expected := map[string]string{
+		"allow_unauthenticated": "true",
+		"concurrency":           "80",
+		"env.EMPTY":             "",
+		"env.GREETING":          "hello: world",
+		"env.SCRIPT":            "echo one\necho two\n",
+		"image":                 "us-docker.pkg.dev/my-project/repo/my-image@sha256:0123abcd",
+		"memory":                "512Mi",
+		"secrets.API_KEY":       "api-key:latest",
+		"svc_account":           "runtime@my-project.iam.gserviceaccount.com",
+		"timeout":               "300s",
+	}
+	if live := liveSettings(v.(map[string]interface{}), true); !reflect.DeepEqual(live, expected) {
+		t.Errorf("expected: %v, got: %v", expected, live)
+	}
+}
+
+func TestDiffSettings(t *testing.T) {
+	cfg := &Config{
+		ImageName: "my-image:v2", Memory: "512Mi", Timeout: "10m",
+		Environment: map[string]string{"GREETING": "hello", "NEW": "1"},
+	}
+	desired, replaced, err := desiredSettings(cfg)
+	if err != nil {
+		t.Fatalf("desiredSettings() err: %s", err)
+	}
+
+	live := map[string]string{
+		"allow_unauthenticated": "true",
+		"concurrency":           "80",
+		"env.GREETING":          "hello",
+		"env.OLD":               "x",
+		"image":                 "my-image:v1",
+		"memory":                "512Mi",
+		"secrets.API_KEY":       "api-key:latest",
+	}
+
+	// concurrency and secrets aren't configured, a deploy leaves them alone
+	var changes []string
+	for _, c := range diffSettings(live, desired, replaced) {
+		changes = append(changes, c.String())
+	}
+	expected := []string{
+		"~ allow_unauthenticated: true -> false",
+		"+ env.NEW: 1",
+		"- env.OLD: x",
+		"~ image: my-image:v1 -> my-image:v2",
+		"+ timeout: 600s",
+	}
+	if !reflect.DeepEqual(changes, expected) {
+		t.Errorf("expected: %q, got: %q", expected, changes)
+	}
+}
+
+func TestDiffSettingsMerge(t *testing.T) {
+	cfg := &Config{
+		ImageName: "my-image:v1", EnvMode: EnvModeMerge,
+		Environment:   map[string]string{"NEW": "1"},
+		Secrets:       map[string]string{"API_KEY": "api-key:2"},
+		RemoveEnv:     []string{"OLD"},
+		RemoveSecrets: []string{"/etc/tls/cert.pem"},
+	}
+	desired, removed, err := desiredSettings(cfg)
+	if err != nil {
+		t.Fatalf("desiredSettings() err: %s", err)
+	}
+
+	live := map[string]string{
+		"allow_unauthenticated":     "false",
+		"env.KEEP":                  "x",
+		"env.OLD":                   "y",
+		"env.OLDER":                 "z",
+		"image":                     "my-image:v1",
+		"secrets.API_KEY":           "api-key:1",
+		"secrets./etc/tls/cert.pem": "tls-cert:latest",
+	}
+
+	// env vars and secrets that aren't set or removed are left alone
+	var changes []string
+	for _, c := range diffSettings(live, desired, removed) {
+		changes = append(changes, c.String())
+	}
+	expected := []string{
+		"+ env.NEW: 1",
+		"- env.OLD: y",
+		"- secrets./etc/tls/cert.pem: tls-cert:latest",
+		"~ secrets.API_KEY: api-key:1 -> api-key:2",
+	}
+	if !reflect.DeepEqual(changes, expected) {
+		t.Errorf("expected: %q, got: %q", expected, changes)
+	}
+}
+
+func TestRunDiff(t *testing.T) {
+	for _, tst := range []struct {
+		name          string
+		cfg           Config
+		expectedOk    bool
+		expectedDrift []string
+	}{
+		{
+			name: "no-drift",
+			cfg: Config{
+				ImageName: "us-docker.pkg.dev/my-project/repo/my-image@sha256:0123abcd", Memory: "512Mi", Concurrency: "80",
+				Secrets: map[string]string{"API_KEY": "api-key"}, AllowUnauthenticated: true, FailOnDrift: true,
+			},
+			expectedOk:    true,
+			expectedDrift: []string{"No drift, service my-service matches the settings"},
+		},
+		{
+			name:          "drift",
+			cfg:           Config{Memory: "1Gi", EnvSecrets: []string{"GREETING=hunter2"}, AllowUnauthenticated: true},
+			expectedOk:    true,
+			expectedDrift: []string{"~ memory: 512Mi -> 1Gi", "~ env.GREETING: ******** -> ********", "- env.SCRIPT: echo one"},
+		},
+		{
+			name:          "fail-on-drift",
+			cfg:           Config{Timeout: "300", FailOnDrift: true},
+			expectedDrift: []string{"~ allow_unauthenticated: true -> false"},
+		},
+	} {
+		t.Run(tst.name, func(t *testing.T) {
+			logFile := fakeGCloud(t,
+				fakeResponse{match: "services describe my-service --format export", output: exportedService},
+				fakeResponse{match: "services get-iam-policy my-service", output: `{"bindings":[{"role":"roles/run.invoker","members":["allUsers"]}]}`},
+			)
+
+			logs := &bytes.Buffer{}
+			log.SetOutput(logs)
+			defer log.SetOutput(os.Stderr)
+
+			cfg := tst.cfg
+			cfg.Action, cfg.ServiceName, cfg.Project, cfg.Runtime, cfg.Token = "diff", "my-service", "my-project", "managed", validGCPKey
+			err := runConfig(&cfg)
+			if (err == nil) != tst.expectedOk {
+				t.Fatalf("runConfig() err: %v", err)
+			}
+
+			for _, expected := range tst.expectedDrift {
+				if !strings.Contains(logs.String(), expected) {
+					t.Errorf("expected %q in the logs, got:\n%s", expected, logs.String())
+				}
+			}
+			if strings.Contains(logs.String(), "hunter2") {
+				t.Errorf("secret leaked into the logs:\n%s", logs.String())
+			}
+
+			// diff only reads the service
+			for _, call := range readCalls(t, logFile)[2:] {
+				if !strings.Contains(call, "describe") && !strings.Contains(call, "get-iam-policy") {
+					t.Errorf("unexpected call: %s", call)
+				}
+			}
+		})
+	}
+}
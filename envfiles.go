@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+var envKeyRe = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// parseEnvFiles loads the env_files, relative to cfg.Dir, and merges them into cfg.Environment.
+// From lowest to highest precedence: the env_files in the order they're listed, env_secret_*
+// and environment. Every variable that's set more than once is logged.
+func parseEnvFiles(cfg *Config) error {
+	value, err := interpolatedSettingValue("env_files")
+	if err != nil {
+		return err
+	}
+	var files []string
+	for _, f := range strings.Split(value, ",") {
+		if f = strings.TrimSpace(f); f != "" {
+			files = append(files, f)
+		}
+	}
+	if len(files) == 0 {
+		return nil
+	}
+
+	merged := map[string]string{}
+	source := map[string]string{}
+	for _, f := range files {
+		vars, err := loadEnvFile(filepath.Join(cfg.Dir, f))
+		if err != nil {
+			return err
+		}
+		for _, k := range sortedKeys(vars) {
+			if s, ok := source[k]; ok {
+				log.Printf("Env var %s of %s overrides the one of %s", k, f, s)
+			}
+			merged[k], source[k] = vars[k], f
+		}
+	}
+
+	for _, kv := range cfg.EnvSecrets {
+		k := strings.SplitN(kv, "=", 2)[0]
+		if s, ok := source[k]; ok {
+			log.Printf("Env var %s of env_secret_%s overrides the one of %s", k, strings.ToLower(k), s)
+			delete(merged, k)
+		}
+		source[k] = "env_secret_" + strings.ToLower(k)
+	}
+
+	for _, k := range sortedKeys(cfg.Environment) {
+		if s, ok := source[k]; ok {
+			log.Printf("Env var %s of environment overrides the one of %s", k, s)
+		}
+		merged[k] = cfg.Environment[k]
+	}
+	cfg.Environment = merged
+
+	// only the names, the values can be sensitive
+	keys := make([]string, 0, len(source))
+	for k := range source {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	log.Printf("Env vars after merging env_files: %s", strings.Join(keys, ", "))
+	return nil
+}
+
+// loadEnvFile reads the variables of a .yaml/.yml, .json or, for every other extension, dotenv file
+func loadEnvFile(path string) (map[string]string, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read env file: %s", err)
+	}
+
+	var vars map[string]string
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		vars, err = parseYAMLEnv(b)
+	case ".json":
+		var m settingsMap
+		err = json.Unmarshal(b, &m)
+		vars = m
+	default:
+		vars, err = parseDotenv(b)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse env file %s: %s", filepath.Base(path), err)
+	}
+
+	for k := range vars {
+		if !envKeyRe.MatchString(k) {
+			return nil, fmt.Errorf("invalid env var name in %s: [%s]", filepath.Base(path), k)
+		}
+	}
+	return vars, nil
+}
+
+// parseYAMLEnv reads a flat YAML map. Scalars are taken as written, like in environment, so 1.10
+// stays 1.10 and 0x1F stays 0x1F, and null is an empty value.
+func parseYAMLEnv(b []byte) (map[string]string, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(b, &doc); err != nil {
+		return nil, err
+	}
+	vars := map[string]string{}
+	if len(doc.Content) == 0 {
+		return vars, nil
+	}
+	m := doc.Content[0]
+	if m.Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("expected a map of env vars")
+	}
+
+	for i := 0; i+1 < len(m.Content); i += 2 {
+		k, v := m.Content[i].Value, m.Content[i+1]
+		if v.Kind == yaml.AliasNode {
+			v = v.Alias
+		}
+		switch {
+		case v.Kind != yaml.ScalarNode:
+			return nil, fmt.Errorf("invalid value of %s, expected a string, number, boolean or null", k)
+		case v.Tag == "!!null":
+			vars[k] = ""
+		default:
+			vars[k] = v.Value
+		}
+	}
+	return vars, nil
+}
+
+// parseDotenv reads KEY=value lines with an optional "export " prefix. Values can be single quoted,
+// taken literally, or double quoted, with \n, \r, \t, \" and \\ escapes and spanning multiple lines.
+// Unquoted values end at a " #" comment and are trimmed.
+func parseDotenv(b []byte) (map[string]string, error) {
+	vars := map[string]string{}
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		text = strings.TrimPrefix(text, "export ")
+
+		eq := strings.Index(text, "=")
+		if eq < 0 {
+			return nil, fmt.Errorf("line %d: expected KEY=value", line)
+		}
+		key, value := strings.TrimSpace(text[:eq]), strings.TrimSpace(text[eq+1:])
+
+		switch {
+		case strings.HasPrefix(value, "'"):
+			end := strings.Index(value[1:], "'")
+			if end < 0 {
+				return nil, fmt.Errorf("line %d: unterminated single quoted value of %s", line, key)
+			}
+			value = value[1 : end+1]
+
+		case strings.HasPrefix(value, `"`):
+			start := line
+			raw := value[1:]
+			for {
+				v, ok, err := unescapeDotenv(raw)
+				if err != nil {
+					return nil, fmt.Errorf("line %d: %s", line, err)
+				}
+				if ok {
+					value = v
+					break
+				}
+				if !scanner.Scan() {
+					return nil, fmt.Errorf("line %d: unterminated double quoted value of %s", start, key)
+				}
+				line++
+				raw += "\n" + scanner.Text()
+			}
+
+		default:
+			if i := strings.Index(value, " #"); i >= 0 {
+				value = strings.TrimSpace(value[:i])
+			}
+		}
+
+		if _, ok := vars[key]; ok {
+			return nil, fmt.Errorf("line %d: %s is set more than once", line, key)
+		}
+		vars[key] = value
+	}
+	return vars, scanner.Err()
+}
+
+// unescapeDotenv returns the value of a double quoted string up to its closing quote,
+// ok is false if the closing quote hasn't been found yet
+func unescapeDotenv(s string) (value string, ok bool, err error) {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '"':
+			return b.String(), true, nil
+		case c == '\\' && i+1 < len(s):
+			i++
+			switch s[i] {
+			case 'n':
+				b.WriteByte('\n')
+			case 'r':
+				b.WriteByte('\r')
+			case 't':
+				b.WriteByte('\t')
+			case '"', '\\', '$':
+				b.WriteByte(s[i])
+			default:
+				return "", false, fmt.Errorf("unknown escape sequence: \\%c", s[i])
+			}
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return "", false, nil
+}
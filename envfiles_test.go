@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseDotenv(t *testing.T) {
+	vars, err := parseDotenv([]byte(`# deploy/prod.env
+LOG_LEVEL=info
+export REGION = us-central1
+EMPTY=
+COMMENTED=value # not part of the value
+HASH=a#b
+SINGLE='literal \n $HOME # kept'
+DOUBLE="tab\there \"quoted\" \\ \$HOME"
+MULTI="line one
+line two"
+URL=postgres://user@host:5432/db?sslmode=disable
+`))
+	if err != nil {
+		t.Fatalf("parseDotenv() err: %s", err)
+	}
+
+	expected := map[string]string{
+		"LOG_LEVEL": "info",
+		"REGION":    "us-central1",
+		"EMPTY":     "",
+		"COMMENTED": "value",
+		"HASH":      "a#b",
+		"SINGLE":    `literal \n $HOME # kept`,
+		"DOUBLE":    "tab\there \"quoted\" \\ $HOME",
+		"MULTI":     "line one\nline two",
+		"URL":       "postgres://user@host:5432/db?sslmode=disable",
+	}
+	if !reflect.DeepEqual(vars, expected) {
+		t.Errorf("expected: %#v, got: %#v", expected, vars)
+	}
+
+	for _, doc := range []string{
+		"NO_VALUE\n",
+		"A='unterminated\n",
+		"A=\"unterminated\nB=1\n",
+		"A=\"\\x\"\n",
+		"A=1\nA=2\n",
+	} {
+		if _, err := parseDotenv([]byte(doc)); err == nil {
+			t.Errorf("expected an error for: %q", doc)
+		}
+	}
+}
+
+func TestLoadEnvFile(t *testing.T) {
+	dir := t.TempDir()
+	for name, tst := range map[string]struct {
+		content  string
+		expected map[string]string
+	}{
+		"staging.yaml": {content: "PORT: 8080\nDEBUG: true\nRATIO: 0.5\nGREETING: 'hello: world'\nEMPTY:\n", expected: map[string]string{"PORT": "8080", "DEBUG": "true", "RATIO": "0.5", "GREETING": "hello: world", "EMPTY": ""}},
+		"as-written.yml": {
+			content:  "VERSION: 1.10\nHEX: 0x1F\nDATE: 2024-01-02\nBIG: 12345678901234567890\nNULL: null\nTILDE: ~\nON: yes\n",
+			expected: map[string]string{"VERSION": "1.10", "HEX": "0x1F", "DATE": "2024-01-02", "BIG": "12345678901234567890", "NULL": "", "TILDE": "", "ON": "yes"},
+		},
+		"empty.yml":       {content: "# nothing yet\n", expected: map[string]string{}},
+		"dev.json":        {content: `{"PORT": 8080, "NAME": "api"}`, expected: map[string]string{"PORT": "8080", "NAME": "api"}},
+		"nested.yaml":     {content: "DB:\n  HOST: localhost\n"},
+		"list.yaml":       {content: "- A=1\n"},
+		"list-value.yaml": {content: "HOSTS:\n  - a\n  - b\n"},
+		"nested.json":     {content: `{"DB": {"HOST": "localhost"}}`},
+		"bad-key.env":     {content: "MY-VAR=1\n"},
+	} {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte(tst.content), 0600); err != nil {
+			t.Fatalf("WriteFile() err: %s", err)
+		}
+		vars, err := loadEnvFile(path)
+		if (err == nil) != (tst.expected != nil) {
+			t.Errorf("%s: unexpected err: %v", name, err)
+			continue
+		}
+		if tst.expected != nil && !reflect.DeepEqual(vars, tst.expected) {
+			t.Errorf("%s: expected: %#v, got: %#v", name, tst.expected, vars)
+		}
+	}
+
+	if _, err := loadEnvFile(filepath.Join(dir, "missing.env")); err == nil {
+		t.Errorf("expected an error for a missing file")
+	}
+}
+
+func TestParseEnvFiles(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "deploy"), 0700); err != nil {
+		t.Fatalf("MkdirAll() err: %s", err)
+	}
+	for name, content := range map[string]string{
+		"deploy/base.env":     "LOG_LEVEL=info\nREGION=us\nAPI_KEY=from-file\nBASE=1\n",
+		"deploy/staging.yaml": "LOG_LEVEL: debug\nSTAGING: true\n",
+	} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0600); err != nil {
+			t.Fatalf("WriteFile() err: %s", err)
+		}
+	}
+
+	logs := &bytes.Buffer{}
+	log.SetOutput(logs)
+	defer log.SetOutput(os.Stderr)
+
+	os.Clearenv()
+	os.Setenv("PLUGIN_ENV_FILES", "deploy/base.env, deploy/staging.yaml")
+	cfg := &Config{
+		Dir:         dir,
+		Environment: map[string]string{"REGION": "eu"},
+		EnvSecrets:  []string{"API_KEY=s3cr3t"},
+	}
+	if err := parseEnvFiles(cfg); err != nil {
+		t.Fatalf("parseEnvFiles() err: %s", err)
+	}
+
+	// the env_secret_* variable isn't in environment so it's passed on its own
+	expected := map[string]string{"LOG_LEVEL": "debug", "REGION": "eu", "BASE": "1", "STAGING": "true"}
+	if !reflect.DeepEqual(cfg.Environment, expected) {
+		t.Errorf("expected: %#v, got: %#v", expected, cfg.Environment)
+	}
+
+	out := logs.String()
+	for _, line := range []string{
+		"Env var LOG_LEVEL of deploy/staging.yaml overrides the one of deploy/base.env",
+		"Env var API_KEY of env_secret_api_key overrides the one of deploy/base.env",
+		"Env var REGION of environment overrides the one of deploy/base.env",
+		"Env vars after merging env_files: API_KEY, BASE, LOG_LEVEL, REGION, STAGING",
+	} {
+		if !strings.Contains(out, line) {
+			t.Errorf("expected %q in the logs, got:\n%s", line, out)
+		}
+	}
+	if strings.Contains(out, "s3cr3t") || strings.Contains(out, "from-file") {
+		t.Errorf("values leaked into the logs:\n%s", out)
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// FingerprintLabel is the service label holding the fingerprint of the settings of the last deploy
+const FingerprintLabel = "drone-cloud-run-fingerprint"
+
+// using a var so tests don't reach out to registries, see registry.go
+var lookupDigest = imageDigest
+
+// imageDigest returns the digest the image points to, looking it up in the registry if it's not pinned
+func imageDigest(b Backend, image string) (string, error) {
+	ref, err := parseImageRef(image)
+	if err != nil {
+		return "", err
+	}
+	if ref.digest != "" {
+		return ref.digest, nil
+	}
+	return manifestDigest(b, ref)
+}
+
+// fingerprint returns a hash of everything a deploy of cfg sets, with the image tag replaced by
+// the digest it points to, so an unchanged fingerprint means a deploy wouldn't change anything
+func fingerprint(cfg *Config, digest string) string {
+	ref, _ := parseImageRef(cfg.ImageName)
+	image := digest
+	if ref != nil {
+		image = ref.name + "@" + digest
+	}
+
+	// encoding/json sorts the map keys, so the same settings always hash the same
+	b, _ := json.Marshal(struct {
+		Image                string
+		Variant              string
+		SvcAccount           string
+		AllowUnauthenticated bool
+		Concurrency          string
+		Memory               string
+		Timeout              string
+		Environment          map[string]string
+		EnvSecrets           map[string]string
+		Secrets              map[string]string
+		EnvMode              string
+		RemoveEnv            []string
+		RemoveSecrets        []string
+		Tag                  string
+		NoTraffic            bool
+		AdditionalFlags      map[string]string
+		Labels               map[string]string
+	}{
+		Image:                image,
+		Variant:              cfg.Variant,
+		SvcAccount:           cfg.SvcAccount,
+		AllowUnauthenticated: cfg.AllowUnauthenticated,
+		Concurrency:          cfg.Concurrency,
+		Memory:               cfg.Memory,
+		Timeout:              cfg.Timeout,
+		Environment:          cfg.Environment,
+		EnvSecrets:           envSecretsMap(cfg.EnvSecrets),
+		Secrets:              cfg.Secrets,
+		EnvMode:              cfg.EnvMode,
+		RemoveEnv:            cfg.RemoveEnv,
+		RemoveSecrets:        cfg.RemoveSecrets,
+		Tag:                  cfg.Tag,
+		NoTraffic:            cfg.NoTraffic,
+		AdditionalFlags:      cfg.AdditionalFlags,
+		Labels:               cfg.Labels,
+	})
+
+	// label values are limited to 63 characters, 128 bits are plenty
+	return fmt.Sprintf("%x", sha256.Sum256(b))[:32]
+}
+
+// envSecretsMap returns the env_secret_* settings as map
+func envSecretsMap(envSecrets []string) map[string]string {
+	m := map[string]string{}
+	for _, kv := range envSecrets {
+		if s := strings.SplitN(kv, "=", 2); len(s) == 2 {
+			m[s[0]] = s[1]
+		}
+	}
+	return m
+}
+
+// fingerprintDeploy returns cfg with the fingerprint of its settings and whether the live service
+// was deployed with the same fingerprint and serves it, in which case the deploy can be skipped.
+// Without a digest, e.g. because the registry doesn't support the v2 API, there's no fingerprint
+// and the deploy always runs. With skip_image_check the registry isn't asked, only images pinned
+// to a digest get a fingerprint.
+func fingerprintDeploy(b Backend, cfg *Config) (*Config, bool, error) {
+	if cfg.SkipImageCheck {
+		if ref, err := parseImageRef(cfg.ImageName); err != nil || ref.digest == "" {
+			b.Logf("skip_image_check is set and image %s isn't pinned to a digest, deploying without a fingerprint", cfg.ImageName)
+			return cfg, false, nil
+		}
+	}
+	digest, err := lookupDigest(b, cfg.ImageName)
+	if err != nil {
+		b.Logf("Couldn't get the digest of image %s, deploying without a fingerprint: %s", cfg.ImageName, err)
+		return cfg, false, nil
+	}
+
+	fcfg := *cfg
+	fcfg.Fingerprint = fingerprint(cfg, digest)
+	if cfg.Force {
+		b.Logf("Deploying with force, settings fingerprint: %s", fcfg.Fingerprint)
+		return &fcfg, false, nil
+	}
+
+	svc, err := b.DescribeService(cfg, cfg.ServiceName)
+	if err != nil {
+		// most likely the service doesn't exist yet
+		return &fcfg, false, nil
+	}
+	if svc.Metadata.Labels[FingerprintLabel] != fcfg.Fingerprint {
+		b.Logf("Settings fingerprint changed from [%s] to [%s]", svc.Metadata.Labels[FingerprintLabel], fcfg.Fingerprint)
+		return &fcfg, false, nil
+	}
+
+	// the labels are updated even if the new revision never gets ready, a failed deploy has to be retried
+	if created := svc.Status.LatestCreatedRevisionName; created != svc.Status.LatestReadyRevisionName {
+		b.Logf("Settings are unchanged but the latest revision %s isn't ready, deploying", created)
+		return &fcfg, false, nil
+	}
+
+	// the traffic could have been moved away from the revision since, e.g. by a rollback
+	if !cfg.NoTraffic {
+		for _, t := range svc.Status.Traffic {
+			if t.Percent > 0 && t.RevisionName != svc.Status.LatestReadyRevisionName && !t.LatestRevision {
+				b.Logf("Settings are unchanged but revision %s serves %d%% of the traffic, deploying", t.RevisionName, t.Percent)
+				return &fcfg, false, nil
+			}
+		}
+	}
+	return &fcfg, true, nil
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestFingerprint(t *testing.T) {
+	base := Config{
+		ImageName: "my-image:v1", Memory: "256Mi",
+		Environment:     map[string]string{"A": "1", "B": "2", "C": "3"},
+		AdditionalFlags: map[string]string{"cpu": "1", "max-instances": "3"},
+		EnvSecrets:      []string{"X=1", "Y=2"},
+	}
+	fp := fingerprint(&base, "sha256:abc")
+	if len(fp) != 32 {
+		t.Errorf("expected a 32 character fingerprint, got: %s", fp)
+	}
+
+	same := base
+	same.ImageName = "my-image@sha256:abc"
+	same.Environment = map[string]string{"C": "3", "B": "2", "A": "1"}
+	same.EnvSecrets = []string{"Y=2", "X=1"}
+	if f := fingerprint(&same, "sha256:abc"); f != fp {
+		t.Errorf("expected the same fingerprint for the same settings, got: %s and %s", fp, f)
+	}
+
+	for name, change := range map[string]func(cfg *Config){
+		"env":         func(cfg *Config) { cfg.Environment = map[string]string{"A": "1", "B": "2", "C": "4"} },
+		"env_secret":  func(cfg *Config) { cfg.EnvSecrets = []string{"X=1", "Y=3"} },
+		"memory":      func(cfg *Config) { cfg.Memory = "512Mi" },
+		"public":      func(cfg *Config) { cfg.AllowUnauthenticated = true },
+		"image-repo":  func(cfg *Config) { cfg.ImageName = "other-image:v1" },
+		"addl_flags":  func(cfg *Config) { cfg.AdditionalFlags = map[string]string{"cpu": "2", "max-instances": "3"} },
+		"secrets":     func(cfg *Config) { cfg.Secrets = map[string]string{"API_KEY": "api-key"} },
+		"svc_account": func(cfg *Config) { cfg.SvcAccount = "runtime@my-project.iam.gserviceaccount.com" },
+		"env_mode":    func(cfg *Config) { cfg.EnvMode = EnvModeMerge },
+		"remove_env":  func(cfg *Config) { cfg.EnvMode, cfg.RemoveEnv = EnvModeMerge, []string{"OLD"} },
+	} {
+		changed := base
+		change(&changed)
+		if fingerprint(&changed, "sha256:abc") == fp {
+			t.Errorf("%s: expected the fingerprint to change", name)
+		}
+	}
+	if fingerprint(&base, "sha256:def") == fp {
+		t.Errorf("expected the fingerprint to change with the digest")
+	}
+}
+
+func TestFingerprintDeploy(t *testing.T) {
+	orig := lookupDigest
+	defer func() { lookupDigest = orig }()
+	lookupDigest = func(Backend, string) (string, error) { return "sha256:abc", nil }
+
+	cfg := Config{Action: "deploy", ServiceName: "my-service", ImageName: "my-image:latest", Project: "my-project", Runtime: "managed", Token: validGCPKey}
+	fp := fingerprint(&cfg, "sha256:abc")
+	describeCreated := func(label, servingRevision, createdRevision string) string {
+		return fmt.Sprintf(`{"metadata":{"labels":{%q:%q}},"status":{"latestReadyRevisionName":"my-service-00002","latestCreatedRevisionName":%q,"traffic":[{"revisionName":%q,"percent":100}]}}`,
+			FingerprintLabel, label, createdRevision, servingRevision)
+	}
+	describe := func(label, servingRevision string) string {
+		return describeCreated(label, servingRevision, "my-service-00002")
+	}
+
+	for _, tst := range []struct {
+		name           string
+		describe       string
+		force          bool
+		expectedDeploy bool
+	}{
+		{name: "unchanged", describe: describe(fp, "my-service-00002")},
+		{name: "changed", describe: describe("0123", "my-service-00002"), expectedDeploy: true},
+		{name: "rolled-back", describe: describe(fp, "my-service-00001"), expectedDeploy: true},
+		// the previous deploy updated the label but its revision never got ready
+		{name: "failed-deploy", describe: describeCreated(fp, "my-service-00002", "my-service-00003"), expectedDeploy: true},
+		{name: "force", describe: describe(fp, "my-service-00002"), force: true, expectedDeploy: true},
+		{name: "new-service", expectedDeploy: true},
+	} {
+		t.Run(tst.name, func(t *testing.T) {
+			responses := []fakeResponse{{match: "services describe", output: tst.describe}}
+			if tst.describe == "" {
+				responses[0].exit = 1
+			}
+			logFile := fakeGCloud(t, responses...)
+
+			c := cfg
+			c.Force = tst.force
+			if err := runConfig(&c); err != nil {
+				t.Fatalf("runConfig() err: %s", err)
+			}
+
+			deployed := false
+			for _, call := range readCalls(t, logFile) {
+				if strings.Contains(call, "run deploy my-service") {
+					deployed = true
+					if !strings.Contains(call, "--update-labels "+FingerprintLabel+"="+fp) {
+						t.Errorf("expected the fingerprint label, got: %s", call)
+					}
+				}
+			}
+			if deployed != tst.expectedDeploy {
+				t.Errorf("expected deploy: %t, got calls: %v", tst.expectedDeploy, readCalls(t, logFile))
+			}
+		})
+	}
+}
+
+func TestFingerprintDeploySkipImageCheck(t *testing.T) {
+	orig := lookupDigest
+	defer func() { lookupDigest = orig }()
+	var lookups []string
+	lookupDigest = func(_ Backend, image string) (string, error) {
+		lookups = append(lookups, image)
+		return imageDigest(nil, image)
+	}
+
+	fakeGCloud(t, fakeResponse{match: "services describe", exit: 1})
+	b := &GCloudBackend{env: NewEnv("/tmp", nil, nil, nil, false)}
+	for _, tst := range []struct {
+		image               string
+		expectedFingerprint bool
+	}{
+		{image: "my-image:latest"},
+		{image: "my-image@sha256:abc", expectedFingerprint: true},
+	} {
+		lookups = nil
+		cfg := &Config{Action: "deploy", ServiceName: "my-service", ImageName: tst.image, SkipImageCheck: true}
+		fcfg, skip, err := fingerprintDeploy(b, cfg)
+		if err != nil || skip {
+			t.Fatalf("fingerprintDeploy() skip: %t, err: %v", skip, err)
+		}
+		if (fcfg.Fingerprint != "") != tst.expectedFingerprint {
+			t.Errorf("%s: expected a fingerprint: %t, got: %q", tst.image, tst.expectedFingerprint, fcfg.Fingerprint)
+		}
+		if !tst.expectedFingerprint && len(lookups) > 0 {
+			t.Errorf("%s: expected no registry lookup with skip_image_check, got: %v", tst.image, lookups)
+		}
+	}
+}
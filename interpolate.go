@@ -0,0 +1,186 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// a DNS label, the default length of the slug filter
+const maxDNSLabelLength = 63
+
+// interpolate replaces the ${VAR} references in s with the values of the environment variables, e.g.
+// the DRONE_* ones. ${VAR:-default} falls back to default if VAR is unset or empty and filters can
+// be appended with "|": lower, truncate:N and slug, or slug:N, see slugify(). Undefined variables
+// without a default are an error. $${ is a literal ${.
+func interpolate(s string) (string, error) {
+	var b strings.Builder
+	for {
+		i := strings.Index(s, "${")
+		if i < 0 {
+			b.WriteString(s)
+			return b.String(), nil
+		}
+		if i > 0 && s[i-1] == '$' {
+			b.WriteString(s[:i-1] + "${")
+			s = s[i+2:]
+			continue
+		}
+		b.WriteString(s[:i])
+
+		end := strings.Index(s[i:], "}")
+		if end < 0 {
+			return "", fmt.Errorf("unterminated reference: [%s]", s[i:])
+		}
+		v, err := expandReference(s[i+2 : i+end])
+		if err != nil {
+			return "", err
+		}
+		b.WriteString(v)
+		s = s[i+end+1:]
+	}
+}
+
+// expandReference returns the value of "VAR[:-default][|filter...]"
+func expandReference(ref string) (string, error) {
+	parts := strings.Split(ref, "|")
+	name, def := strings.TrimSpace(parts[0]), ""
+	hasDefault := false
+	if i := strings.Index(name, ":-"); i >= 0 {
+		name, def, hasDefault = name[:i], name[i+2:], true
+	}
+	if !envKeyRe.MatchString(name) {
+		return "", fmt.Errorf("invalid variable name: [%s]", name)
+	}
+
+	v, ok := os.LookupEnv(name)
+	switch {
+	case hasDefault && v == "":
+		v = def
+	case !ok:
+		return "", fmt.Errorf("undefined variable: [%s], set it or give a default like ${%s:-value}", name, name)
+	}
+
+	for _, f := range parts[1:] {
+		filter, arg := strings.TrimSpace(f), ""
+		if i := strings.Index(filter, ":"); i >= 0 {
+			filter, arg = filter[:i], filter[i+1:]
+		}
+		n := -1
+		if arg != "" {
+			var err error
+			if n, err = strconv.Atoi(arg); err != nil || n < 1 {
+				return "", fmt.Errorf("invalid argument of filter %s of %s: [%s], expected a positive integer", filter, name, arg)
+			}
+		}
+
+		switch {
+		case filter == "lower" && n < 0:
+			v = strings.ToLower(v)
+		case filter == "truncate" && n > 0:
+			if len(v) > n {
+				v = v[:n]
+			}
+		case filter == "slug":
+			if n < 0 {
+				n = maxDNSLabelLength
+			}
+			v = slugify(v, n)
+		default:
+			return "", fmt.Errorf("invalid filter of %s: [%s], expected lower, truncate:N or slug", name, strings.TrimSpace(f))
+		}
+	}
+	return v, nil
+}
+
+// interpolatedSetting is a setting interpolate() is applied to, either a string or the values of a map
+type interpolatedSetting struct {
+	name   string
+	value  *string
+	values map[string]string
+}
+
+// interpolateSettings interpolates the settings in place, the errors name the setting
+func interpolateSettings(settings []interpolatedSetting) error {
+	for _, s := range settings {
+		if s.value != nil {
+			v, err := interpolate(*s.value)
+			if err != nil {
+				return fmt.Errorf("failed to interpolate %s: %s", s.name, err)
+			}
+			*s.value = v
+		}
+		for _, k := range sortedKeys(s.values) {
+			v, err := interpolate(s.values[k])
+			if err != nil {
+				return fmt.Errorf("failed to interpolate %s %s: %s", s.name, k, err)
+			}
+			s.values[k] = v
+		}
+	}
+	return nil
+}
+
+// interpolatedSettingValue returns the value of the setting's PLUGIN_* variable, interpolated, for the
+// settings that are parsed on their own like the lists
+func interpolatedSettingValue(setting string) (string, error) {
+	v, err := interpolate(os.Getenv("PLUGIN_" + strings.ToUpper(setting)))
+	if err != nil {
+		return "", fmt.Errorf("failed to interpolate %s: %s", setting, err)
+	}
+	return v, nil
+}
+
+// interpolateConfig interpolates the plain settings of cfg, the ones parsed on their own use
+// interpolatedSettingValue(). Credentials, env_secret_* and the contents of the env_files are
+// left alone, their values can contain "${" on purpose.
+func interpolateConfig(cfg *Config) error {
+	return interpolateSettings([]interpolatedSetting{
+		{name: "project", value: &cfg.Project},
+		{name: "region", value: &cfg.Region},
+		{name: "service", value: &cfg.ServiceName},
+		{name: "image", value: &cfg.ImageName},
+		{name: "svc_account", value: &cfg.SvcAccount},
+		{name: "memory", value: &cfg.Memory},
+		{name: "concurrency", value: &cfg.Concurrency},
+		{name: "timeout", value: &cfg.Timeout},
+		{name: "tag", value: &cfg.Tag},
+		{name: "revision", value: &cfg.Revision},
+		{name: "service_yaml", value: &cfg.ServiceYAML},
+		{name: "url_file", value: &cfg.URLFile},
+		{name: "job", value: &cfg.JobName},
+		{name: "tasks", value: &cfg.Tasks},
+		{name: "parallelism", value: &cfg.Parallelism},
+		{name: "max_retries", value: &cfg.MaxRetries},
+		{name: "task_timeout", value: &cfg.TaskTimeout},
+		{name: "environment", values: cfg.Environment},
+		{name: "secrets", values: cfg.Secrets},
+		{name: "addl_flags", values: cfg.AdditionalFlags},
+		{name: "labels", values: cfg.Labels},
+	})
+}
+
+// interpolateServiceEntry interpolates the settings of one of the services like interpolateConfig()
+func interpolateServiceEntry(e *ServiceEntry) error {
+	settings := []interpolatedSetting{
+		{name: "name", value: &e.Name},
+		{name: "image", value: &e.Image},
+		{name: "memory", value: &e.Memory},
+		{name: "concurrency", value: &e.Concurrency},
+		{name: "timeout", value: &e.Timeout},
+		{name: "svc_account", value: &e.SvcAccount},
+		{name: "tag", value: &e.Tag},
+		{name: "environment", values: e.Environment},
+		{name: "secrets", values: e.Secrets},
+		{name: "addl_flags", values: e.AdditionalFlags},
+	}
+	// so a service with an interpolated name can be depended on
+	for i := range e.DependsOn {
+		settings = append(settings, interpolatedSetting{name: "depends_on", value: &e.DependsOn[i]})
+	}
+	if err := interpolateSettings(settings); err != nil {
+		return fmt.Errorf("service %s: %s", e.Name, err)
+	}
+	return nil
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestInterpolate(t *testing.T) {
+	os.Clearenv()
+	os.Setenv("DRONE_COMMIT_SHA", "d0c13cb8646875cf94387f0d3de4e92b85eee3b0")
+	os.Setenv("DRONE_BRANCH", "Feature/Login_Page")
+	os.Setenv("DRONE_PULL_REQUEST", "")
+	os.Setenv("DRONE_REPO_NAME", "My-App")
+
+	for _, tst := range []struct {
+		value       string
+		expected    string
+		expectedErr string
+	}{
+		{value: "no references", expected: "no references"},
+		{value: "${DRONE_COMMIT_SHA}", expected: "d0c13cb8646875cf94387f0d3de4e92b85eee3b0"},
+		{value: "pr-${DRONE_PULL_REQUEST}", expected: "pr-"},
+		{value: "pr-${DRONE_PULL_REQUEST:-none}", expected: "pr-none"},
+		{value: "${DRONE_TAG:-latest}", expected: "latest"},
+		{value: "${DRONE_TAG:-}", expected: ""},
+		{value: "${DRONE_COMMIT_SHA|truncate:8}", expected: "d0c13cb8"},
+		{value: "${DRONE_REPO_NAME | lower}-${DRONE_BRANCH|slug}", expected: "my-app-feature-login-page"},
+		{value: "${DRONE_BRANCH|slug:10}", expected: "feature-lo"},
+		{value: "${DRONE_TAG:-V1.2|lower|slug}", expected: "v1-2"},
+		{value: "$${HOME} $HOME ${DRONE_REPO_NAME}", expected: "${HOME} $HOME My-App"},
+		{value: "${DRONE_TAG}", expectedErr: "undefined variable: [DRONE_TAG]"},
+		{value: "${DRONE_BRANCH", expectedErr: "unterminated reference"},
+		{value: "${DRONE-BRANCH}", expectedErr: "invalid variable name"},
+		{value: "${DRONE_BRANCH|upper}", expectedErr: "invalid filter of DRONE_BRANCH: [upper]"},
+		{value: "${DRONE_BRANCH|truncate}", expectedErr: "invalid filter of DRONE_BRANCH: [truncate]"},
+		{value: "${DRONE_BRANCH|truncate:0}", expectedErr: "invalid argument"},
+	} {
+		got, err := interpolate(tst.value)
+		if tst.expectedErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tst.expectedErr) {
+				t.Errorf("%s: expected err: %s, got: %v", tst.value, tst.expectedErr, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: err: %s", tst.value, err)
+		} else if got != tst.expected {
+			t.Errorf("%s: expected: %q, got: %q", tst.value, tst.expected, got)
+		}
+	}
+}
+
+func TestInterpolateConfig(t *testing.T) {
+	os.Clearenv()
+	os.Setenv("DRONE_COMMIT_SHA", "d0c13cb8646875cf94387f0d3de4e92b85eee3b0")
+	os.Setenv("DRONE_BRANCH", "main")
+
+	cfg := &Config{
+		ServiceName:     "api-${DRONE_BRANCH}",
+		ImageName:       "my-image:${DRONE_COMMIT_SHA|truncate:8}",
+		Environment:     map[string]string{"VERSION": "${DRONE_COMMIT_SHA}"},
+		AdditionalFlags: map[string]string{"labels": "branch=${DRONE_BRANCH}"},
+		EnvSecrets:      []string{"PASSWORD=p${ss"},
+	}
+	if err := interpolateConfig(cfg); err != nil {
+		t.Fatalf("interpolateConfig() err: %s", err)
+	}
+	expected := &Config{
+		ServiceName:     "api-main",
+		ImageName:       "my-image:d0c13cb8",
+		Environment:     map[string]string{"VERSION": "d0c13cb8646875cf94387f0d3de4e92b85eee3b0"},
+		AdditionalFlags: map[string]string{"labels": "branch=main"},
+		EnvSecrets:      []string{"PASSWORD=p${ss"},
+	}
+	if !reflect.DeepEqual(cfg, expected) {
+		t.Errorf("expected: %#v, got: %#v", expected, cfg)
+	}
+
+	cfg = &Config{Environment: map[string]string{"A": "1", "B": "${DRONE_TAG}"}}
+	if err := interpolateConfig(cfg); err == nil || !strings.Contains(err.Error(), "failed to interpolate environment B") {
+		t.Errorf("expected the setting in the error, got: %v", err)
+	}
+
+	e := &ServiceEntry{Name: "worker", Image: "worker:${DRONE_BRANCH}", Environment: settingsMap{"SHA": "${DRONE_COMMIT_SHA|truncate:7}"}}
+	if err := interpolateServiceEntry(e); err != nil {
+		t.Fatalf("interpolateServiceEntry() err: %s", err)
+	}
+	if e.Image != "worker:main" || e.Environment["SHA"] != "d0c13cb" {
+		t.Errorf("expected the service entry to be interpolated, got: %#v", e)
+	}
+}
+
+func TestParseConfigInterpolation(t *testing.T) {
+	os.Clearenv()
+	for k, v := range map[string]string{
+		"DRONE_COMMIT_SHA": "d0c13cb8646875cf94387f0d3de4e92b85eee3b0", "DRONE_BRANCH": "main", "DEPLOYER": "deployer",
+		"PLUGIN_ACTION": "delete", "PLUGIN_TOKEN": validGCPKey, "PLUGIN_SERVICE": "api-${DRONE_BRANCH}",
+		"PLUGIN_DEPLOYMENT_IMAGE":            "my-image:${DRONE_COMMIT_SHA|truncate:8}",
+		"PLUGIN_IMPERSONATE_SERVICE_ACCOUNT": "${DEPLOYER}@my-project-id.iam.gserviceaccount.com",
+		"PLUGIN_DELETE_ALLOWLIST":            "api-${DRONE_BRANCH}*",
+		"PLUGIN_VERIFY_PATH":                 "/healthz/${DRONE_BRANCH}",
+		"PLUGIN_URL_FILE":                    ".url-${DRONE_BRANCH}",
+		"PLUGIN_VERIFY_BODY":                 "${DRONE_COMMIT_SHA}",
+		"PLUGIN_ENV_MODE":                    "merge",
+		"PLUGIN_REMOVE_ENV":                  "OLD_${DRONE_BRANCH}",
+		"PLUGIN_REMOVE_SECRETS":              "KEY_${DRONE_BRANCH}",
+	} {
+		os.Setenv(k, v)
+	}
+
+	cfg, err := parseConfig()
+	if err != nil {
+		t.Fatalf("parseConfig() err: %s", err)
+	}
+	for _, tst := range []struct {
+		value    interface{}
+		expected interface{}
+	}{
+		{cfg.ServiceName, "api-main"},
+		{cfg.ImageName, "my-image:d0c13cb8"},
+		{cfg.ImpersonateServiceAccount, []string{"deployer@my-project-id.iam.gserviceaccount.com"}},
+		{cfg.DeleteAllowlist, []string{"api-main*"}},
+		{cfg.VerifyPath, "/healthz/main"},
+		{cfg.URLFile, ".url-main"},
+		{cfg.VerifyBody, "d0c13cb8646875cf94387f0d3de4e92b85eee3b0"},
+		{cfg.RemoveEnv, []string{"OLD_main"}},
+		{cfg.RemoveSecrets, []string{"KEY_main"}},
+	} {
+		if !reflect.DeepEqual(tst.value, tst.expected) {
+			t.Errorf("expected: %#v, got: %#v", tst.expected, tst.value)
+		}
+	}
+
+	os.Setenv("PLUGIN_ENV_FILES", "deploy/${DRONE_BRANCH}.env")
+	if _, err := parseConfig(); err == nil || !strings.Contains(err.Error(), "main.env") {
+		t.Errorf("expected env_files to be interpolated, got: %v", err)
+	}
+	os.Setenv("PLUGIN_ENV_FILES", "deploy/${DRONE_TAG}.env")
+	if _, err := parseConfig(); err == nil || !strings.Contains(err.Error(), "failed to interpolate env_files") {
+		t.Errorf("expected an undefined variable error, got: %v", err)
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// build labels, added to every deployed service and job so its revisions can be traced back to the build
+const (
+	LabelCommit        = "drone-commit"
+	LabelBuild         = "drone-build"
+	LabelRepo          = "drone-repo"
+	LabelBranch        = "drone-branch"
+	LabelPluginVersion = "drone-cloud-run-version"
+
+	// label keys and values, and revision names, are limited to 63 characters
+	maxLabelLength = 63
+)
+
+var (
+	labelKeyRe        = regexp.MustCompile(`^[a-z][a-z0-9_-]{0,62}$`)
+	invalidLabelChars = regexp.MustCompile(`[^a-z0-9_-]+`)
+)
+
+// labelValue lower-cases s and replaces everything that isn't allowed in a label value with dashes,
+// e.g. "octocat/Hello-World" becomes "octocat-hello-world"
+func labelValue(s string) string {
+	s = invalidLabelChars.ReplaceAllString(strings.ToLower(s), "-")
+	if len(s) > maxLabelLength {
+		s = s[:maxLabelLength]
+	}
+	return s
+}
+
+// parseLabels validates the labels setting, derives the build labels from the Drone build unless
+// skip_build_labels is set and the revision suffix if revision_suffix is set
+func parseLabels(cfg *Config) error {
+	for _, k := range sortedKeys(cfg.Labels) {
+		if !labelKeyRe.MatchString(k) {
+			return fmt.Errorf("invalid label: [%s], keys start with a lowercase letter followed by up to 62 lowercase letters, digits, _ or -", k)
+		}
+		if k == FingerprintLabel {
+			return fmt.Errorf("label %s is set by the plugin", k)
+		}
+		cfg.Labels[k] = labelValue(cfg.Labels[k])
+	}
+
+	if os.Getenv("PLUGIN_SKIP_BUILD_LABELS") != "true" {
+		for k, v := range map[string]string{
+			LabelCommit:        os.Getenv("DRONE_COMMIT_SHA"),
+			LabelBuild:         os.Getenv("DRONE_BUILD_NUMBER"),
+			LabelRepo:          os.Getenv("DRONE_REPO"),
+			LabelBranch:        os.Getenv("DRONE_BRANCH"),
+			LabelPluginVersion: BuildTag,
+		} {
+			if v = labelValue(v); v == "" {
+				continue
+			}
+			if cfg.BuildLabels == nil {
+				cfg.BuildLabels = map[string]string{}
+			}
+			cfg.BuildLabels[k] = v
+		}
+	}
+
+	if os.Getenv("PLUGIN_REVISION_SUFFIX") == "true" {
+		sha, build := os.Getenv("DRONE_COMMIT_SHA"), os.Getenv("DRONE_BUILD_NUMBER")
+		if sha == "" || build == "" {
+			return fmt.Errorf("revision_suffix needs DRONE_COMMIT_SHA and DRONE_BUILD_NUMBER to be set")
+		}
+		if len(sha) > 7 {
+			sha = sha[:7]
+		}
+		cfg.RevisionSuffix = strings.Trim(nonDNSChars.ReplaceAllString(strings.ToLower(sha+"-"+build), "-"), "-")
+	}
+	return nil
+}
+
+// deployLabels returns the labels a deploy sets: the build labels, the labels setting, which
+// overrides them, and the fingerprint
+func deployLabels(cfg *Config) map[string]string {
+	labels := mergeSettings(cfg.BuildLabels, cfg.Labels)
+	if cfg.Fingerprint != "" {
+		labels = mergeSettings(labels, map[string]string{FingerprintLabel: cfg.Fingerprint})
+	}
+	return labels
+}
+
+// labelArgs returns the --update-labels flag of deployLabels(), existing labels that aren't set are kept
+func labelArgs(cfg *Config) []string {
+	labels := deployLabels(cfg)
+	if len(labels) == 0 {
+		return nil
+	}
+	// the values are sanitized, they can't contain a comma
+	var kv []string
+	for _, k := range sortedKeys(labels) {
+		kv = append(kv, k+"="+labels[k])
+	}
+	return []string{"--update-labels", strings.Join(kv, ",")}
+}
+
+// revisionSuffixArgs returns the --revision-suffix flag if revision_suffix is set
+func revisionSuffixArgs(cfg *Config) ([]string, error) {
+	if cfg.RevisionSuffix == "" {
+		return nil, nil
+	}
+	if name := cfg.ServiceName + "-" + cfg.RevisionSuffix; len(name) > maxLabelLength {
+		return nil, fmt.Errorf("revision name %s is longer than %d characters, shorten the service name or unset revision_suffix", name, maxLabelLength)
+	}
+	return []string{"--revision-suffix", cfg.RevisionSuffix}, nil
+}
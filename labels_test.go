@@ -0,0 +1,152 @@
+package main
+
+import (
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLabelValue(t *testing.T) {
+	for value, expected := range map[string]string{
+		"d0c13cb8646875cf94387f0d3de4e92b85eee3b0": "d0c13cb8646875cf94387f0d3de4e92b85eee3b0",
+		"octocat/Hello-World":                      "octocat-hello-world",
+		"feature/login_page":                       "feature-login_page",
+		"v1.2.3":                                   "v1-2-3",
+		"":                                         "",
+		strings.Repeat("a", 70):                    strings.Repeat("a", 63),
+	} {
+		if got := labelValue(value); got != expected {
+			t.Errorf("labelValue(%q) expected: %q, got: %q", value, expected, got)
+		}
+	}
+}
+
+func TestParseLabels(t *testing.T) {
+	origTag := BuildTag
+	defer func() { BuildTag = origTag }()
+	BuildTag = "v1.4.0"
+
+	drone := map[string]string{
+		"DRONE_COMMIT_SHA":   "D0C13CB8646875CF94387F0D3DE4E92B85EEE3B0",
+		"DRONE_BUILD_NUMBER": "42",
+		"DRONE_REPO":         "octocat/Hello-World",
+		"DRONE_BRANCH":       "main",
+	}
+
+	for _, tst := range []struct {
+		name                   string
+		env                    map[string]string
+		labels                 map[string]string
+		expectedLabels         map[string]string
+		expectedBuildLabels    map[string]string
+		expectedRevisionSuffix string
+		expectedErr            string
+	}{
+		{
+			name:           "build-labels",
+			env:            drone,
+			labels:         map[string]string{"team": "Payments", "cost_center": "cc/42"},
+			expectedLabels: map[string]string{"team": "payments", "cost_center": "cc-42"},
+			expectedBuildLabels: map[string]string{
+				LabelCommit: "d0c13cb8646875cf94387f0d3de4e92b85eee3b0", LabelBuild: "42",
+				LabelRepo: "octocat-hello-world", LabelBranch: "main", LabelPluginVersion: "v1-4-0",
+			},
+		},
+		{
+			name:                "no-drone-vars",
+			env:                 map[string]string{},
+			expectedBuildLabels: map[string]string{LabelPluginVersion: "v1-4-0"},
+		},
+		{
+			name: "skip-build-labels",
+			env:  map[string]string{"DRONE_BUILD_NUMBER": "42", "PLUGIN_SKIP_BUILD_LABELS": "true"},
+		},
+		{
+			name:                   "revision-suffix",
+			env:                    map[string]string{"DRONE_COMMIT_SHA": "D0C13CB8646", "DRONE_BUILD_NUMBER": "42", "PLUGIN_SKIP_BUILD_LABELS": "true", "PLUGIN_REVISION_SUFFIX": "true"},
+			expectedRevisionSuffix: "d0c13cb-42",
+		},
+		{
+			name:        "revision-suffix-without-build",
+			env:         map[string]string{"DRONE_COMMIT_SHA": "d0c13cb8646", "PLUGIN_REVISION_SUFFIX": "true"},
+			expectedErr: "revision_suffix needs DRONE_COMMIT_SHA and DRONE_BUILD_NUMBER",
+		},
+		{
+			name:        "invalid-key",
+			env:         map[string]string{},
+			labels:      map[string]string{"Team": "payments"},
+			expectedErr: "invalid label: [Team]",
+		},
+		{
+			name:        "fingerprint-key",
+			env:         map[string]string{},
+			labels:      map[string]string{FingerprintLabel: "0123"},
+			expectedErr: "is set by the plugin",
+		},
+	} {
+		t.Run(tst.name, func(t *testing.T) {
+			os.Clearenv()
+			for k, v := range tst.env {
+				os.Setenv(k, v)
+			}
+
+			cfg := &Config{Labels: tst.labels}
+			err := parseLabels(cfg)
+			if tst.expectedErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tst.expectedErr) {
+					t.Errorf("expected err: %s, got: %v", tst.expectedErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseLabels() err: %s", err)
+			}
+			if !reflect.DeepEqual(cfg.Labels, tst.expectedLabels) {
+				t.Errorf("expected labels: %v, got: %v", tst.expectedLabels, cfg.Labels)
+			}
+			if !reflect.DeepEqual(cfg.BuildLabels, tst.expectedBuildLabels) {
+				t.Errorf("expected build labels: %v, got: %v", tst.expectedBuildLabels, cfg.BuildLabels)
+			}
+			if cfg.RevisionSuffix != tst.expectedRevisionSuffix {
+				t.Errorf("expected revision suffix: %s, got: %s", tst.expectedRevisionSuffix, cfg.RevisionSuffix)
+			}
+		})
+	}
+}
+
+func TestRevisionSuffixArgs(t *testing.T) {
+	cfg := &Config{ServiceName: "my-service", RevisionSuffix: "d0c13cb-42"}
+	if args, err := revisionSuffixArgs(cfg); err != nil || !reflect.DeepEqual(args, []string{"--revision-suffix", "d0c13cb-42"}) {
+		t.Errorf("expected the --revision-suffix flag, got: %v, err: %v", args, err)
+	}
+
+	cfg.ServiceName = strings.Repeat("s", 53)
+	if _, err := revisionSuffixArgs(cfg); err == nil {
+		t.Errorf("expected an error for a revision name longer than 63 characters")
+	}
+}
+
+func TestRenderServiceLabels(t *testing.T) {
+	cfg := &Config{
+		Action: "replace", ServiceName: "my-service", ImageName: "my-image",
+		Labels: map[string]string{"team": "payments"}, Fingerprint: "0123", RevisionSuffix: "d0c13cb-42",
+	}
+	rendered, err := renderService(cfg)
+	if err != nil {
+		t.Fatalf("renderService() err: %s", err)
+	}
+	v, err := parseYAML([]byte(rendered))
+	if err != nil {
+		t.Fatalf("parseYAML() err: %s", err)
+	}
+	svc := v.(map[string]interface{})
+	expected := map[string]interface{}{"team": "payments", FingerprintLabel: "0123"}
+	if labels := svc["metadata"].(map[string]interface{})["labels"]; !reflect.DeepEqual(labels, expected) {
+		t.Errorf("expected service labels: %v, got: %v", expected, labels)
+	}
+	tmplMeta := svc["spec"].(map[string]interface{})["template"].(map[string]interface{})["metadata"].(map[string]interface{})
+	if !reflect.DeepEqual(tmplMeta["labels"], expected) || tmplMeta["name"] != "my-service-d0c13cb-42" {
+		t.Errorf("expected the labels and the revision name on the template, got: %v", tmplMeta)
+	}
+}
@@ -1,25 +1,39 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"log"
 	"os"
 	"os/exec"
+	"path"
 	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 )
 
 type Config struct {
-	Action string
-	Dir    string
+	Action  string
+	Dir     string
+	Backend string
 
 	// deployment service account token
 	Token string
 
+	// workload identity federation credential config and the OIDC token it exchanges, see credentials.go
+	CredentialConfig string
+	OIDCToken        string
+
+	// service accounts to impersonate after authenticating, the last one is the account
+	// the plugin acts as and the ones before it are delegates, in order
+	ImpersonateServiceAccount []string
+
 	// cloud run runtime info
 	Runtime    string
 	Project    string
@@ -27,6 +41,11 @@ type Config struct {
 	SvcAccount string
 	Variant    string
 
+	// all regions to deploy to, "region" is only set when there's a single one, see region.go
+	Regions             []string
+	RegionParallelism   int
+	RegionFailurePolicy string
+
 	// deployed service config
 	ServiceName          string
 	ImageName            string
@@ -37,19 +56,93 @@ type Config struct {
 	Environment          map[string]string
 	Secrets              map[string]string
 	EnvSecrets           []string
+	Tag                  string
+	NoTraffic            bool
+
+	// whether the env vars and secrets replace all existing ones or are merged into them,
+	// and the ones to remove when merging
+	EnvMode       string
+	RemoveEnv     []string
+	RemoveSecrets []string
+
+	// Knative service template the "replace" action renders the settings onto, relative to
+	// Dir, and the rendered file it applies, see replace.go
+	ServiceYAML string
+	ReplaceFile string
+
+	// log the plans, and the rendered service for "replace", without running anything
+	DryRun bool
+
+	// drift between the settings and the live service, see diff.go
+	ReportDrift bool
+	FailOnDrift bool
+
+	// deploys are skipped if the service was deployed with the same fingerprint unless
+	// force is set, the fingerprint is set right before deploying, see fingerprint.go
+	Force       bool
+	Fingerprint string
+
+	// labels of the deployed service or job and its revisions: the labels setting and the ones
+	// derived from the Drone build, and the optional revision suffix, see labels.go
+	Labels         map[string]string
+	BuildLabels    map[string]string
+	RevisionSuffix string
+
+	// services deployed by one step, on top of the settings above, see services.go
+	Services []ServiceEntry
+
+	// deploy the digest the image tag points to instead of the tag, see registry.go
+	ResolveDigest  bool
+	SkipImageCheck bool
+
+	// rollbacks, see rollback.go
+	RollbackOnFailure bool
+	Revision          string
+
+	// preview environments, see preview.go
+	PreviewType  string
+	URLFile      string
+	PullRequest  string
+	SourceBranch string
+
+	// post-deploy verification, see verify.go
+	VerifyPath    string
+	VerifyStatus  int
+	VerifyBody    string
+	VerifyTimeout time.Duration
+
+	// canary rollouts, see canary.go
+	CanarySteps    []int
+	CanaryInterval time.Duration
+
+	// cloud run job config
+	JobName     string
+	Tasks       string
+	Parallelism string
+	MaxRetries  string
+	TaskTimeout string
+
+	// glob patterns of service names the "delete" action is allowed to remove
+	DeleteAllowlist []string
 
 	AdditionalFlags map[string]string
 }
 
 const (
-	TmpTokenFileLocation = "/tmp/token.json"
+	EnvModeReplace = "replace"
+	EnvModeMerge   = "merge"
 )
 
 // using a var instead of const so tests can override this
 var (
 	GCloudCommand = "gcloud"
+
+	sleep = time.Sleep
 )
 
+// emailRe is a loose check for service account emails, gcloud and the API validate them properly
+var emailRe = regexp.MustCompile(`^[^@\s,]+@[^@\s,]+\.[^@\s,]+$`)
+
 var (
 	// populated by "go build"
 	BuildDate string
@@ -72,6 +165,7 @@ func parseConfig() (*Config, error) {
 	cfg := Config{
 		Dir:        filepath.Join(os.Getenv("DRONE_WORKSPACE"), os.Getenv("PLUGIN_DIR")),
 		Action:     os.Getenv("PLUGIN_ACTION"),
+		Backend:    os.Getenv("PLUGIN_BACKEND"),
 		Runtime:    os.Getenv("PLUGIN_RUNTIME"),
 		Project:    os.Getenv("PLUGIN_PROJECT"),
 		Region:     os.Getenv("PLUGIN_REGION"),
@@ -79,31 +173,91 @@ func parseConfig() (*Config, error) {
 		Token:      os.Getenv("PLUGIN_TOKEN"),
 		Variant:    os.Getenv("PLUGIN_VARIANT"),
 
+		CredentialConfig: os.Getenv("PLUGIN_CREDENTIAL_CONFIG"),
+		OIDCToken:        os.Getenv("PLUGIN_OIDC_TOKEN"),
+
 		ServiceName:          os.Getenv("PLUGIN_SERVICE"),
 		ImageName:            os.Getenv("PLUGIN_IMAGE"),
 		AllowUnauthenticated: os.Getenv("PLUGIN_ALLOW_UNAUTHENTICATED") == "true",
 		Concurrency:          os.Getenv("PLUGIN_CONCURRENCY"),
 		Memory:               os.Getenv("PLUGIN_MEMORY"),
 		Timeout:              os.Getenv("PLUGIN_TIMEOUT"),
+		Tag:                  os.Getenv("PLUGIN_TAG"),
+		NoTraffic:            os.Getenv("PLUGIN_NO_TRAFFIC") == "true",
+		EnvMode:              os.Getenv("PLUGIN_ENV_MODE"),
+		ResolveDigest:        os.Getenv("PLUGIN_RESOLVE_DIGEST") == "true",
+		SkipImageCheck:       os.Getenv("PLUGIN_SKIP_IMAGE_CHECK") == "true",
+		ServiceYAML:          os.Getenv("PLUGIN_SERVICE_YAML"),
+		DryRun:               os.Getenv("PLUGIN_DRY_RUN") == "true",
+		ReportDrift:          os.Getenv("PLUGIN_REPORT_DRIFT") == "true",
+		FailOnDrift:          os.Getenv("PLUGIN_FAIL_ON_DRIFT") == "true",
+		Force:                os.Getenv("PLUGIN_FORCE") == "true",
+
+		RollbackOnFailure: os.Getenv("PLUGIN_ROLLBACK_ON_FAILURE") == "true",
+		Revision:          os.Getenv("PLUGIN_REVISION"),
+
+		PreviewType:  os.Getenv("PLUGIN_PREVIEW_TYPE"),
+		URLFile:      os.Getenv("PLUGIN_URL_FILE"),
+		PullRequest:  os.Getenv("DRONE_PULL_REQUEST"),
+		SourceBranch: os.Getenv("DRONE_SOURCE_BRANCH"),
+
+		JobName:     os.Getenv("PLUGIN_JOB"),
+		Tasks:       os.Getenv("PLUGIN_TASKS"),
+		Parallelism: os.Getenv("PLUGIN_PARALLELISM"),
+		MaxRetries:  os.Getenv("PLUGIN_MAX_RETRIES"),
+		TaskTimeout: os.Getenv("PLUGIN_TASK_TIMEOUT"),
 	}
 
-	envStr := os.Getenv("PLUGIN_ENVIRONMENT")
-	if err := json.Unmarshal([]byte(envStr), &cfg.Environment); err != nil && envStr != "" {
-		log.Printf("json.Unmarshal() err: %s", err)
-		log.Printf("os.Getenv(PLUGIN_ENVIRONMENT): %s", envStr)
+	var err error
+	if cfg.Environment, err = parseSettingsMap("environment", os.Getenv("PLUGIN_ENVIRONMENT")); err != nil {
+		return nil, err
+	}
+	if cfg.Secrets, err = parseSettingsMap("secrets", os.Getenv("PLUGIN_SECRETS")); err != nil {
+		return nil, err
+	}
+	if cfg.AdditionalFlags, err = parseSettingsMap("additional flags", os.Getenv("PLUGIN_ADDL_FLAGS")); err != nil {
+		return nil, err
+	}
+	if cfg.Labels, err = parseSettingsMap("labels", os.Getenv("PLUGIN_LABELS")); err != nil {
+		return nil, err
+	}
+	if cfg.ImageName == "" {
+		// for Drone v0.8 compat. as 'image' clashes since settings are passed top-level
+		cfg.ImageName = os.Getenv("PLUGIN_DEPLOYMENT_IMAGE")
+	}
+	if err := interpolateConfig(&cfg); err != nil {
+		return nil, err
 	}
 
-	secretsStr := os.Getenv("PLUGIN_SECRETS")
-	if err := json.Unmarshal([]byte(secretsStr), &cfg.Secrets); err != nil && secretsStr != "" {
-		log.Printf("json.Unmarshal() err: %s", err)
-		log.Printf("os.Getenv(PLUGIN_SECRETS): %s", secretsStr)
+	impersonate, err := interpolatedSettingValue("impersonate_service_account")
+	if err != nil {
+		return nil, err
+	}
+	for _, sa := range strings.Split(impersonate, ",") {
+		if sa = strings.TrimSpace(sa); sa == "" {
+			continue
+		}
+		if !emailRe.MatchString(sa) {
+			return nil, fmt.Errorf("invalid impersonate_service_account, not an email: [%s]", sa)
+		}
+		cfg.ImpersonateServiceAccount = append(cfg.ImpersonateServiceAccount, sa)
+	}
+	if cfg.SvcAccount != "" && !emailRe.MatchString(cfg.SvcAccount) {
+		return nil, fmt.Errorf("invalid svc_account, not an email: [%s]", cfg.SvcAccount)
 	}
 
-	addlFlagsStr := os.Getenv("PLUGIN_ADDL_FLAGS")
-	if err := json.Unmarshal([]byte(addlFlagsStr), &cfg.AdditionalFlags); err != nil && addlFlagsStr != "" {
-		log.Printf("json.Unmarshal() err: %s", err)
-		log.Printf("os.Getenv(PLUGIN_ADDL_FLAGS): %s", addlFlagsStr)
-		return nil, fmt.Errorf("failed to parse additional flags: [%s]", err)
+	allowlist, err := interpolatedSettingValue("delete_allowlist")
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range strings.Split(allowlist, ",") {
+		if p = strings.TrimSpace(p); p == "" {
+			continue
+		}
+		if _, err := path.Match(p, ""); err != nil {
+			return nil, fmt.Errorf("invalid delete_allowlist pattern: [%s]", p)
+		}
+		cfg.DeleteAllowlist = append(cfg.DeleteAllowlist, p)
 	}
 
 	PluginEnvSecretPrefix := "PLUGIN_ENV_SECRET_"
@@ -115,34 +269,118 @@ func parseConfig() (*Config, error) {
 		}
 	}
 
+	if err := parseEnvFiles(&cfg); err != nil {
+		return nil, err
+	}
+
+	if err := parseEnvMode(&cfg); err != nil {
+		return nil, err
+	}
+
+	if err := parseLabels(&cfg); err != nil {
+		return nil, err
+	}
+
 	if cfg.Action == "" {
 		return nil, fmt.Errorf("Missing action")
 	}
 	if cfg.Runtime == "" {
 		cfg.Runtime = "managed"
 	}
-	if cfg.ServiceName == "" {
+	if cfg.Backend == "" {
+		cfg.Backend = BackendGCloud
+	}
+	if cfg.Backend != BackendGCloud && cfg.Backend != BackendAPI {
+		return nil, fmt.Errorf("invalid backend: [%s], expected %s or %s", cfg.Backend, BackendGCloud, BackendAPI)
+	}
+	if cfg.Backend == BackendAPI && cfg.Runtime != "managed" {
+		// the Admin API only manages fully managed Cloud Run
+		return nil, fmt.Errorf("runtime: %s isn't supported by the %s backend, only managed is", cfg.Runtime, BackendAPI)
+	}
+	if cfg.Backend == BackendAPI && cfg.Variant != "" {
+		return nil, fmt.Errorf("variant isn't supported by the %s backend", BackendAPI)
+	}
+	if isJobAction(cfg.Action) {
+		if cfg.JobName == "" {
+			// the job name falls back to "service" so existing pipelines only need to change the action
+			cfg.JobName = cfg.ServiceName
+		}
+		if cfg.JobName == "" && strings.TrimSpace(os.Getenv("PLUGIN_SERVICES")) == "" {
+			return nil, fmt.Errorf("Missing job name")
+		}
+	} else if cfg.ServiceName == "" && strings.TrimSpace(os.Getenv("PLUGIN_SERVICES")) == "" {
 		return nil, fmt.Errorf("Missing service name")
 	}
 	if cfg.ImageName == "" {
-		// for Drone v0.8 compat. as 'image' clashes since settings are passed top-level
-		cfg.ImageName = os.Getenv("PLUGIN_DEPLOYMENT_IMAGE")
-		if cfg.ImageName == "" && cfg.Action == "deploy" {
+		// the service template of "replace" can bring its own image
+		imageRequired := deploysImage(cfg.Action) && !(cfg.Action == "replace" && cfg.ServiceYAML != "")
+		if cfg.ImageName == "" && imageRequired && strings.TrimSpace(os.Getenv("PLUGIN_SERVICES")) == "" {
 			return nil, fmt.Errorf("Missing image/deployment_image name")
 		}
 	}
 
-	if cfg.Token == "" {
+	if cfg.Action == "preview" || cfg.Action == "preview-cleanup" {
+		if cfg.PreviewType == "" {
+			cfg.PreviewType = PreviewTypeService
+		}
+		if cfg.PreviewType != PreviewTypeService && cfg.PreviewType != PreviewTypeTag {
+			return nil, fmt.Errorf("invalid preview_type: [%s], expected %s or %s", cfg.PreviewType, PreviewTypeService, PreviewTypeTag)
+		}
+		if cfg.URLFile == "" {
+			cfg.URLFile = DefaultURLFile
+		}
+	}
+
+	if err := parseServicesConfig(&cfg); err != nil {
+		return nil, err
+	}
+
+	if err := parseRegionConfig(&cfg); err != nil {
+		return nil, err
+	}
+
+	if err := parseVerifyConfig(&cfg); err != nil {
+		return nil, err
+	}
+
+	if cfg.Action == "canary" {
+		if err := parseCanaryConfig(&cfg); err != nil {
+			return nil, err
+		}
+	}
+
+	for name, val := range map[string]string{
+		"tasks":       cfg.Tasks,
+		"parallelism": cfg.Parallelism,
+		"max_retries": cfg.MaxRetries,
+	} {
+		if val == "" {
+			continue
+		}
+		if n, err := strconv.Atoi(val); err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid %s: [%s], expected a non-negative integer", name, val)
+		}
+	}
+
+	if cfg.CredentialConfig != "" {
+		if err := validateCredentialConfig(cfg.CredentialConfig); err != nil {
+			return nil, err
+		}
+	} else if cfg.Token == "" {
 		cfg.Token = os.Getenv("TOKEN")
 		if cfg.Token == "" {
-			return nil, fmt.Errorf("Missing token")
+			return nil, fmt.Errorf("Missing token or credential_config")
 		}
 	}
 
 	if cfg.Project == "" {
-		cfg.Project = getProjectFromToken(cfg.Token)
+		if cfg.CredentialConfig != "" {
+			cfg.Project = getProjectFromCredentialConfig(cfg.CredentialConfig)
+		} else {
+			cfg.Project = getProjectFromToken(cfg.Token)
+		}
 		if cfg.Project == "" {
-			return nil, fmt.Errorf("project id not found in token or param")
+			return nil, fmt.Errorf("project id not found in token, credential_config or param")
 		}
 	}
 	log.Printf("Using project ID: %s", cfg.Project)
@@ -150,6 +388,60 @@ func parseConfig() (*Config, error) {
 	return &cfg, nil
 }
 
+// settingsMap is a map setting like environment whose values can be written as numbers,
+// booleans or null in the pipeline, e.g. "PORT: 8080", they're converted to strings
+type settingsMap map[string]string
+
+func (m *settingsMap) UnmarshalJSON(b []byte) error {
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return err
+	}
+
+	values := settingsMap{}
+	keys := make([]string, 0, len(raw))
+	for k := range raw {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		var v interface{}
+		d := json.NewDecoder(bytes.NewReader(raw[k]))
+		d.UseNumber()
+		if err := d.Decode(&v); err != nil {
+			return err
+		}
+
+		switch v := v.(type) {
+		case nil:
+			values[k] = ""
+		case string:
+			values[k] = v
+		case bool:
+			values[k] = strconv.FormatBool(v)
+		case json.Number:
+			// as written, so 1.10 stays 1.10 instead of becoming 1.1
+			values[k] = v.String()
+		default:
+			return fmt.Errorf("invalid value of %s, expected a string, number, boolean or null, got: %s", k, raw[k])
+		}
+	}
+	*m = values
+	return nil
+}
+
+// parseSettingsMap parses the JSON of a map setting, a blank setting is the same as none
+func parseSettingsMap(name, value string) (map[string]string, error) {
+	if strings.TrimSpace(value) == "" {
+		return nil, nil
+	}
+	var m settingsMap
+	if err := json.Unmarshal([]byte(value), &m); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: [%s]", name, err)
+	}
+	return m, nil
+}
+
 func CreateExecutionPlan(cfg *Config) ([]string, error) {
 	args := []string{
 		"--quiet",
@@ -159,6 +451,12 @@ func CreateExecutionPlan(cfg *Config) ([]string, error) {
 		args = append(args, cfg.Variant)
 	}
 
+	if ecfg, err := effectiveConfig(cfg); err != nil {
+		return []string{}, err
+	} else if ecfg != cfg {
+		return CreateExecutionPlan(ecfg)
+	}
+
 	args = append(args, "run")
 
 	switch cfg.Action {
@@ -167,35 +465,15 @@ func CreateExecutionPlan(cfg *Config) ([]string, error) {
 		args = append(args, cfg.ServiceName)
 		args = append(args, "--image", cfg.ImageName)
 
-		// we're using ":||:" as the separator for args, let's hope no one puts that in an env or secret variable value
-		sep := ":||:"
-
 		if cfg.SvcAccount != "" {
 			args = append(args, "--service-account", cfg.SvcAccount)
 		}
 
-		if len(cfg.EnvSecrets) > 0 || len(cfg.Environment) > 0 {
-			e := make([]string, len(cfg.EnvSecrets))
-			copy(e, cfg.EnvSecrets)
-			for k, v := range cfg.Environment {
-				e = append(e, fmt.Sprintf(`%s=%s`, k, v))
-			}
-
-			envStr := strings.Join(e, sep)
-			envStr = "^" + sep + "^" + envStr
-			args = append(args, "--set-env-vars", envStr)
-		}
-
-		if len(cfg.Secrets) > 0 {
-			e := make([]string, 0)
-			for k, v := range cfg.Secrets {
-				e = append(e, fmt.Sprintf(`%s=%s`, k, v))
-			}
-
-			secretsStr := strings.Join(e, sep)
-			secretsStr = "^" + sep + "^" + secretsStr
-			args = append(args, "--set-secrets", secretsStr)
+		env, err := envArgs(cfg)
+		if err != nil {
+			return []string{}, err
 		}
+		args = append(args, env...)
 
 		// If --quiet and none selected, GCP defaults to --no-allow-unauthenticated
 		if cfg.AllowUnauthenticated {
@@ -216,57 +494,516 @@ func CreateExecutionPlan(cfg *Config) ([]string, error) {
 			args = append(args, "--timeout", cfg.Timeout)
 		}
 
+		if cfg.Tag != "" {
+			args = append(args, "--tag", cfg.Tag)
+		}
+
+		if cfg.NoTraffic {
+			args = append(args, "--no-traffic")
+		}
+
+		args = append(args, labelArgs(cfg)...)
+		suffix, err := revisionSuffixArgs(cfg)
+		if err != nil {
+			return []string{}, err
+		}
+		args = append(args, suffix...)
+
+	case "replace":
+		if cfg.ReplaceFile == "" {
+			return []string{}, fmt.Errorf("no rendered service file to replace the service with")
+		}
+		args = append(args, "services", "replace")
+		args = append(args, cfg.ReplaceFile)
+
+	case "deploy-job":
+		args = append(args, "jobs", "deploy")
+		args = append(args, cfg.JobName)
+		args = append(args, "--image", cfg.ImageName)
+
+		if cfg.SvcAccount != "" {
+			args = append(args, "--service-account", cfg.SvcAccount)
+		}
+
+		env, err := envArgs(cfg)
+		if err != nil {
+			return []string{}, err
+		}
+		args = append(args, env...)
+
+		if cfg.Memory != "" {
+			args = append(args, "--memory", cfg.Memory)
+		}
+
+		if cfg.Tasks != "" {
+			args = append(args, "--tasks", cfg.Tasks)
+		}
+
+		if cfg.Parallelism != "" {
+			args = append(args, "--parallelism", cfg.Parallelism)
+		}
+
+		if cfg.MaxRetries != "" {
+			args = append(args, "--max-retries", cfg.MaxRetries)
+		}
+
+		if cfg.TaskTimeout != "" {
+			args = append(args, "--task-timeout", cfg.TaskTimeout)
+		}
+
+		args = append(args, labelArgs(cfg)...)
+
+	case "execute-job":
+		// --wait makes gcloud block until the execution finishes and exit non-zero if it failed
+		args = append(args, "jobs", "execute")
+		args = append(args, cfg.JobName)
+		args = append(args, "--wait")
+
 	case "update-traffic":
 		args = append(args, "services", "update-traffic")
 		args = append(args, cfg.ServiceName)
 
+	case "rollback":
+		if cfg.Revision == "" {
+			return []string{}, fmt.Errorf("no revision to roll back to")
+		}
+		args = append(args, "services", "update-traffic")
+		args = append(args, cfg.ServiceName)
+		args = append(args, "--to-revisions", cfg.Revision+"=100")
+
+	case "delete":
+		if !deleteAllowed(cfg.ServiceName, cfg.DeleteAllowlist) {
+			return []string{}, fmt.Errorf("refusing to delete service: %s, it doesn't match any delete_allowlist pattern %v", cfg.ServiceName, cfg.DeleteAllowlist)
+		}
+		args = append(args, "services", "delete")
+		args = append(args, cfg.ServiceName)
+
 	default:
 		return []string{}, fmt.Errorf("action: %s not implemented yet", cfg.Action)
 	}
 
-	args = append(args, "--project", cfg.Project)
-	args = append(args, "--platform", cfg.Runtime)
+	args = append(args, locationArgs(cfg)...)
+
+	for _, flg := range sortedKeys(cfg.AdditionalFlags) {
+		if argStr := cfg.AdditionalFlags[flg]; argStr != "" {
+			args = append(args, fmt.Sprintf("--%s=%s", flg, argStr))
+		} else {
+			args = append(args, fmt.Sprintf("--%s", flg))
+		}
+	}
+
+	return args, nil
+}
+
+// effectiveConfig resolves the composite actions into the config of the single command
+// they start with, for all other actions it returns cfg itself
+func effectiveConfig(cfg *Config) (*Config, error) {
+	switch cfg.Action {
+	case "preview", "preview-cleanup":
+		return previewConfig(cfg)
+
+	case "canary":
+		// the canary starts out as a tagged revision without traffic, see runCanary() for the rollout
+		ccfg := *cfg
+		ccfg.Action = "deploy"
+		ccfg.NoTraffic = true
+		return &ccfg, nil
+	}
+	return cfg, nil
+}
+
+// locationArgs returns the flags selecting the project, platform and region a command runs against
+func locationArgs(cfg *Config) []string {
+	args := []string{"--project", cfg.Project}
+
+	// jobs are only available on fully managed Cloud Run and "gcloud run jobs" doesn't accept --platform
+	if !isJobAction(cfg.Action) {
+		args = append(args, "--platform", cfg.Runtime)
+	}
 
 	if cfg.Region != "" {
 		args = append(args, "--region", cfg.Region)
 	}
 
-	for flg, argStr := range cfg.AdditionalFlags {
-		if argStr != "" {
-			args = append(args, fmt.Sprintf("--%s=%s", flg, argStr))
-		} else {
-			args = append(args, fmt.Sprintf("--%s", flg))
+	return args
+}
+
+// parseEnvMode reads env_mode and the env vars and secrets to remove, which only works when merging
+func parseEnvMode(cfg *Config) error {
+	if cfg.EnvMode == "" {
+		cfg.EnvMode = EnvModeReplace
+	}
+	if cfg.EnvMode != EnvModeReplace && cfg.EnvMode != EnvModeMerge {
+		return fmt.Errorf("invalid env_mode: [%s], expected %s or %s", cfg.EnvMode, EnvModeReplace, EnvModeMerge)
+	}
+
+	envSet, secretSet := map[string]bool{}, map[string]bool{}
+	for _, kv := range cfg.EnvSecrets {
+		envSet[strings.SplitN(kv, "=", 2)[0]] = true
+	}
+	for k := range cfg.Environment {
+		envSet[k] = true
+	}
+	for k := range cfg.Secrets {
+		secretSet[k] = true
+	}
+
+	for _, r := range []struct {
+		setting string
+		keys    *[]string
+		set     map[string]bool
+	}{
+		{"remove_env", &cfg.RemoveEnv, envSet},
+		{"remove_secrets", &cfg.RemoveSecrets, secretSet},
+	} {
+		keys, err := interpolatedSettingValue(r.setting)
+		if err != nil {
+			return err
+		}
+		for _, k := range strings.Split(keys, ",") {
+			if k = strings.TrimSpace(k); k == "" {
+				continue
+			}
+			if r.set[k] {
+				return fmt.Errorf("%s removes a variable that's set too: [%s]", r.setting, k)
+			}
+			*r.keys = append(*r.keys, k)
 		}
+		sort.Strings(*r.keys)
+		if len(*r.keys) > 0 && cfg.EnvMode != EnvModeMerge {
+			return fmt.Errorf("%s needs env_mode %s, with %s everything that isn't set is removed anyway", r.setting, EnvModeMerge, EnvModeReplace)
+		}
+	}
+	return nil
+}
+
+// envArgs returns the --set-env-vars and --set-secrets flags shared by services and jobs, or with
+// env_mode merge the --update-* and --remove-* flags
+func envArgs(cfg *Config) ([]string, error) {
+	var args []string
+
+	setEnv, setSecrets := "--set-env-vars", "--set-secrets"
+	if cfg.EnvMode == EnvModeMerge {
+		setEnv, setSecrets = "--update-env-vars", "--update-secrets"
+	}
+
+	if len(cfg.EnvSecrets) > 0 || len(cfg.Environment) > 0 {
+		// environment comes after env_secret_* so it keeps winning when both set a variable
+		e := make([]string, len(cfg.EnvSecrets))
+		copy(e, cfg.EnvSecrets)
+		sort.Strings(e)
+		for _, k := range sortedKeys(cfg.Environment) {
+			e = append(e, fmt.Sprintf(`%s=%s`, k, cfg.Environment[k]))
+		}
+
+		envStr, err := listArg(e)
+		if err != nil {
+			return nil, fmt.Errorf("can't pass the env vars to gcloud: %s", err)
+		}
+		args = append(args, setEnv, envStr)
+	}
+
+	if len(cfg.Secrets) > 0 {
+		e := make([]string, 0)
+		for _, k := range sortedKeys(cfg.Secrets) {
+			e = append(e, fmt.Sprintf(`%s=%s`, k, cfg.Secrets[k]))
+		}
+
+		secretsStr, err := listArg(e)
+		if err != nil {
+			return nil, fmt.Errorf("can't pass the secrets to gcloud: %s", err)
+		}
+		args = append(args, setSecrets, secretsStr)
+	}
+
+	for _, r := range []struct {
+		flag string
+		keys []string
+	}{
+		{"--remove-env-vars", cfg.RemoveEnv},
+		{"--remove-secrets", cfg.RemoveSecrets},
+	} {
+		if len(r.keys) == 0 {
+			continue
+		}
+		keys, err := listArg(r.keys)
+		if err != nil {
+			return nil, fmt.Errorf("can't pass %s to gcloud: %s", r.flag, err)
+		}
+		args = append(args, r.flag, keys)
 	}
 
 	return args, nil
 }
 
-func ExecutePlan(e *Env, plan []string) error {
-	if err := e.Run(GCloudCommand, plan...); err != nil {
+// listDelimiters are the delimiters listArg() tries in order, the first one is what the plugin always used
+var listDelimiters = []string{":||:", "@@", "##", "~~", ";;", "%%", "!!", "&&", "**", "++", "::", "||", ",,"}
+
+// listArg joins items into a gcloud list argument with the "^<delimiter>^" syntax, see
+// "gcloud topic escaping", using the first delimiter that splits back into exactly the items
+func listArg(items []string) (string, error) {
+	for _, sep := range listDelimiters {
+		// checking the joined string catches delimiters across item boundaries too, e.g. a value ending in ":||"
+		if joined := strings.Join(items, sep); splitsInto(joined, sep, items) {
+			return "^" + sep + "^" + joined, nil
+		}
+	}
+	return "", fmt.Errorf("no delimiter to separate the values, all of %s appear in them", strings.Join(listDelimiters, " "))
+}
+
+// splitsInto reports whether splitting s at sep gives exactly items
+func splitsInto(s, sep string, items []string) bool {
+	split := strings.Split(s, sep)
+	if len(split) != len(items) {
+		return false
+	}
+	for i := range split {
+		if split[i] != items[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// sortedKeys returns the keys of m in order, so plans don't depend on the map iteration order
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// deleteAllowed reports whether the service name matches one of the allowlist patterns,
+// an empty allowlist never allows a delete
+func deleteAllowed(service string, allowlist []string) bool {
+	for _, p := range allowlist {
+		if ok, _ := path.Match(p, service); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// deploysImage returns true for the actions that create a new revision or job from "image"
+func deploysImage(action string) bool {
+	return action == "deploy" || action == "deploy-job" || action == "preview" || action == "canary" || action == "replace"
+}
+
+func isJobAction(action string) bool {
+	return action == "deploy-job" || action == "execute-job"
+}
+
+// ExecutePlan carries out the plan CreateExecutionPlan() created for cfg
+func ExecutePlan(b Backend, cfg *Config, plan []string) error {
+	if err := b.Execute(cfg, plan); err != nil {
 		return fmt.Errorf("error: %s\n", err)
 	}
 
 	return nil
 }
 
-func runConfig(cfg *Config) error {
+// runPlan creates the plan for cfg and executes it
+func runPlan(b Backend, cfg *Config) error {
 	plan, err := CreateExecutionPlan(cfg)
 	if err != nil {
 		return err
 	}
+	return ExecutePlan(b, cfg, plan)
+}
+
+// runDeploy executes the deploy plan and verifies the deployment, with rollback_on_failure set
+// the traffic split from before the deploy is restored if either fails
+func runDeploy(b Backend, cfg *Config, plan []string) error {
+	prior := ""
+	if cfg.RollbackOnFailure {
+		prior = servingTraffic(b, cfg)
+	}
+
+	err := ExecutePlan(b, cfg, plan)
+	if err == nil {
+		err = verifyDeployment(b, cfg)
+	}
+	if err != nil && prior != "" {
+		return revertTraffic(b, cfg, prior, err)
+	}
+	return err
+}
 
-	e := NewEnv(cfg.Dir, os.Environ(), os.Stdout, os.Stderr, false)
+// planFor creates the plan for cfg, rollbacks without a revision are planned once the
+// previous revision is known, see runRollback(), and replace once the service is rendered,
+// see runReplace(). diff doesn't change anything so it has no plan.
+func planFor(cfg *Config) ([]string, error) {
+	if cfg.Action == "rollback" && cfg.Revision == "" {
+		return nil, nil
+	}
+	if cfg.Action == "diff" {
+		_, _, err := desiredSettings(cfg)
+		return nil, err
+	}
+	if cfg.Action == "replace" && cfg.ReplaceFile == "" {
+		_, err := renderService(cfg)
+		return nil, err
+	}
+	return CreateExecutionPlan(cfg)
+}
 
-	if err := e.Run(GCloudCommand, "version"); err != nil {
+func runConfig(cfg *Config) error {
+	// plans are created before authenticating so invalid settings fail right away
+	for _, scfg := range serviceConfigs(cfg) {
+		for _, rcfg := range regionConfigs(scfg) {
+			if _, err := planFor(rcfg); err != nil {
+				return err
+			}
+		}
+	}
+
+	if cfg.DryRun {
+		return dryRun(cfg)
+	}
+
+	creds, err := NewCredentials(cfg)
+	if err != nil {
+		return err
+	}
+	defer creds.Cleanup()
+	defer removeOnSignal(creds)()
+
+	e := NewEnv(cfg.Dir, append(os.Environ(), creds.Env()...), os.Stdout, os.Stderr, false)
+	e.Redact(cfg.SensitiveValues()...)
+
+	b, err := NewBackend(cfg, e, creds)
+	if err != nil {
 		return err
 	}
 
-	if err := e.Run(GCloudCommand, "auth", "activate-service-account", "--key-file", TmpTokenFileLocation); err != nil {
+	if err := b.Setup(); err != nil {
+		return err
+	}
+
+	if len(cfg.Services) > 0 {
+		return runServices(b, cfg, creds)
+	}
+	return runService(b, cfg, creds)
+}
+
+// runService runs the action for the service of cfg in all its regions
+func runService(b Backend, cfg *Config, creds *Credentials) error {
+	// the image is the same in every region so it's only checked once
+	switch {
+	case !deploysImage(cfg.Action), cfg.ImageName == "":
+		// replace can take the image from service_yaml, gcloud checks it exists then
+	case cfg.ResolveDigest:
+		// resolving the digest checks the image exists as well
+		if err := resolveImageDigest(b, cfg); err != nil {
+			return err
+		}
+	case !cfg.SkipImageCheck:
+		if err := checkImage(b, cfg.ImageName); err != nil {
+			return err
+		}
+	}
+
+	if len(cfg.Regions) > 1 {
+		return runRegions(cfg, creds)
+	}
+	return runAction(b, cfg, creds)
+}
+
+// runAction creates the plan for cfg and runs the action with the authenticated backend
+func runAction(b Backend, cfg *Config, creds *Credentials) error {
+	if cfg.Action == "deploy" {
+		fcfg, unchanged, err := fingerprintDeploy(b, cfg)
+		if err != nil {
+			return err
+		}
+		if unchanged {
+			b.Logf("Skipping deploy, service %s is already deployed with the same image and settings, set force to deploy anyway", cfg.ServiceName)
+			return verifyDeployment(b, cfg)
+		}
+		cfg = fcfg
+	}
+
+	plan, err := planFor(cfg)
+	if err != nil {
+		return err
+	}
+
+	switch cfg.Action {
+	case "deploy":
+		if cfg.ReportDrift {
+			// the report is informational, the deploy goes ahead either way
+			if _, err := reportDrift(b, cfg); err != nil {
+				b.Logf("Couldn't report the drift of service %s: %s", cfg.ServiceName, err)
+			}
+		}
+		return runDeploy(b, cfg, plan)
+
+	case "diff":
+		return runDiff(b, cfg)
+
+	case "canary":
+		return runCanary(b, cfg, plan)
+
+	case "rollback":
+		return runRollback(b, cfg)
+
+	case "replace":
+		return runReplace(b, cfg, creds)
+	}
+
+	if err := ExecutePlan(b, cfg, plan); err != nil {
 		return err
 	}
 
-	return ExecutePlan(e, plan)
+	switch cfg.Action {
+	case "preview":
+		pcfg, err := previewConfig(cfg)
+		if err != nil {
+			return err
+		}
+		if err := verifyDeployment(b, pcfg); err != nil {
+			return err
+		}
+		return writePreviewURL(b, cfg)
+	}
+
+	return nil
+}
+
+// dryRun logs what runConfig() would run for cfg without authenticating or running anything
+func dryRun(cfg *Config) error {
+	e := NewEnv(cfg.Dir, os.Environ(), os.Stdout, os.Stderr, true)
+	e.Redact(cfg.SensitiveValues()...)
+
+	for _, scfg := range serviceConfigs(cfg) {
+		for _, rcfg := range regionConfigs(scfg) {
+			if rcfg.Action == "replace" {
+				manifest, err := renderService(rcfg)
+				if err != nil {
+					return err
+				}
+				dcfg := *rcfg
+				dcfg.ReplaceFile = rcfg.ServiceName + ".yaml"
+				rcfg = &dcfg
+				log.Printf("Dry run, rendered %s:\n%s", rcfg.ReplaceFile, e.mask(manifest))
+			}
+
+			plan, err := planFor(rcfg)
+			if err != nil {
+				return err
+			}
+			if plan == nil {
+				log.Printf("Dry run, skipping %s of service %s, it depends on the live service", rcfg.Action, rcfg.ServiceName)
+				continue
+			}
+			if err := e.Run(GCloudCommand, plan...); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
 }
 
 type Env struct {
@@ -275,6 +1012,12 @@ type Env struct {
 	stdout io.Writer
 	stderr io.Writer
 	dryRun bool
+
+	// values masked in all log output, see redact.go
+	secrets []string
+
+	// prepended to the logged commands, see region.go
+	logPrefix string
 }
 
 func NewEnv(dir string, env []string, stdout, stderr io.Writer, dryRun bool) *Env {
@@ -287,19 +1030,45 @@ func NewEnv(dir string, env []string, stdout, stderr io.Writer, dryRun bool) *En
 	}
 }
 
+// Logf logs like log.Printf, with the prefix of the commands and the secrets masked, so the lines
+// of regions running in parallel can be told apart
+func (e *Env) Logf(format string, args ...interface{}) {
+	log.Print(e.logPrefix + e.mask(fmt.Sprintf(format, args...)))
+}
+
 func (e *Env) Run(name string, arg ...string) error {
-	log.Printf("Running: %s %#v", name, arg)
+	log.Printf("%sRunning: %s %#v", e.logPrefix, name, e.maskAll(arg))
 	if e.dryRun {
 		return nil
 	}
+	stdout, stderr := e.redactWriter(e.stdout), e.redactWriter(e.stderr)
+	defer stdout.Flush()
+	defer stderr.Flush()
+
 	cmd := exec.Command(name, arg...)
 	cmd.Dir = e.dir
 	cmd.Env = e.env
-	cmd.Stdout = e.stdout
-	cmd.Stderr = e.stderr
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
 	return cmd.Run()
 }
 
+// Output runs the command like Run but returns its stdout instead of passing it through
+func (e *Env) Output(name string, arg ...string) ([]byte, error) {
+	log.Printf("%sRunning: %s %#v", e.logPrefix, name, e.maskAll(arg))
+	if e.dryRun {
+		return nil, nil
+	}
+	stderr := e.redactWriter(e.stderr)
+	defer stderr.Flush()
+
+	cmd := exec.Command(name, arg...)
+	cmd.Dir = e.dir
+	cmd.Env = e.env
+	cmd.Stderr = stderr
+	return cmd.Output()
+}
+
 func main() {
 	if BuildTag == "" {
 		BuildTag = "[not-tagged]"
@@ -320,14 +1089,7 @@ func main() {
 		return
 	}
 
-	if err := ioutil.WriteFile(TmpTokenFileLocation, []byte(cfg.Token), 0600); err != nil {
-		log.Fatalf("Error writing token file: %s", err)
-	}
-
-	defer func() {
-		os.Remove(TmpTokenFileLocation)
-	}()
-
+	// runConfig() removes the credentials before returning, so it's safe to log.Fatalf() here
 	if err := runConfig(cfg); err != nil {
 		log.Fatalf("runConfig() err: %s", err)
 		return
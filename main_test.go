@@ -3,7 +3,9 @@ package main
 import (
 	"bytes"
 	"fmt"
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 )
@@ -22,6 +24,17 @@ var (
   "auth_provider_x509_cert_url": "https://www.googleapis.com/oauth2/v1/certs",
   "client_x509_cert_url": "https://www.googleapis.com/robot/v1/metadata/x509/my-project%40appspot.gserviceaccount.com"
 }
+`
+
+	validCredentialConfig = `
+{
+  "type": "external_account",
+  "audience": "//iam.googleapis.com/projects/123456/locations/global/workloadIdentityPools/drone/providers/drone",
+  "subject_token_type": "urn:ietf:params:oauth:token-type:jwt",
+  "token_url": "https://sts.googleapis.com/v1/token",
+  "service_account_impersonation_url": "https://iamcredentials.googleapis.com/v1/projects/-/serviceAccounts/deployer@my-wif-project.iam.gserviceaccount.com:generateAccessToken",
+  "credential_source": {"file": "/var/run/oidc-token"}
+}
 `
 
 	invalidGCPKey = `
@@ -33,6 +46,13 @@ var (
 `
 )
 
+func TestMain(m *testing.M) {
+	// tests mustn't reach out to real registries, registry_test.go covers the image check
+	checkImage = func(Backend, string) error { return nil }
+	lookupDigest = func(Backend, string) (string, error) { return "", fmt.Errorf("no registry in tests") }
+	os.Exit(m.Run())
+}
+
 func TestEnvironRun(t *testing.T) {
 	stdout := &bytes.Buffer{}
 	stderr := &bytes.Buffer{}
@@ -242,6 +262,92 @@ func TestParseAndRunConfig(t *testing.T) {
 			cfgExpectedProjectId: "my-project-id",
 			planExpectedFlags:    []string{"--add-cloud-sql-instances=instance1,instance2", "--clear-config-maps"},
 		},
+		// numbers, booleans and null are converted to strings as they're written
+		{
+			cfgExpectedOk:        true,
+			env:                  map[string]string{"PLUGIN_ACTION": "deploy", "PLUGIN_TOKEN": validGCPKey, "PLUGIN_ENVIRONMENT": `{"PORT":8080,"DEBUG":true,"RATIO":1.50,"BIG":12345678901234567890,"EMPTY":null}`, "PLUGIN_SERVICE": "my-service", "PLUGIN_IMAGE": "my-image"},
+			cfgExpectedProjectId: "my-project-id",
+			cfgExpectedEnvKeys:   []string{"PORT=8080", "DEBUG=true", "RATIO=1.50", "BIG=12345678901234567890", "EMPTY="},
+			planExpectedOk:       true,
+		},
+		{
+			cfgExpectedOk:        true,
+			env:                  map[string]string{"PLUGIN_ACTION": "deploy", "PLUGIN_TOKEN": validGCPKey, "PLUGIN_SECRETS": `{"/mnt/path":"secretname:1"}`, "PLUGIN_ADDL_FLAGS": `{"max-instances":10,"cpu-boost":null}`, "PLUGIN_SERVICE": "my-service", "PLUGIN_IMAGE": "my-image"},
+			cfgExpectedProjectId: "my-project-id",
+			planExpectedFlags:    []string{"--max-instances=10", "--cpu-boost"},
+			planExpectedOk:       true,
+		},
+		{
+			cfgExpectedOk:        false,
+			env:                  map[string]string{"PLUGIN_ACTION": "deploy", "PLUGIN_TOKEN": validGCPKey, "PLUGIN_ENV_FILES": "deploy/missing.env", "PLUGIN_SERVICE": "my-service", "PLUGIN_IMAGE": "my-image"},
+			cfgExpectedProjectId: "my-project-id",
+		},
+		// env_mode merge only touches the listed env vars and secrets
+		{
+			cfgExpectedOk:        true,
+			env:                  map[string]string{"PLUGIN_ACTION": "deploy", "PLUGIN_TOKEN": validGCPKey, "PLUGIN_ENV_MODE": "merge", "PLUGIN_ENVIRONMENT": `{"A":"1"}`, "PLUGIN_SECRETS": `{"KEY":"key:2"}`, "PLUGIN_REMOVE_ENV": "OLD,LEGACY", "PLUGIN_REMOVE_SECRETS": "/etc/old.pem", "PLUGIN_SERVICE": "my-service", "PLUGIN_IMAGE": "my-image"},
+			cfgExpectedProjectId: "my-project-id",
+			planExpectedFlags:    []string{"--update-env-vars", "^:||:^A=1", "--update-secrets", "^:||:^KEY=key:2", "--remove-env-vars", "^:||:^LEGACY:||:OLD", "--remove-secrets", "^:||:^/etc/old.pem"},
+			planExpectedOk:       true,
+		},
+		{
+			cfgExpectedOk:        false,
+			env:                  map[string]string{"PLUGIN_ACTION": "deploy", "PLUGIN_TOKEN": validGCPKey, "PLUGIN_ENV_MODE": "append", "PLUGIN_SERVICE": "my-service", "PLUGIN_IMAGE": "my-image"},
+			cfgExpectedProjectId: "my-project-id",
+		},
+		{
+			cfgExpectedOk:        false,
+			env:                  map[string]string{"PLUGIN_ACTION": "deploy", "PLUGIN_TOKEN": validGCPKey, "PLUGIN_REMOVE_ENV": "OLD", "PLUGIN_SERVICE": "my-service", "PLUGIN_IMAGE": "my-image"},
+			cfgExpectedProjectId: "my-project-id",
+		},
+		{
+			cfgExpectedOk:        false,
+			env:                  map[string]string{"PLUGIN_ACTION": "deploy", "PLUGIN_TOKEN": validGCPKey, "PLUGIN_ENV_MODE": "merge", "PLUGIN_ENVIRONMENT": `{"A":"1"}`, "PLUGIN_REMOVE_ENV": "A", "PLUGIN_SERVICE": "my-service", "PLUGIN_IMAGE": "my-image"},
+			cfgExpectedProjectId: "my-project-id",
+		},
+		// settings are interpolated with the Drone variables
+		{
+			cfgExpectedOk:        true,
+			env:                  map[string]string{"PLUGIN_ACTION": "deploy", "PLUGIN_TOKEN": validGCPKey, "DRONE_COMMIT_SHA": "d0c13cb8646875cf94387f0d3de4e92b85eee3b0", "DRONE_BRANCH": "Feature/Login", "PLUGIN_ENVIRONMENT": `{"VERSION":"${DRONE_COMMIT_SHA}"}`, "PLUGIN_TAG": "${DRONE_BRANCH|slug}", "PLUGIN_SERVICE": "my-service", "PLUGIN_IMAGE": "my-image:${DRONE_COMMIT_SHA|truncate:8}"},
+			cfgExpectedProjectId: "my-project-id",
+			cfgExpectedEnvKeys:   []string{"VERSION=d0c13cb8646875cf94387f0d3de4e92b85eee3b0"},
+			planExpectedFlags:    []string{"--image", "my-image:d0c13cb8", "--tag", "feature-login"},
+			planExpectedOk:       true,
+		},
+		{
+			cfgExpectedOk:        false,
+			env:                  map[string]string{"PLUGIN_ACTION": "deploy", "PLUGIN_TOKEN": validGCPKey, "PLUGIN_TAG": "pr-${DRONE_PULL_REQUEST}", "PLUGIN_SERVICE": "my-service", "PLUGIN_IMAGE": "my-image"},
+			cfgExpectedProjectId: "my-project-id",
+		},
+		// build labels and the labels setting end up in one --update-labels flag
+		{
+			cfgExpectedOk:        true,
+			env:                  map[string]string{"PLUGIN_ACTION": "deploy", "PLUGIN_TOKEN": validGCPKey, "DRONE_BUILD_NUMBER": "42", "DRONE_BRANCH": "Feature/Login", "DRONE_COMMIT_SHA": "d0c13cb8646875cf94387f0d3de4e92b85eee3b0", "PLUGIN_LABELS": `{"team":"payments","branch":"${DRONE_BRANCH|slug}"}`, "PLUGIN_REVISION_SUFFIX": "true", "PLUGIN_SERVICE": "my-service", "PLUGIN_IMAGE": "my-image"},
+			cfgExpectedProjectId: "my-project-id",
+			planExpectedFlags:    []string{"--update-labels", "branch=feature-login,drone-branch=feature-login,drone-build=42,drone-commit=d0c13cb8646875cf94387f0d3de4e92b85eee3b0,team=payments", "--revision-suffix", "d0c13cb-42"},
+			planExpectedOk:       true,
+		},
+		{
+			cfgExpectedOk:        false,
+			env:                  map[string]string{"PLUGIN_ACTION": "deploy", "PLUGIN_TOKEN": validGCPKey, "PLUGIN_LABELS": `{"Team":"payments"}`, "PLUGIN_SERVICE": "my-service", "PLUGIN_IMAGE": "my-image"},
+			cfgExpectedProjectId: "my-project-id",
+		},
+		// nested values and invalid JSON fail instead of deploying without the variables
+		{
+			cfgExpectedOk:        false,
+			env:                  map[string]string{"PLUGIN_ACTION": "deploy", "PLUGIN_TOKEN": validGCPKey, "PLUGIN_ENVIRONMENT": `{"PORT":8080,"NESTED":{"A":"1"}}`, "PLUGIN_SERVICE": "my-service", "PLUGIN_IMAGE": "my-image"},
+			cfgExpectedProjectId: "my-project-id",
+		},
+		{
+			cfgExpectedOk:        false,
+			env:                  map[string]string{"PLUGIN_ACTION": "deploy", "PLUGIN_TOKEN": validGCPKey, "PLUGIN_ENVIRONMENT": `{"VAR_1":"var01"`, "PLUGIN_SERVICE": "my-service", "PLUGIN_IMAGE": "my-image"},
+			cfgExpectedProjectId: "my-project-id",
+		},
+		{
+			cfgExpectedOk:        false,
+			env:                  map[string]string{"PLUGIN_ACTION": "deploy", "PLUGIN_TOKEN": validGCPKey, "PLUGIN_SECRETS": `{"API_KEY":["api-key","latest"]}`, "PLUGIN_SERVICE": "my-service", "PLUGIN_IMAGE": "my-image"},
+			cfgExpectedProjectId: "my-project-id",
+		},
 		{
 			env: map[string]string{
 				"PLUGIN_ACTION": "deploy", "PLUGIN_SERVICE": "my-service",
@@ -318,6 +424,216 @@ func TestParseAndRunConfig(t *testing.T) {
 			cfgExpectedProjectId: "my-project-id",
 			planExpectedFlags:    []string{"--no-allow-unauthenticated"},
 		},
+		{
+			env: map[string]string{
+				"PLUGIN_ACTION": "deploy-job", "PLUGIN_JOB": "my-job",
+				"PLUGIN_IMAGE": "my-image", "PLUGIN_TOKEN": validGCPKey,
+				"PLUGIN_SVC_ACCOUNT": "1234-my-service-acct@account.com", "PLUGIN_ENV_SECRET_API_KEY": "secret",
+				"PLUGIN_TASKS": "10", "PLUGIN_PARALLELISM": "2", "PLUGIN_MAX_RETRIES": "3", "PLUGIN_TASK_TIMEOUT": "30m"},
+			planExpectedOk:        true,
+			cfgExpectedOk:         true,
+			cfgExpectedProjectId:  "my-project-id",
+			cfgExpectedEnvSecrets: []string{"API_KEY=secret"},
+			planExpectedFlags: []string{"jobs", "deploy", "my-job", "--service-account", "--set-env-vars", "^:||:^API_KEY=secret",
+				"--tasks", "10", "--parallelism", "2", "--max-retries", "3", "--task-timeout", "30m"},
+		},
+		// job name falls back to the service name
+		{
+			env: map[string]string{
+				"PLUGIN_ACTION": "execute-job", "PLUGIN_SERVICE": "my-job", "PLUGIN_TOKEN": validGCPKey,
+				"PLUGIN_REGION": "us-central1"},
+			planExpectedOk:       true,
+			cfgExpectedOk:        true,
+			cfgExpectedProjectId: "my-project-id",
+			planExpectedFlags:    []string{"jobs", "execute", "my-job", "--wait", "--region"},
+		},
+		{
+			cfgExpectedOk:        false,
+			env:                  map[string]string{"PLUGIN_ACTION": "execute-job", "PLUGIN_TOKEN": validGCPKey},
+			cfgExpectedProjectId: "my-project-id",
+		},
+		{
+			cfgExpectedOk:        false,
+			env:                  map[string]string{"PLUGIN_ACTION": "deploy-job", "PLUGIN_JOB": "my-job", "PLUGIN_TOKEN": validGCPKey},
+			cfgExpectedProjectId: "my-project-id",
+		},
+		{
+			cfgExpectedOk:        false,
+			env:                  map[string]string{"PLUGIN_ACTION": "deploy-job", "PLUGIN_JOB": "my-job", "PLUGIN_IMAGE": "my-image", "PLUGIN_TOKEN": validGCPKey, "PLUGIN_TASKS": "many"},
+			cfgExpectedProjectId: "my-project-id",
+		},
+		{
+			env: map[string]string{
+				"PLUGIN_ACTION": "delete", "PLUGIN_SERVICE": "my-service-pr-12", "PLUGIN_TOKEN": validGCPKey,
+				"PLUGIN_DELETE_ALLOWLIST": "*-staging,my-service-pr-*"},
+			planExpectedOk:       true,
+			cfgExpectedOk:        true,
+			cfgExpectedProjectId: "my-project-id",
+			planExpectedFlags:    []string{"services", "delete", "my-service-pr-12"},
+		},
+		// service doesn't match the allowlist
+		{
+			env: map[string]string{
+				"PLUGIN_ACTION": "delete", "PLUGIN_SERVICE": "my-service", "PLUGIN_TOKEN": validGCPKey,
+				"PLUGIN_DELETE_ALLOWLIST": "my-service-pr-*"},
+			planExpectedOk:       false,
+			cfgExpectedOk:        true,
+			cfgExpectedProjectId: "my-project-id",
+		},
+		// no allowlist means no deletes
+		{
+			env:                  map[string]string{"PLUGIN_ACTION": "delete", "PLUGIN_SERVICE": "my-service", "PLUGIN_TOKEN": validGCPKey},
+			planExpectedOk:       false,
+			cfgExpectedOk:        true,
+			cfgExpectedProjectId: "my-project-id",
+		},
+		{
+			env: map[string]string{
+				"PLUGIN_ACTION": "delete", "PLUGIN_SERVICE": "my-service", "PLUGIN_TOKEN": validGCPKey,
+				"PLUGIN_DELETE_ALLOWLIST": "my-service-[pr"},
+			cfgExpectedOk:        false,
+			cfgExpectedProjectId: "my-project-id",
+		},
+		{
+			env: map[string]string{
+				"PLUGIN_ACTION": "deploy", "PLUGIN_SERVICE": "my-service",
+				"PLUGIN_IMAGE": "my-image", "PLUGIN_TOKEN": validGCPKey,
+				"PLUGIN_TAG": "canary", "PLUGIN_NO_TRAFFIC": "true"},
+			planExpectedOk:       true,
+			cfgExpectedOk:        true,
+			cfgExpectedProjectId: "my-project-id",
+			planExpectedFlags:    []string{"--tag", "canary", "--no-traffic"},
+		},
+		{
+			env: map[string]string{
+				"PLUGIN_ACTION": "preview", "PLUGIN_SERVICE": "my-service",
+				"PLUGIN_IMAGE": "my-image", "PLUGIN_TOKEN": validGCPKey,
+				"PLUGIN_PREVIEW_TYPE": "branch", "DRONE_PULL_REQUEST": "12"},
+			cfgExpectedOk:        false,
+			cfgExpectedProjectId: "my-project-id",
+		},
+		{
+			env: map[string]string{
+				"PLUGIN_ACTION": "canary", "PLUGIN_SERVICE": "my-service",
+				"PLUGIN_IMAGE": "my-image", "PLUGIN_TOKEN": validGCPKey,
+				"PLUGIN_CANARY_STEPS": "25,10,100"},
+			cfgExpectedOk:        false,
+			cfgExpectedProjectId: "my-project-id",
+		},
+		{
+			env: map[string]string{
+				"PLUGIN_ACTION": "canary", "PLUGIN_SERVICE": "my-service",
+				"PLUGIN_IMAGE": "my-image", "PLUGIN_TOKEN": validGCPKey,
+				"PLUGIN_CANARY_INTERVAL": "soon"},
+			cfgExpectedOk:        false,
+			cfgExpectedProjectId: "my-project-id",
+		},
+		{
+			env: map[string]string{
+				"PLUGIN_ACTION": "rollback", "PLUGIN_SERVICE": "my-service", "PLUGIN_TOKEN": validGCPKey,
+				"PLUGIN_REVISION": "my-service-00001-abc"},
+			planExpectedOk:       true,
+			cfgExpectedOk:        true,
+			cfgExpectedProjectId: "my-project-id",
+			planExpectedFlags:    []string{"update-traffic", "--to-revisions", "my-service-00001-abc=100"},
+		},
+		// replace needs the image from either the settings or service_yaml
+		{
+			env:                  map[string]string{"PLUGIN_ACTION": "replace", "PLUGIN_SERVICE": "my-service", "PLUGIN_TOKEN": validGCPKey},
+			cfgExpectedOk:        false,
+			cfgExpectedProjectId: "my-project-id",
+		},
+		{
+			env: map[string]string{
+				"PLUGIN_ACTION": "deploy", "PLUGIN_SERVICE": "my-service",
+				"PLUGIN_IMAGE": "my-image", "PLUGIN_TOKEN": validGCPKey,
+				"PLUGIN_BACKEND": "kubectl"},
+			cfgExpectedOk:        false,
+			cfgExpectedProjectId: "my-project-id",
+		},
+		// the API backend only deploys to fully managed Cloud Run
+		{
+			env: map[string]string{
+				"PLUGIN_ACTION": "deploy", "PLUGIN_SERVICE": "my-service", "PLUGIN_IMAGE": "my-image",
+				"PLUGIN_TOKEN": validGCPKey, "PLUGIN_REGION": "us-central1", "PLUGIN_BACKEND": "api", "PLUGIN_RUNTIME": "gke"},
+			cfgExpectedOk:        false,
+			cfgExpectedProjectId: "my-project-id",
+		},
+		{
+			env: map[string]string{
+				"PLUGIN_ACTION": "deploy", "PLUGIN_SERVICE": "my-service", "PLUGIN_IMAGE": "my-image",
+				"PLUGIN_TOKEN": validGCPKey, "PLUGIN_REGION": "us-central1", "PLUGIN_BACKEND": "api", "PLUGIN_VARIANT": "beta"},
+			cfgExpectedOk:        false,
+			cfgExpectedProjectId: "my-project-id",
+		},
+		// workload identity federation, project comes from the impersonated service account
+		{
+			env: map[string]string{
+				"PLUGIN_ACTION": "deploy", "PLUGIN_SERVICE": "my-service", "PLUGIN_IMAGE": "my-image",
+				"PLUGIN_CREDENTIAL_CONFIG": validCredentialConfig, "PLUGIN_OIDC_TOKEN": "oidc-token"},
+			planExpectedOk:       true,
+			cfgExpectedOk:        true,
+			cfgExpectedProjectId: "my-wif-project",
+		},
+		// without impersonation the project number from the pool audience is used
+		{
+			env: map[string]string{
+				"PLUGIN_ACTION": "deploy", "PLUGIN_SERVICE": "my-service", "PLUGIN_IMAGE": "my-image",
+				"PLUGIN_CREDENTIAL_CONFIG": strings.Replace(validCredentialConfig, "service_account_impersonation_url", "unused", 1)},
+			planExpectedOk:       true,
+			cfgExpectedOk:        true,
+			cfgExpectedProjectId: "123456",
+		},
+		{
+			env: map[string]string{
+				"PLUGIN_ACTION": "deploy", "PLUGIN_SERVICE": "my-service", "PLUGIN_IMAGE": "my-image",
+				"PLUGIN_CREDENTIAL_CONFIG": validGCPKey},
+			cfgExpectedOk: false,
+		},
+		{
+			env: map[string]string{
+				"PLUGIN_ACTION": "deploy", "PLUGIN_SERVICE": "my-service", "PLUGIN_IMAGE": "my-image",
+				"PLUGIN_CREDENTIAL_CONFIG": strings.Replace(validCredentialConfig, "token_url", "unused", 1)},
+			cfgExpectedOk: false,
+		},
+		{
+			env: map[string]string{
+				"PLUGIN_ACTION": "deploy", "PLUGIN_SERVICE": "my-service", "PLUGIN_IMAGE": "my-image", "PLUGIN_TOKEN": validGCPKey,
+				"PLUGIN_SVC_ACCOUNT":                 "runtime@my-project-id.iam.gserviceaccount.com",
+				"PLUGIN_IMPERSONATE_SERVICE_ACCOUNT": "delegate@my-project-id.iam.gserviceaccount.com, deployer@my-project-id.iam.gserviceaccount.com"},
+			planExpectedOk:       true,
+			cfgExpectedOk:        true,
+			cfgExpectedProjectId: "my-project-id",
+			planExpectedFlags:    []string{"--service-account", "runtime@my-project-id.iam.gserviceaccount.com"},
+		},
+		{
+			env: map[string]string{
+				"PLUGIN_ACTION": "deploy", "PLUGIN_SERVICE": "my-service", "PLUGIN_IMAGE": "my-image", "PLUGIN_TOKEN": validGCPKey,
+				"PLUGIN_IMPERSONATE_SERVICE_ACCOUNT": "deployer"},
+			cfgExpectedOk: false,
+		},
+		{
+			env: map[string]string{
+				"PLUGIN_ACTION": "deploy", "PLUGIN_SERVICE": "my-service", "PLUGIN_IMAGE": "my-image", "PLUGIN_TOKEN": validGCPKey,
+				"PLUGIN_SVC_ACCOUNT": "runtime@my project"},
+			cfgExpectedOk: false,
+		},
+		// services replace the service setting
+		{
+			env: map[string]string{
+				"PLUGIN_ACTION": "deploy", "PLUGIN_IMAGE": "my-image", "PLUGIN_TOKEN": validGCPKey,
+				"PLUGIN_SERVICES": `[{"name":"api"},{"name":"worker","image":"worker-image"}]`},
+			planExpectedOk:       true,
+			cfgExpectedOk:        true,
+			cfgExpectedProjectId: "my-project-id",
+		},
+		{
+			env: map[string]string{
+				"PLUGIN_ACTION": "deploy", "PLUGIN_TOKEN": validGCPKey,
+				"PLUGIN_SERVICES": `[{"name":"api"},{"name":"worker","image":"worker-image"}]`},
+			cfgExpectedOk:        false,
+			cfgExpectedProjectId: "my-project-id",
+		},
 		// gcloud defaults to --no-allow-unauthenticated if parameter not passed
 		{
 			env: map[string]string{
@@ -355,7 +671,7 @@ func TestParseAndRunConfig(t *testing.T) {
 				t.Errorf("expected projectID: %s   got: %s", tst.cfgExpectedProjectId, cfg.Project)
 			}
 
-			if cfg.Token == "" {
+			if cfg.Token == "" && cfg.CredentialConfig == "" {
 				t.Errorf("expected a token, got nothing, tst: %#v", tst)
 			}
 
@@ -372,6 +688,13 @@ func TestParseAndRunConfig(t *testing.T) {
 				}
 			}
 
+			for _, kv := range tst.cfgExpectedEnvKeys {
+				s := strings.SplitN(kv, "=", 2)
+				if v, ok := cfg.Environment[s[0]]; !ok || v != s[1] {
+					t.Errorf("missing env var: %s, got: %#v", kv, cfg.Environment)
+				}
+			}
+
 			// for _, e := range tst.cfgExpectedSecrets {
 			for k, v := range tst.cfgExpectedSecrets {
 				found := v == cfg.Secrets[k]
@@ -427,3 +750,96 @@ func TestParseAndRunConfig(t *testing.T) {
 		})
 	}
 }
+
+func TestJobPlanWithoutPlatform(t *testing.T) {
+	cfg := &Config{Action: "execute-job", JobName: "my-job", Project: "my-project", Runtime: "managed"}
+	plan, err := CreateExecutionPlan(cfg)
+	if err != nil {
+		t.Fatalf("CreateExecutionPlan() err: %s", err)
+	}
+	for _, p := range plan {
+		if p == "--platform" {
+			t.Errorf("job plans shouldn't contain --platform, got: %v", plan)
+		}
+	}
+}
+
+func TestExecutePlanFailure(t *testing.T) {
+	GCloudCommand = "/bin/false"
+	defer func() { GCloudCommand = "gcloud" }()
+
+	e := NewEnv("/tmp", []string{}, &bytes.Buffer{}, &bytes.Buffer{}, false)
+	if err := ExecutePlan(&GCloudBackend{env: e}, &Config{}, []string{"run", "jobs", "execute", "my-job", "--wait"}); err == nil {
+		t.Errorf("expected failed execution to return an error")
+	}
+}
+
+type fakeResponse struct {
+	match  string
+	output string
+	exit   int
+}
+
+// fakeGCloud replaces GCloudCommand with a script that logs its arguments and answers
+// with the output and exit code of the first response whose match is part of the arguments
+func fakeGCloud(t *testing.T, responses ...fakeResponse) (logFile string) {
+	dir := t.TempDir()
+	logFile = filepath.Join(dir, "calls.log")
+
+	script := "#!/bin/sh\necho \"$@\" >> " + logFile + "\ncase \"$*\" in\n"
+	for i, r := range responses {
+		outFile := filepath.Join(dir, fmt.Sprintf("out-%d", i))
+		if err := ioutil.WriteFile(outFile, []byte(r.output), 0600); err != nil {
+			t.Fatalf("WriteFile() err: %s", err)
+		}
+		script += fmt.Sprintf("  *%q*) cat %s; exit %d ;;\n", r.match, outFile, r.exit)
+	}
+	script += "esac\n"
+
+	cmd := filepath.Join(dir, "gcloud")
+	if err := ioutil.WriteFile(cmd, []byte(script), 0700); err != nil {
+		t.Fatalf("WriteFile() err: %s", err)
+	}
+
+	orig := GCloudCommand
+	GCloudCommand = cmd
+	t.Cleanup(func() { GCloudCommand = orig })
+	return logFile
+}
+
+func readCalls(t *testing.T, logFile string) []string {
+	b, err := ioutil.ReadFile(logFile)
+	if err != nil {
+		t.Fatalf("ReadFile() err: %s", err)
+	}
+	return strings.Split(strings.TrimSpace(string(b)), "\n")
+}
+
+func TestParseSettingsMap(t *testing.T) {
+	for _, tst := range []struct {
+		value       string
+		expected    map[string]string
+		expectedErr string
+	}{
+		{value: "", expected: nil},
+		{value: "  \n", expected: nil},
+		{value: `{}`, expected: map[string]string{}},
+		{value: `{"PORT":8080,"DEBUG":false,"NAME":"api","NONE":null,"EXP":1e3}`, expected: map[string]string{"PORT": "8080", "DEBUG": "false", "NAME": "api", "NONE": "", "EXP": "1e3"}},
+		{value: `{"A":"1","LIST":[1,2]}`, expectedErr: "failed to parse environment: [invalid value of LIST, expected a string, number, boolean or null, got: [1,2]]"},
+		{value: `["A=1"]`, expectedErr: "failed to parse environment: [json: cannot unmarshal array"},
+	} {
+		m, err := parseSettingsMap("environment", tst.value)
+		if tst.expectedErr != "" {
+			if err == nil || !strings.HasPrefix(err.Error(), tst.expectedErr) {
+				t.Errorf("expected err: %s, got: %v", tst.expectedErr, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseSettingsMap(%s) err: %s", tst.value, err)
+		}
+		if fmt.Sprint(m) != fmt.Sprint(tst.expected) || (m == nil) != (tst.expected == nil) {
+			t.Errorf("expected: %#v, got: %#v", tst.expected, m)
+		}
+	}
+}
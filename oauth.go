@@ -0,0 +1,437 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	CloudPlatformScope = "https://www.googleapis.com/auth/cloud-platform"
+
+	jwtBearerGrantType     = "urn:ietf:params:oauth:grant-type:jwt-bearer"
+	tokenExchangeGrantType = "urn:ietf:params:oauth:grant-type:token-exchange"
+	accessTokenType        = "urn:ietf:params:oauth:token-type:access_token"
+)
+
+// using a var instead of const so tests can override this
+var (
+	apiClient              = &http.Client{Timeout: 60 * time.Second}
+	IAMCredentialsEndpoint = "https://iamcredentials.googleapis.com"
+)
+
+// TokenSource provides OAuth access tokens and OIDC identity tokens of the deploying identity
+type TokenSource interface {
+	AccessToken() (string, error)
+	IdentityToken(audience string) (string, error)
+}
+
+// NewTokenSource returns a TokenSource for the credentials JSON passed as "token"
+func NewTokenSource(credentials string) (TokenSource, error) {
+	data := struct {
+		Type string `json:"type"`
+	}{}
+	if err := json.Unmarshal([]byte(credentials), &data); err != nil {
+		return nil, fmt.Errorf("failed to parse credentials: %s", err)
+	}
+
+	switch data.Type {
+	case "service_account":
+		return newServiceAccountTokenSource(credentials)
+	case "external_account":
+		return newExternalAccountTokenSource(credentials)
+	}
+	return nil, fmt.Errorf("unsupported credentials type: [%s]", data.Type)
+}
+
+type tokenResponse struct {
+	AccessToken      string `json:"access_token"`
+	ExpiresIn        int    `json:"expires_in"`
+	IDToken          string `json:"id_token"`
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
+
+// postTokenRequest posts the form to an OAuth token endpoint and decodes the response
+func postTokenRequest(endpoint string, form url.Values) (*tokenResponse, error) {
+	resp, err := apiClient.PostForm(endpoint, form)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	tr := &tokenResponse{}
+	if err := json.Unmarshal(body, tr); err != nil {
+		return nil, fmt.Errorf("failed to parse token response, status: %d", resp.StatusCode)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("token request failed, status: %d, error: %s %s", resp.StatusCode, tr.Error, tr.ErrorDescription)
+	}
+	return tr, nil
+}
+
+// postJSON posts in as JSON with the bearer token to endpoint and decodes the response into out
+func postJSON(endpoint, token string, in, out interface{}) error {
+	body, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", bearer(token))
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := apiClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("request to %s failed, status: %d, body: %s", endpoint, resp.StatusCode, respBody)
+	}
+	return json.Unmarshal(respBody, out)
+}
+
+// cachedToken is an access token that is reused until shortly before it expires
+type cachedToken struct {
+	mu     sync.Mutex
+	token  string
+	expiry time.Time
+}
+
+func (c *cachedToken) get(fetch func() (string, time.Duration, error)) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.token != "" && time.Now().Before(c.expiry) {
+		return c.token, nil
+	}
+
+	token, ttl, err := fetch()
+	if err != nil {
+		return "", err
+	}
+	c.token = token
+	c.expiry = time.Now().Add(ttl - time.Minute)
+	return token, nil
+}
+
+type serviceAccountTokenSource struct {
+	email    string
+	keyID    string
+	tokenURI string
+	key      *rsa.PrivateKey
+
+	access cachedToken
+}
+
+func newServiceAccountTokenSource(credentials string) (*serviceAccountTokenSource, error) {
+	data := struct {
+		ClientEmail  string `json:"client_email"`
+		PrivateKeyID string `json:"private_key_id"`
+		PrivateKey   string `json:"private_key"`
+		TokenURI     string `json:"token_uri"`
+	}{}
+	if err := json.Unmarshal([]byte(credentials), &data); err != nil {
+		return nil, fmt.Errorf("failed to parse service account key: %s", err)
+	}
+	if data.ClientEmail == "" || data.TokenURI == "" {
+		return nil, fmt.Errorf("service account key is missing client_email or token_uri")
+	}
+
+	key, err := parsePrivateKey(data.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return &serviceAccountTokenSource{
+		email:    data.ClientEmail,
+		keyID:    data.PrivateKeyID,
+		tokenURI: data.TokenURI,
+		key:      key,
+	}, nil
+}
+
+func parsePrivateKey(keyPEM string) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode([]byte(keyPEM))
+	if block == nil {
+		return nil, fmt.Errorf("service account key doesn't contain a PEM encoded private key")
+	}
+
+	if key, err := x509.ParsePKCS8PrivateKey(block.Bytes); err == nil {
+		if rsaKey, ok := key.(*rsa.PrivateKey); ok {
+			return rsaKey, nil
+		}
+		return nil, fmt.Errorf("service account private key isn't an RSA key")
+	}
+	return x509.ParsePKCS1PrivateKey(block.Bytes)
+}
+
+// signedJWT returns a RS256 signed JWT with the given claims, see
+// https://developers.google.com/identity/protocols/oauth2/service-account#authorizingrequests
+func (s *serviceAccountTokenSource) signedJWT(claims map[string]interface{}) (string, error) {
+	now := time.Now()
+	claims["iss"] = s.email
+	claims["aud"] = s.tokenURI
+	claims["iat"] = now.Unix()
+	claims["exp"] = now.Add(time.Hour).Unix()
+
+	header, err := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT", "kid": s.keyID})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	enc := base64.RawURLEncoding
+	unsigned := enc.EncodeToString(header) + "." + enc.EncodeToString(payload)
+	hash := sha256.Sum256([]byte(unsigned))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, s.key, crypto.SHA256, hash[:])
+	if err != nil {
+		return "", err
+	}
+	return unsigned + "." + enc.EncodeToString(sig), nil
+}
+
+func (s *serviceAccountTokenSource) exchange(claims map[string]interface{}) (*tokenResponse, error) {
+	assertion, err := s.signedJWT(claims)
+	if err != nil {
+		return nil, err
+	}
+	return postTokenRequest(s.tokenURI, url.Values{"grant_type": {jwtBearerGrantType}, "assertion": {assertion}})
+}
+
+func (s *serviceAccountTokenSource) AccessToken() (string, error) {
+	return s.access.get(func() (string, time.Duration, error) {
+		tr, err := s.exchange(map[string]interface{}{"scope": CloudPlatformScope})
+		if err != nil {
+			return "", 0, err
+		}
+		return tr.AccessToken, time.Duration(tr.ExpiresIn) * time.Second, nil
+	})
+}
+
+func (s *serviceAccountTokenSource) IdentityToken(audience string) (string, error) {
+	tr, err := s.exchange(map[string]interface{}{"target_audience": audience})
+	if err != nil {
+		return "", err
+	}
+	if tr.IDToken == "" {
+		return "", fmt.Errorf("token response didn't contain an identity token")
+	}
+	return tr.IDToken, nil
+}
+
+// externalAccountTokenSource exchanges an OIDC token for Google access tokens via workload
+// identity federation, see https://google.aip.dev/auth/4117
+type externalAccountTokenSource struct {
+	cfg externalAccountConfig
+
+	access cachedToken
+}
+
+func newExternalAccountTokenSource(credentials string) (*externalAccountTokenSource, error) {
+	if err := validateCredentialConfig(credentials); err != nil {
+		return nil, err
+	}
+	s := &externalAccountTokenSource{}
+	if err := json.Unmarshal([]byte(credentials), &s.cfg); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// subjectToken reads the OIDC token from the file or URL in the credential_source
+func (s *externalAccountTokenSource) subjectToken() (string, error) {
+	src := s.cfg.CredentialSource
+
+	var raw []byte
+	var err error
+	switch {
+	case src.File != "":
+		raw, err = ioutil.ReadFile(src.File)
+
+	case src.URL != "":
+		var req *http.Request
+		if req, err = http.NewRequest(http.MethodGet, src.URL, nil); err != nil {
+			break
+		}
+		for k, v := range src.Headers {
+			req.Header.Set(k, v)
+		}
+		var resp *http.Response
+		if resp, err = apiClient.Do(req); err != nil {
+			break
+		}
+		defer resp.Body.Close()
+		raw, err = ioutil.ReadAll(resp.Body)
+
+	default:
+		return "", fmt.Errorf("credential_source needs a file or url")
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to read subject token: %s", err)
+	}
+
+	if src.Format.Type == "json" {
+		data := map[string]interface{}{}
+		if err := json.Unmarshal(raw, &data); err != nil {
+			return "", fmt.Errorf("failed to parse subject token: %s", err)
+		}
+		token, _ := data[src.Format.SubjectTokenFieldName].(string)
+		return token, nil
+	}
+	return strings.TrimSpace(string(raw)), nil
+}
+
+// federatedToken exchanges the subject token at the security token service
+func (s *externalAccountTokenSource) federatedToken() (string, time.Duration, error) {
+	subject, err := s.subjectToken()
+	if err != nil {
+		return "", 0, err
+	}
+
+	tr, err := postTokenRequest(s.cfg.TokenURL, url.Values{
+		"grant_type":           {tokenExchangeGrantType},
+		"audience":             {s.cfg.Audience},
+		"scope":                {CloudPlatformScope},
+		"requested_token_type": {accessTokenType},
+		"subject_token":        {subject},
+		"subject_token_type":   {s.cfg.SubjectTokenType},
+	})
+	if err != nil {
+		return "", 0, err
+	}
+	return tr.AccessToken, time.Duration(tr.ExpiresIn) * time.Second, nil
+}
+
+func (s *externalAccountTokenSource) AccessToken() (string, error) {
+	return s.access.get(func() (string, time.Duration, error) {
+		token, ttl, err := s.federatedToken()
+		if err != nil || s.cfg.ServiceAccountImpersonationURL == "" {
+			return token, ttl, err
+		}
+
+		resp := struct {
+			AccessToken string    `json:"accessToken"`
+			ExpireTime  time.Time `json:"expireTime"`
+		}{}
+		err = postJSON(s.cfg.ServiceAccountImpersonationURL, token, map[string]interface{}{
+			"scope":    []string{CloudPlatformScope},
+			"lifetime": "3600s",
+		}, &resp)
+		return resp.AccessToken, time.Until(resp.ExpireTime), err
+	})
+}
+
+// IdentityToken needs a service account to impersonate, federated identities can't get identity tokens themselves
+func (s *externalAccountTokenSource) IdentityToken(audience string) (string, error) {
+	if s.cfg.ServiceAccountImpersonationURL == "" {
+		return "", fmt.Errorf("identity tokens need service_account_impersonation_url in the credential_config")
+	}
+
+	token, _, err := s.federatedToken()
+	if err != nil {
+		return "", err
+	}
+
+	resp := struct {
+		Token string `json:"token"`
+	}{}
+	endpoint := strings.Replace(s.cfg.ServiceAccountImpersonationURL, ":generateAccessToken", ":generateIdToken", 1)
+	if err := postJSON(endpoint, token, map[string]interface{}{"audience": audience, "includeEmail": true}, &resp); err != nil {
+		return "", err
+	}
+	return resp.Token, nil
+}
+
+// impersonatedTokenSource acts as the last service account of a delegation chain via the IAM
+// credentials API, the source identity needs roles/iam.serviceAccountTokenCreator on the first one
+// and every delegate on the next one
+type impersonatedTokenSource struct {
+	source    TokenSource
+	target    string
+	delegates []string
+
+	access cachedToken
+}
+
+func newImpersonatedTokenSource(source TokenSource, chain []string) *impersonatedTokenSource {
+	s := &impersonatedTokenSource{source: source, target: chain[len(chain)-1]}
+	for _, sa := range chain[:len(chain)-1] {
+		s.delegates = append(s.delegates, "projects/-/serviceAccounts/"+sa)
+	}
+	return s
+}
+
+// generate calls the IAM credentials API method for the target service account
+func (s *impersonatedTokenSource) generate(method string, body map[string]interface{}, out interface{}) error {
+	token, err := s.source.AccessToken()
+	if err != nil {
+		return err
+	}
+	if len(s.delegates) > 0 {
+		body["delegates"] = s.delegates
+	}
+	endpoint := fmt.Sprintf("%s/v1/projects/-/serviceAccounts/%s:%s", IAMCredentialsEndpoint, s.target, method)
+	if err := postJSON(endpoint, token, body, out); err != nil {
+		return fmt.Errorf("impersonating %s failed: %s", s.target, err)
+	}
+	return nil
+}
+
+func (s *impersonatedTokenSource) AccessToken() (string, error) {
+	return s.access.get(func() (string, time.Duration, error) {
+		resp := struct {
+			AccessToken string    `json:"accessToken"`
+			ExpireTime  time.Time `json:"expireTime"`
+		}{}
+		err := s.generate("generateAccessToken", map[string]interface{}{
+			"scope":    []string{CloudPlatformScope},
+			"lifetime": "3600s",
+		}, &resp)
+		return resp.AccessToken, time.Until(resp.ExpireTime), err
+	})
+}
+
+func (s *impersonatedTokenSource) IdentityToken(audience string) (string, error) {
+	resp := struct {
+		Token string `json:"token"`
+	}{}
+	if err := s.generate("generateIdToken", map[string]interface{}{"audience": audience, "includeEmail": true}, &resp); err != nil {
+		return "", err
+	}
+	return resp.Token, nil
+}
+
+// bearer returns the Authorization header value for the token
+func bearer(token string) string {
+	return "Bearer " + strings.TrimSpace(token)
+}
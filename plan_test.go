@@ -0,0 +1,114 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// run "go test -run TestPlanGolden -update" to rewrite the golden files after an intended change
+var updateGolden = flag.Bool("update", false, "update the golden files in testdata/plans")
+
+func TestPlanGolden(t *testing.T) {
+	base := Config{Project: "my-project", Runtime: "managed", Region: "us-central1", ServiceName: "my-service", ImageName: "my-image:v1"}
+
+	for _, tst := range []struct {
+		name string
+		cfg  func(cfg *Config)
+	}{
+		{name: "deploy", cfg: func(cfg *Config) { cfg.Action = "deploy" }},
+		{name: "deploy-all-settings", cfg: func(cfg *Config) {
+			cfg.Action = "deploy"
+			cfg.Variant = "beta"
+			cfg.SvcAccount = "runtime@my-project.iam.gserviceaccount.com"
+			cfg.AllowUnauthenticated = true
+			cfg.Concurrency = "80"
+			cfg.Memory = "512Mi"
+			cfg.Timeout = "10m"
+			cfg.Tag = "blue"
+			cfg.NoTraffic = true
+			cfg.Fingerprint = "0123456789abcdef0123456789abcdef"
+			cfg.Environment = map[string]string{"LOG_LEVEL": "debug", "APP_ENV": "prod", "VERSION": "1.2.3", "EMPTY": ""}
+			cfg.EnvSecrets = []string{"PASSWORD=hunter2", "API_TOKEN=abc"}
+			cfg.Secrets = map[string]string{"DB_PASSWORD": "db-password:3", "/etc/tls/cert.pem": "tls-cert", "API_KEY": "api-key:latest"}
+			cfg.AdditionalFlags = map[string]string{"max-instances": "10", "cpu": "2", "set-cloudsql-instances": "my-project:us-central1:db", "cpu-boost": ""}
+		}},
+		{name: "deploy-merge-env", cfg: func(cfg *Config) {
+			cfg.Action = "deploy"
+			cfg.EnvMode = EnvModeMerge
+			cfg.Environment = map[string]string{"B": "2", "A": "1"}
+			cfg.Secrets = map[string]string{"API_KEY": "api-key:2"}
+			cfg.RemoveEnv = []string{"LEGACY", "OLD"}
+			cfg.RemoveSecrets = []string{"/etc/old.pem"}
+		}},
+		{name: "deploy-labels", cfg: func(cfg *Config) {
+			cfg.Action = "deploy"
+			cfg.Fingerprint = "0123456789abcdef0123456789abcdef"
+			cfg.BuildLabels = map[string]string{LabelCommit: "d0c13cb8646875cf94387f0d3de4e92b85eee3b0", LabelBuild: "42", LabelRepo: "octocat-hello-world", LabelBranch: "main"}
+			cfg.Labels = map[string]string{"team": "payments", LabelBranch: "release"}
+			cfg.RevisionSuffix = "d0c13cb-42"
+		}},
+		{name: "deploy-job", cfg: func(cfg *Config) {
+			cfg.Action = "deploy-job"
+			cfg.JobName = "my-job"
+			cfg.Tasks, cfg.Parallelism, cfg.MaxRetries, cfg.TaskTimeout = "10", "2", "3", "1h"
+			cfg.Environment = map[string]string{"B": "2", "A": "1"}
+			cfg.Secrets = map[string]string{"Z": "z", "Y": "y"}
+		}},
+		{name: "execute-job", cfg: func(cfg *Config) { cfg.Action, cfg.JobName = "execute-job", "my-job" }},
+		{name: "update-traffic", cfg: func(cfg *Config) {
+			cfg.Action = "update-traffic"
+			cfg.AdditionalFlags = map[string]string{"to-tags": "blue=10", "remove-tags": "green", "to-latest": ""}
+		}},
+		{name: "rollback", cfg: func(cfg *Config) { cfg.Action, cfg.Revision = "rollback", "my-service-00001-abc" }},
+		{name: "delete", cfg: func(cfg *Config) { cfg.Action, cfg.DeleteAllowlist = "delete", []string{"my-*"} }},
+		{name: "canary", cfg: func(cfg *Config) {
+			cfg.Action = "canary"
+			cfg.Environment = map[string]string{"C": "3", "B": "2", "A": "1"}
+		}},
+		{name: "preview-service", cfg: func(cfg *Config) {
+			cfg.Action, cfg.PreviewType, cfg.PullRequest = "preview", PreviewTypeService, "12"
+		}},
+		{name: "preview-tag", cfg: func(cfg *Config) {
+			cfg.Action, cfg.PreviewType, cfg.SourceBranch = "preview", PreviewTypeTag, "Feature/Login"
+		}},
+		{name: "preview-cleanup-tag", cfg: func(cfg *Config) {
+			cfg.Action, cfg.PreviewType, cfg.PullRequest = "preview-cleanup", PreviewTypeTag, "12"
+		}},
+		{name: "replace", cfg: func(cfg *Config) { cfg.Action, cfg.ReplaceFile = "replace", "my-service.yaml" }},
+	} {
+		t.Run(tst.name, func(t *testing.T) {
+			cfg := base
+			tst.cfg(&cfg)
+
+			plan, err := CreateExecutionPlan(&cfg)
+			if err != nil {
+				t.Fatalf("CreateExecutionPlan() err: %s", err)
+			}
+			got := strings.Join(plan, "\n") + "\n"
+
+			// maps are iterated in random order, the same config has to give the same plan every time
+			for i := 0; i < 20; i++ {
+				if again, _ := CreateExecutionPlan(&cfg); strings.Join(again, "\n")+"\n" != got {
+					t.Fatalf("plan isn't deterministic, got:\n%s\nand:\n%s", got, strings.Join(again, "\n"))
+				}
+			}
+
+			golden := filepath.Join("testdata", "plans", tst.name+".golden")
+			if *updateGolden {
+				if err := ioutil.WriteFile(golden, []byte(got), 0644); err != nil {
+					t.Fatalf("WriteFile() err: %s", err)
+				}
+			}
+			expected, err := ioutil.ReadFile(golden)
+			if err != nil {
+				t.Fatalf("ReadFile() err: %s, run with -update to create it", err)
+			}
+			if got != string(expected) {
+				t.Errorf("plan doesn't match %s, run with -update if the change is intended\nexpected:\n%s\ngot:\n%s", golden, expected, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+const (
+	PreviewTypeService = "service"
+	PreviewTypeTag     = "tag"
+
+	DefaultURLFile = ".preview-url"
+
+	// Cloud Run service names are limited to 49 characters
+	maxServiceNameLength = 49
+
+	// tagged revisions are served from "<tag>---<service>-<hash>-<region>.a.run.app" and
+	// the first DNS label of that host must fit into 63 characters
+	maxTagURLLabelLength = 46
+)
+
+var nonDNSChars = regexp.MustCompile(`[^a-z0-9-]+`)
+
+// slugify lower-cases s, replaces everything that isn't valid in a DNS label with dashes and
+// truncates the result to max characters. The result always starts with a letter.
+func slugify(s string, max int) string {
+	s = nonDNSChars.ReplaceAllString(strings.ToLower(s), "-")
+	for strings.Contains(s, "--") {
+		s = strings.Replace(s, "--", "-", -1)
+	}
+	s = strings.Trim(s, "-")
+	if s != "" && (s[0] < 'a' || s[0] > 'z') {
+		s = "x-" + s
+	}
+	if len(s) > max {
+		s = s[:max]
+	}
+	return strings.TrimRight(s, "-")
+}
+
+// previewName derives the name of the preview environment from the Drone metadata,
+// the pull request number takes precedence over the source branch
+func previewName(cfg *Config) (string, error) {
+	switch {
+	case cfg.PullRequest != "":
+		return slugify("pr-"+cfg.PullRequest, maxServiceNameLength), nil
+	case cfg.SourceBranch != "":
+		return slugify(cfg.SourceBranch, maxServiceNameLength), nil
+	}
+	return "", fmt.Errorf("preview needs DRONE_PULL_REQUEST or DRONE_SOURCE_BRANCH to be set")
+}
+
+// previewConfig returns a copy of cfg rewritten into the deploy/delete/update-traffic
+// config that creates or removes the preview environment
+func previewConfig(cfg *Config) (*Config, error) {
+	name, err := previewName(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	pcfg := *cfg
+	switch cfg.PreviewType {
+	case PreviewTypeTag:
+		max := maxTagURLLabelLength - len(cfg.ServiceName)
+		if max < len("pr-1") {
+			return nil, fmt.Errorf("service name %s is too long to add a preview tag", cfg.ServiceName)
+		}
+		pcfg.Tag = slugify(name, max)
+		if cfg.Action == "preview" {
+			pcfg.Action = "deploy"
+			pcfg.NoTraffic = true
+		} else {
+			pcfg.Action = "update-traffic"
+			pcfg.AdditionalFlags = map[string]string{"remove-tags": pcfg.Tag}
+		}
+
+	default:
+		// keep the preview suffix intact and shorten the service part of the name instead
+		base := cfg.ServiceName
+		if max := maxServiceNameLength - len(name) - 1; len(base) > max {
+			base = base[:max]
+		}
+		pcfg.ServiceName = slugify(base+"-"+name, maxServiceNameLength)
+		if cfg.Action == "preview" {
+			pcfg.Action = "deploy"
+		} else {
+			// a pull request preview always ends in "-pr-<number>" and can be deleted without an
+			// allowlist, a preview named after the source branch has to match delete_allowlist
+			pcfg.Action = "delete"
+			if cfg.PullRequest != "" {
+				pcfg.DeleteAllowlist = []string{pcfg.ServiceName}
+			}
+			pcfg.AdditionalFlags = nil
+		}
+	}
+
+	return &pcfg, nil
+}
+
+// writePreviewURL looks up the URL of the deployed preview environment and writes it to cfg.URLFile
+func writePreviewURL(b Backend, cfg *Config) error {
+	pcfg, err := previewConfig(cfg)
+	if err != nil {
+		return err
+	}
+
+	svc, err := b.DescribeService(pcfg, pcfg.ServiceName)
+	if err != nil {
+		return err
+	}
+
+	url := svc.Status.URL
+	if pcfg.Tag != "" {
+		url = svc.TagURL(pcfg.Tag)
+	}
+	if url == "" {
+		return fmt.Errorf("couldn't find the URL of preview %s", pcfg.ServiceName)
+	}
+	b.Logf("Preview URL: %s", url)
+
+	fileName := cfg.URLFile
+	if !filepath.IsAbs(fileName) {
+		fileName = filepath.Join(cfg.Dir, fileName)
+	}
+	if err := ioutil.WriteFile(fileName, []byte(url), 0644); err != nil {
+		return fmt.Errorf("error writing preview url file: %s", err)
+	}
+	return nil
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSlugify(t *testing.T) {
+	for _, tst := range []struct {
+		in       string
+		max      int
+		expected string
+	}{
+		{in: "feature/My_New--Thing", max: 63, expected: "feature-my-new-thing"},
+		{in: "123-fix", max: 63, expected: "x-123-fix"},
+		{in: "--weird..branch--", max: 63, expected: "weird-branch"},
+		{in: "a-very-long-branch-name", max: 7, expected: "a-very"},
+		{in: "ÜNICODE-branch", max: 63, expected: "nicode-branch"},
+	} {
+		if got := slugify(tst.in, tst.max); got != tst.expected {
+			t.Errorf("slugify(%s, %d) expected: %s   got: %s", tst.in, tst.max, tst.expected, got)
+		}
+	}
+}
+
+func TestPreviewPlans(t *testing.T) {
+	for _, tst := range []struct {
+		cfg           Config
+		expectedOk    bool
+		expectedFlags []string
+		expectedName  string
+	}{
+		{
+			cfg:           Config{Action: "preview", PreviewType: PreviewTypeService, ServiceName: "my-service", ImageName: "my-image", PullRequest: "42"},
+			expectedOk:    true,
+			expectedName:  "my-service-pr-42",
+			expectedFlags: []string{"deploy", "--image"},
+		},
+		{
+			cfg:           Config{Action: "preview", PreviewType: PreviewTypeService, ServiceName: "my-service", ImageName: "my-image", SourceBranch: "feature/Login-Page"},
+			expectedOk:    true,
+			expectedName:  "my-service-feature-login-page",
+			expectedFlags: []string{"deploy"},
+		},
+		{
+			cfg:          Config{Action: "preview", PreviewType: PreviewTypeService, ServiceName: strings.Repeat("s", 60), ImageName: "my-image", PullRequest: "42"},
+			expectedOk:   true,
+			expectedName: strings.Repeat("s", 43) + "-pr-42",
+		},
+		{
+			cfg:           Config{Action: "preview", PreviewType: PreviewTypeTag, ServiceName: "my-service", ImageName: "my-image", PullRequest: "42"},
+			expectedOk:    true,
+			expectedName:  "my-service",
+			expectedFlags: []string{"deploy", "--tag", "pr-42", "--no-traffic"},
+		},
+		{
+			cfg:           Config{Action: "preview-cleanup", PreviewType: PreviewTypeService, ServiceName: "my-service", PullRequest: "42", AdditionalFlags: map[string]string{"no-traffic": ""}},
+			expectedOk:    true,
+			expectedName:  "my-service-pr-42",
+			expectedFlags: []string{"services", "delete"},
+		},
+		{
+			cfg:        Config{Action: "preview-cleanup", PreviewType: PreviewTypeService, ServiceName: "my-api", SourceBranch: "prod"},
+			expectedOk: false,
+		},
+		{
+			cfg:           Config{Action: "preview-cleanup", PreviewType: PreviewTypeService, ServiceName: "my-api", SourceBranch: "feature/login", DeleteAllowlist: []string{"my-api-feature-*"}},
+			expectedOk:    true,
+			expectedName:  "my-api-feature-login",
+			expectedFlags: []string{"services", "delete"},
+		},
+		{
+			cfg:           Config{Action: "preview-cleanup", PreviewType: PreviewTypeTag, ServiceName: "my-service", PullRequest: "42"},
+			expectedOk:    true,
+			expectedName:  "my-service",
+			expectedFlags: []string{"services", "update-traffic", "--remove-tags=pr-42"},
+		},
+		{
+			cfg:        Config{Action: "preview", PreviewType: PreviewTypeService, ServiceName: "my-service", ImageName: "my-image"},
+			expectedOk: false,
+		},
+		{
+			cfg:        Config{Action: "preview", PreviewType: PreviewTypeTag, ServiceName: strings.Repeat("s", 45), ImageName: "my-image", PullRequest: "42"},
+			expectedOk: false,
+		},
+	} {
+		plan, err := CreateExecutionPlan(&tst.cfg)
+		if err != nil {
+			if tst.expectedOk {
+				t.Errorf("CreateExecutionPlan(%#v) err: %s", tst.cfg, err)
+			}
+			continue
+		}
+		if !tst.expectedOk {
+			t.Errorf("CreateExecutionPlan(%#v) should have failed, got: %v", tst.cfg, plan)
+			continue
+		}
+
+		found := false
+		for _, p := range plan {
+			if p == tst.expectedName {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("expected service name %s in plan: %v", tst.expectedName, plan)
+		}
+
+		planStr := strings.Join(plan, " ")
+		for _, flg := range tst.expectedFlags {
+			if !strings.Contains(planStr, flg) {
+				t.Errorf("couldn't find expected flag [%s] in [%v]", flg, plan)
+			}
+		}
+	}
+}
+
+func TestPreviewWritesURL(t *testing.T) {
+	for _, tst := range []struct {
+		previewType string
+		describe    string
+		expectedURL string
+	}{
+		{
+			previewType: PreviewTypeService,
+			describe:    `{"status":{"url":"https://my-service-pr-7-abc-uc.a.run.app"}}`,
+			expectedURL: "https://my-service-pr-7-abc-uc.a.run.app",
+		},
+		{
+			previewType: PreviewTypeTag,
+			describe:    `{"status":{"url":"https://my-service-abc-uc.a.run.app","traffic":[{"percent":100,"latestRevision":true},{"revisionName":"my-service-00002","tag":"pr-7","url":"https://pr-7---my-service-abc-uc.a.run.app"}]}}`,
+			expectedURL: "https://pr-7---my-service-abc-uc.a.run.app",
+		},
+	} {
+		t.Run(tst.previewType, func(t *testing.T) {
+			logFile := fakeGCloud(t, fakeResponse{match: "services describe", output: tst.describe})
+
+			dir := t.TempDir()
+			cfg := &Config{
+				Action: "preview", PreviewType: tst.previewType, Dir: dir, URLFile: DefaultURLFile,
+				ServiceName: "my-service", ImageName: "my-image", Project: "my-project", Runtime: "managed", PullRequest: "7",
+			}
+			if err := runConfig(cfg); err != nil {
+				t.Fatalf("runConfig() err: %s", err)
+			}
+
+			b, err := ioutil.ReadFile(filepath.Join(dir, DefaultURLFile))
+			if err != nil {
+				t.Fatalf("ReadFile() err: %s", err)
+			}
+			if string(b) != tst.expectedURL {
+				t.Errorf("expected url: %s   got: %s", tst.expectedURL, b)
+			}
+
+			calls := readCalls(t, logFile)
+			if last := calls[len(calls)-1]; !strings.Contains(last, "services describe") {
+				t.Errorf("expected the last call to describe the service, got: %s", last)
+			}
+		})
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"sort"
+	"strings"
+)
+
+const (
+	RedactedValue = "********"
+)
+
+// SensitiveValues returns the values that must never show up in the build log:
+// the token, the private key inside of it, the OIDC token and the values of all env_secret_* settings
+func (cfg *Config) SensitiveValues() []string {
+	values := []string{cfg.Token, cfg.OIDCToken}
+
+	key := struct {
+		PrivateKey string `json:"private_key"`
+	}{}
+	if err := json.Unmarshal([]byte(cfg.Token), &key); err == nil {
+		values = append(values, key.PrivateKey)
+	}
+
+	for _, s := range cfg.EnvSecrets {
+		if kv := strings.SplitN(s, "=", 2); len(kv) == 2 {
+			values = append(values, kv[1])
+		}
+	}
+	return values
+}
+
+// Redact registers values that are masked in everything the Env logs or passes through
+func (e *Env) Redact(values ...string) {
+	for _, v := range values {
+		if v != "" {
+			e.secrets = append(e.secrets, v)
+		}
+	}
+
+	// longest first so a secret containing another secret gets masked completely
+	sort.Slice(e.secrets, func(i, j int) bool { return len(e.secrets[i]) > len(e.secrets[j]) })
+}
+
+func (e *Env) mask(s string) string {
+	for _, secret := range e.secrets {
+		s = strings.Replace(s, secret, RedactedValue, -1)
+	}
+	return s
+}
+
+func (e *Env) maskAll(args []string) []string {
+	masked := make([]string, len(args))
+	for i, a := range args {
+		masked[i] = e.mask(a)
+	}
+	return masked
+}
+
+func (e *Env) redactWriter(w io.Writer) *redactWriter {
+	return &redactWriter{w: w, mask: e.mask}
+}
+
+// redactWriter masks secrets in everything written to it. Output is passed on line by line
+// so a secret split across two writes still gets masked.
+type redactWriter struct {
+	w    io.Writer
+	mask func(string) string
+	buf  []byte
+}
+
+func (r *redactWriter) Write(p []byte) (int, error) {
+	if r.w == nil {
+		return len(p), nil
+	}
+	r.buf = append(r.buf, p...)
+	if i := bytes.LastIndexByte(r.buf, '\n'); i >= 0 {
+		if _, err := io.WriteString(r.w, r.mask(string(r.buf[:i+1]))); err != nil {
+			return 0, err
+		}
+		r.buf = r.buf[i+1:]
+	}
+	return len(p), nil
+}
+
+// Flush writes out the last line if it didn't end with a newline
+func (r *redactWriter) Flush() error {
+	if r.w == nil || len(r.buf) == 0 {
+		return nil
+	}
+	_, err := io.WriteString(r.w, r.mask(string(r.buf)))
+	r.buf = nil
+	return err
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	RegionFailFast   = "fail-fast"
+	RegionBestEffort = "best-effort"
+)
+
+// outputMu keeps the lines of regions deploying in parallel from interleaving
+var outputMu sync.Mutex
+
+func parseRegionConfig(cfg *Config) error {
+	seen := map[string]bool{}
+	for _, r := range strings.Split(cfg.Region, ",") {
+		if r = strings.TrimSpace(r); r == "" {
+			continue
+		}
+		if seen[r] {
+			return fmt.Errorf("duplicate region: [%s]", r)
+		}
+		seen[r] = true
+		cfg.Regions = append(cfg.Regions, r)
+	}
+
+	if len(cfg.Regions) < 2 {
+		cfg.Region = strings.Join(cfg.Regions, "")
+		return nil
+	}
+	// every region gets its own config, see regionConfig()
+	cfg.Region = ""
+
+	if cfg.Action == "preview" || cfg.Action == "preview-cleanup" {
+		return fmt.Errorf("%s only supports a single region", cfg.Action)
+	}
+
+	if p := os.Getenv("PLUGIN_REGION_PARALLELISM"); p != "" {
+		n, err := strconv.Atoi(p)
+		if err != nil || n < 0 {
+			return fmt.Errorf("invalid region_parallelism: [%s], expected a non-negative integer", p)
+		}
+		cfg.RegionParallelism = n
+	}
+
+	cfg.RegionFailurePolicy = os.Getenv("PLUGIN_REGION_FAILURE_POLICY")
+	if cfg.RegionFailurePolicy == "" {
+		cfg.RegionFailurePolicy = RegionFailFast
+	}
+	if cfg.RegionFailurePolicy != RegionFailFast && cfg.RegionFailurePolicy != RegionBestEffort {
+		return fmt.Errorf("invalid region_failure_policy: [%s], expected %s or %s", cfg.RegionFailurePolicy, RegionFailFast, RegionBestEffort)
+	}
+	return nil
+}
+
+// regionConfig returns a copy of cfg for one of its regions
+func regionConfig(cfg *Config, region string) *Config {
+	rcfg := *cfg
+	rcfg.Region = region
+	rcfg.Regions = []string{region}
+	return &rcfg
+}
+
+// regionConfigs returns the configs for all regions of cfg, or cfg itself if there's just one
+func regionConfigs(cfg *Config) []*Config {
+	if len(cfg.Regions) < 2 {
+		return []*Config{cfg}
+	}
+	var configs []*Config
+	for _, region := range cfg.Regions {
+		configs = append(configs, regionConfig(cfg, region))
+	}
+	return configs
+}
+
+// runResult is the outcome of running the action for one region or service
+type runResult struct {
+	name    string
+	err     error
+	started bool
+}
+
+// runRegions runs the action in every region, at most region_parallelism at a time. Each region
+// gets its own Env so its output can be told apart. With the fail-fast policy no more regions are
+// started once one failed, regions that are already running finish either way.
+func runRegions(cfg *Config, creds *Credentials) error {
+	parallelism := cfg.RegionParallelism
+	if parallelism <= 0 || parallelism > len(cfg.Regions) {
+		parallelism = len(cfg.Regions)
+	}
+	log.Printf("Running %s in %d regions, %d at a time: %s", cfg.Action, len(cfg.Regions), parallelism, strings.Join(cfg.Regions, ", "))
+
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		failed  bool
+		slots   = make(chan struct{}, parallelism)
+		results = make([]runResult, len(cfg.Regions))
+	)
+	for i, region := range cfg.Regions {
+		results[i].name = region
+
+		slots <- struct{}{}
+		mu.Lock()
+		stop := failed && cfg.RegionFailurePolicy == RegionFailFast
+		mu.Unlock()
+		if stop {
+			<-slots
+			continue
+		}
+
+		results[i].started = true
+		wg.Add(1)
+		go func(res *runResult) {
+			defer wg.Done()
+			defer func() { <-slots }()
+
+			if res.err = runInRegion(cfg, creds, res.name); res.err != nil {
+				mu.Lock()
+				failed = true
+				mu.Unlock()
+			}
+		}(&results[i])
+	}
+	wg.Wait()
+
+	return summary("regions", results)
+}
+
+// runInRegion runs the action in one region with an Env that prefixes all output with the region
+func runInRegion(cfg *Config, creds *Credentials, region string) error {
+	prefix := "[" + region + "] "
+	stdout, stderr := &prefixWriter{w: os.Stdout, prefix: prefix}, &prefixWriter{w: os.Stderr, prefix: prefix}
+	defer stdout.Flush()
+	defer stderr.Flush()
+
+	e := NewEnv(cfg.Dir, append(os.Environ(), creds.Env()...), stdout, stderr, false)
+	e.Redact(cfg.SensitiveValues()...)
+	e.logPrefix = prefix
+
+	rcfg := regionConfig(cfg, region)
+	b, err := NewBackend(rcfg, e, creds)
+	if err != nil {
+		return err
+	}
+	return runAction(b, rcfg, creds)
+}
+
+// summary logs how every region or service went and returns an error naming the ones that failed
+func summary(kind string, results []runResult) error {
+	var failed []string
+	log.Printf("Summary of %d %s:", len(results), kind)
+	for _, res := range results {
+		switch {
+		case !res.started:
+			log.Printf("  %s: skipped", res.name)
+			failed = append(failed, res.name)
+		case res.err != nil:
+			log.Printf("  %s: failed: %s", res.name, strings.TrimSpace(res.err.Error()))
+			failed = append(failed, res.name)
+		default:
+			log.Printf("  %s: succeeded", res.name)
+		}
+	}
+
+	if len(failed) > 0 {
+		return fmt.Errorf("%d of %d %s didn't succeed: [%s]", len(failed), len(results), kind, strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// prefixWriter prefixes every line written to it, whole lines are written at once so
+// the output of regions running in parallel doesn't interleave mid-line
+type prefixWriter struct {
+	w      io.Writer
+	prefix string
+	buf    []byte
+}
+
+func (p *prefixWriter) Write(b []byte) (int, error) {
+	p.buf = append(p.buf, b...)
+	i := bytes.LastIndexByte(p.buf, '\n')
+	if i < 0 {
+		return len(b), nil
+	}
+
+	lines := strings.SplitAfter(string(p.buf[:i+1]), "\n")
+	p.buf = p.buf[i+1:]
+	out := &strings.Builder{}
+	for _, l := range lines {
+		if l != "" {
+			out.WriteString(p.prefix + l)
+		}
+	}
+	return len(b), p.write(out.String())
+}
+
+// Flush writes out the last line if it didn't end with a newline
+func (p *prefixWriter) Flush() error {
+	if len(p.buf) == 0 {
+		return nil
+	}
+	line := p.prefix + string(p.buf) + "\n"
+	p.buf = nil
+	return p.write(line)
+}
+
+func (p *prefixWriter) write(s string) error {
+	outputMu.Lock()
+	defer outputMu.Unlock()
+	_, err := io.WriteString(p.w, s)
+	return err
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestParseRegionConfig(t *testing.T) {
+	for _, tst := range []struct {
+		env             map[string]string
+		expectedOk      bool
+		expectedRegion  string
+		expectedRegions []string
+		expectedPolicy  string
+	}{
+		{
+			env:             map[string]string{"PLUGIN_REGION": "us-central1"},
+			expectedOk:      true,
+			expectedRegion:  "us-central1",
+			expectedRegions: []string{"us-central1"},
+		},
+		{
+			env:             map[string]string{"PLUGIN_REGION": "us-central1, europe-west1,asia-northeast1"},
+			expectedOk:      true,
+			expectedRegions: []string{"us-central1", "europe-west1", "asia-northeast1"},
+			expectedPolicy:  RegionFailFast,
+		},
+		{
+			env:             map[string]string{"PLUGIN_REGION": "us-central1,europe-west1", "PLUGIN_REGION_FAILURE_POLICY": "best-effort", "PLUGIN_REGION_PARALLELISM": "1"},
+			expectedOk:      true,
+			expectedRegions: []string{"us-central1", "europe-west1"},
+			expectedPolicy:  RegionBestEffort,
+		},
+		{env: map[string]string{"PLUGIN_REGION": "us-central1,us-central1"}},
+		{env: map[string]string{"PLUGIN_REGION": "us-central1,europe-west1", "PLUGIN_REGION_FAILURE_POLICY": "yolo"}},
+		{env: map[string]string{"PLUGIN_REGION": "us-central1,europe-west1", "PLUGIN_REGION_PARALLELISM": "-1"}},
+		{env: map[string]string{"PLUGIN_REGION": "us-central1,europe-west1", "PLUGIN_ACTION": "preview"}},
+	} {
+		t.Run(tst.env["PLUGIN_REGION"], func(t *testing.T) {
+			os.Clearenv()
+			for k, v := range tst.env {
+				os.Setenv(k, v)
+			}
+			cfg := &Config{Action: os.Getenv("PLUGIN_ACTION"), Region: os.Getenv("PLUGIN_REGION")}
+			err := parseRegionConfig(cfg)
+			if (err == nil) != tst.expectedOk {
+				t.Fatalf("parseRegionConfig() err: %v", err)
+			}
+			if err != nil {
+				return
+			}
+			if cfg.Region != tst.expectedRegion || strings.Join(cfg.Regions, ",") != strings.Join(tst.expectedRegions, ",") || cfg.RegionFailurePolicy != tst.expectedPolicy {
+				t.Errorf("unexpected config: %+v", cfg)
+			}
+		})
+	}
+}
+
+func TestRunRegions(t *testing.T) {
+	for _, tst := range []struct {
+		policy         string
+		parallelism    int
+		expectedCalls  []string
+		expectedErr    string
+		expectedLength int
+	}{
+		// every region is deployed, the failed one is reported
+		{
+			policy:         RegionBestEffort,
+			expectedCalls:  []string{"--region us-central1", "--region europe-west1", "--region asia-northeast1"},
+			expectedErr:    "1 of 3 regions didn't succeed: [europe-west1]",
+			expectedLength: 3,
+		},
+		// one at a time, the region after the failed one is never started
+		{
+			policy:         RegionFailFast,
+			parallelism:    1,
+			expectedCalls:  []string{"--region us-central1", "--region europe-west1"},
+			expectedErr:    "2 of 3 regions didn't succeed: [europe-west1, asia-northeast1]",
+			expectedLength: 2,
+		},
+	} {
+		t.Run(tst.policy, func(t *testing.T) {
+			logFile := fakeGCloud(t, fakeResponse{match: "--region europe-west1", exit: 1})
+
+			cfg := &Config{
+				Action: "deploy", ServiceName: "my-service", ImageName: "my-image", Project: "my-project", Runtime: "managed", Token: validGCPKey,
+				Regions: []string{"us-central1", "europe-west1", "asia-northeast1"}, RegionFailurePolicy: tst.policy, RegionParallelism: tst.parallelism,
+			}
+			err := runConfig(cfg)
+			if err == nil || err.Error() != tst.expectedErr {
+				t.Fatalf("expected err: %s, got: %v", tst.expectedErr, err)
+			}
+
+			// gcloud is set up once, then there's a deploy per started region
+			calls := readCalls(t, logFile)
+			if len(calls) != 2+tst.expectedLength {
+				t.Fatalf("unexpected calls: %v", calls)
+			}
+			deploys := strings.Join(calls[2:], "\n")
+			for _, c := range tst.expectedCalls {
+				if !strings.Contains(deploys, c) {
+					t.Errorf("expected a deploy with %s, got: %v", c, calls)
+				}
+			}
+		})
+	}
+}
+
+func TestRegionLogPrefix(t *testing.T) {
+	fakeGCloud(t)
+
+	logs := &bytes.Buffer{}
+	log.SetOutput(logs)
+	defer log.SetOutput(os.Stderr)
+
+	cfg := &Config{
+		Action: "rollback", Revision: "my-service-00001", ServiceName: "my-service", Project: "my-project", Runtime: "managed", Token: validGCPKey,
+		Regions: []string{"us-central1", "europe-west1"}, RegionFailurePolicy: RegionFailFast,
+	}
+	if err := runConfig(cfg); err != nil {
+		t.Fatalf("runConfig() err: %s", err)
+	}
+
+	// the plugin's own lines are prefixed like the commands so parallel regions can be told apart
+	for _, region := range cfg.Regions {
+		if expected := "[" + region + "] Rolling back service my-service to revision my-service-00001"; !strings.Contains(logs.String(), expected) {
+			t.Errorf("expected %q in log, got: %s", expected, logs.String())
+		}
+	}
+	for _, line := range strings.Split(logs.String(), "\n") {
+		if strings.Contains(line, "Rolling back") && !strings.Contains(line, "] Rolling back") {
+			t.Errorf("expected the region prefix, got: %s", line)
+		}
+	}
+}
+
+func TestPrefixWriter(t *testing.T) {
+	out := &bytes.Buffer{}
+	w := &prefixWriter{w: out, prefix: "[us-central1] "}
+
+	w.Write([]byte("Deploying"))
+	w.Write([]byte(" container...\nDone.\nService URL"))
+	if out.String() != "[us-central1] Deploying container...\n[us-central1] Done.\n" {
+		t.Errorf("unexpected output: %q", out.String())
+	}
+
+	w.Flush()
+	w.Flush()
+	if !strings.HasSuffix(out.String(), "[us-central1] Service URL\n") {
+		t.Errorf("expected the last line to be flushed, got: %q", out.String())
+	}
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+const dockerHubRegistry = "registry-1.docker.io"
+
+// manifest media types accepted when looking up images, the digest of a multi-arch image is
+// the digest of its index so it has to be asked for explicitly
+var manifestMediaTypes = []string{
+	"application/vnd.oci.image.index.v1+json",
+	"application/vnd.docker.distribution.manifest.list.v2+json",
+	"application/vnd.oci.image.manifest.v1+json",
+	"application/vnd.docker.distribution.manifest.v2+json",
+}
+
+// using a var so tests can stub out the registry
+var checkImage = imageExists
+
+// registry domains that get the deploying identity's access token, it must not leak to any
+// other registry. using a var instead of const so tests can override this
+var googleRegistries = []string{"gcr.io", "pkg.dev"}
+
+var challengeParamRe = regexp.MustCompile(`(\w+)="([^"]*)"`)
+
+// imageRef is a parsed image reference like us-docker.pkg.dev/my-project/repo/image:tag
+type imageRef struct {
+	// name is the image as written, without tag and digest
+	name       string
+	registry   string
+	repository string
+	tag        string
+	digest     string
+}
+
+func parseImageRef(image string) (*imageRef, error) {
+	ref := &imageRef{name: image}
+	if i := strings.Index(ref.name, "@"); i >= 0 {
+		ref.name, ref.digest = ref.name[:i], ref.name[i+1:]
+	}
+	if i := strings.LastIndex(ref.name, ":"); i > strings.LastIndex(ref.name, "/") {
+		ref.name, ref.tag = ref.name[:i], ref.name[i+1:]
+	}
+	if ref.name == "" || strings.HasSuffix(ref.name, "/") {
+		return nil, fmt.Errorf("invalid image: [%s]", image)
+	}
+	if ref.tag == "" && ref.digest == "" {
+		ref.tag = "latest"
+	}
+
+	ref.registry, ref.repository = dockerHubRegistry, ref.name
+	if parts := strings.SplitN(ref.name, "/", 2); len(parts) == 2 && (strings.ContainsAny(parts[0], ".:") || parts[0] == "localhost") {
+		ref.registry, ref.repository = parts[0], parts[1]
+	}
+	if ref.registry == "docker.io" || ref.registry == "index.docker.io" {
+		ref.registry = dockerHubRegistry
+	}
+	if ref.registry == dockerHubRegistry && !strings.Contains(ref.repository, "/") {
+		ref.repository = "library/" + ref.repository
+	}
+	return ref, nil
+}
+
+// reference is the tag or, if the image is pinned, the digest
+func (r *imageRef) reference() string {
+	if r.digest != "" {
+		return r.digest
+	}
+	return r.tag
+}
+
+func (r *imageRef) manifestURL() string {
+	scheme := "https"
+	if host, _, err := net.SplitHostPort(r.registry); (err == nil && isLocalHost(host)) || isLocalHost(r.registry) {
+		scheme = "http"
+	}
+	return fmt.Sprintf("%s://%s/v2/%s/manifests/%s", scheme, r.registry, r.repository, r.reference())
+}
+
+func isLocalHost(host string) bool {
+	return host == "localhost" || host == "127.0.0.1" || host == "::1"
+}
+
+func isGoogleRegistry(registry string) bool {
+	host := registry
+	if h, _, err := net.SplitHostPort(registry); err == nil {
+		host = h
+	}
+	for _, r := range googleRegistries {
+		if host == r || strings.HasSuffix(host, "."+r) {
+			return true
+		}
+	}
+	return false
+}
+
+// imageNotFoundError is returned when the registry doesn't know the image
+type imageNotFoundError struct {
+	image string
+}
+
+func (e *imageNotFoundError) Error() string {
+	return fmt.Sprintf("image not found: [%s]", e.image)
+}
+
+// manifestDigest looks up the digest of the image's manifest with the registry v2 API, authenticating
+// with the access token of b for Google registries and anonymously everywhere else
+func manifestDigest(b Backend, ref *imageRef) (string, error) {
+	resp, err := registryRequest(b, ref, http.MethodHead)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+
+	if digest := resp.Header.Get("Docker-Content-Digest"); digest != "" {
+		return digest, nil
+	}
+
+	// not every registry sends the digest on HEAD requests, it's the hash of the manifest
+	if resp, err = registryRequest(b, ref, http.MethodGet); err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("sha256:%x", sha256.Sum256(body)), nil
+}
+
+// registryRequest requests the image's manifest, answering an authentication challenge if needed
+func registryRequest(b Backend, ref *imageRef, method string) (*http.Response, error) {
+	token := ""
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequest(method, ref.manifestURL(), nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Accept", strings.Join(manifestMediaTypes, ", "))
+		if token != "" {
+			req.Header.Set("Authorization", bearer(token))
+		}
+
+		resp, err := apiClient.Do(req)
+		if err != nil {
+			return nil, err
+		}
+
+		switch {
+		case resp.StatusCode == http.StatusOK:
+			return resp, nil
+
+		case resp.StatusCode == http.StatusUnauthorized && attempt == 0:
+			challenge := resp.Header.Get("WWW-Authenticate")
+			resp.Body.Close()
+			if token, err = registryToken(b, ref, challenge); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		resp.Body.Close()
+		switch resp.StatusCode {
+		case http.StatusNotFound:
+			return nil, &imageNotFoundError{image: ref.name + ":" + ref.reference()}
+		case http.StatusUnauthorized, http.StatusForbidden:
+			return nil, fmt.Errorf("access to image %s:%s denied, status: %d", ref.name, ref.reference(), resp.StatusCode)
+		}
+		return nil, fmt.Errorf("registry request for %s failed, status: %d", ref.manifestURL(), resp.StatusCode)
+	}
+}
+
+// registryToken gets a bearer token for the challenge of a registry, see
+// https://docs.docker.com/registry/spec/auth/token/
+func registryToken(b Backend, ref *imageRef, challenge string) (string, error) {
+	if !strings.HasPrefix(strings.ToLower(challenge), "bearer ") {
+		return "", fmt.Errorf("unsupported registry authentication: [%s]", challenge)
+	}
+	params := map[string]string{}
+	for _, m := range challengeParamRe.FindAllStringSubmatch(challenge, -1) {
+		params[m[1]] = m[2]
+	}
+	if params["realm"] == "" {
+		return "", fmt.Errorf("registry authentication without realm: [%s]", challenge)
+	}
+
+	q := url.Values{}
+	if params["service"] != "" {
+		q.Set("service", params["service"])
+	}
+	scope := params["scope"]
+	if scope == "" {
+		scope = fmt.Sprintf("repository:%s:pull", ref.repository)
+	}
+	q.Set("scope", scope)
+
+	req, err := http.NewRequest(http.MethodGet, params["realm"]+"?"+q.Encode(), nil)
+	if err != nil {
+		return "", err
+	}
+	if isGoogleRegistry(ref.registry) {
+		accessToken, err := b.AccessToken()
+		if err != nil {
+			return "", err
+		}
+		req.SetBasicAuth("oauth2accesstoken", accessToken)
+	}
+
+	resp, err := apiClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("registry token request failed, status: %d", resp.StatusCode)
+	}
+
+	tr := struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(&tr); err != nil {
+		return "", fmt.Errorf("failed to parse registry token: %s", err)
+	}
+	if tr.Token != "" {
+		return tr.Token, nil
+	}
+	return tr.AccessToken, nil
+}
+
+// imageExists checks the deploying identity can read the image's manifest, so a typo in "image"
+// fails right away instead of after gcloud created a revision that can't pull it
+func imageExists(b Backend, image string) error {
+	ref, err := parseImageRef(image)
+	if err != nil {
+		return err
+	}
+
+	resp, err := registryRequest(b, ref, http.MethodHead)
+	if err != nil {
+		return fmt.Errorf("image check failed: %s, set skip_image_check for registries that don't support it", err)
+	}
+	resp.Body.Close()
+
+	log.Printf("Found image %s", image)
+	return nil
+}
+
+// resolveImageDigest replaces the tag of cfg.ImageName with the digest it currently points to,
+// so the deployed revision records exactly what ran
+func resolveImageDigest(b Backend, cfg *Config) error {
+	ref, err := parseImageRef(cfg.ImageName)
+	if err != nil {
+		return err
+	}
+	if ref.digest != "" {
+		log.Printf("Image %s is already pinned to a digest", cfg.ImageName)
+		return nil
+	}
+
+	digest, err := manifestDigest(b, ref)
+	if err != nil {
+		return fmt.Errorf("resolving image %s failed: %s", cfg.ImageName, err)
+	}
+
+	resolved := ref.name + "@" + digest
+	log.Printf("Resolved image %s to %s", cfg.ImageName, resolved)
+	cfg.ImageName = resolved
+	return nil
+}
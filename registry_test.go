@@ -0,0 +1,197 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestParseImageRef(t *testing.T) {
+	for _, tst := range []struct {
+		image      string
+		registry   string
+		repository string
+		reference  string
+		ok         bool
+	}{
+		{image: "nginx", registry: dockerHubRegistry, repository: "library/nginx", reference: "latest", ok: true},
+		{image: "org-name/my-image:v1", registry: dockerHubRegistry, repository: "org-name/my-image", reference: "v1", ok: true},
+		{image: "docker.io/org-name/my-image:v1", registry: dockerHubRegistry, repository: "org-name/my-image", reference: "v1", ok: true},
+		{image: "gcr.io/my-project/my-image", registry: "gcr.io", repository: "my-project/my-image", reference: "latest", ok: true},
+		{image: "us-docker.pkg.dev/my-project/repo/my-image:v1", registry: "us-docker.pkg.dev", repository: "my-project/repo/my-image", reference: "v1", ok: true},
+		{image: "localhost:5000/my-image:v1", registry: "localhost:5000", repository: "my-image", reference: "v1", ok: true},
+		{image: "gcr.io/my-project/my-image:v1@sha256:abc", registry: "gcr.io", repository: "my-project/my-image", reference: "sha256:abc", ok: true},
+		{image: ":v1"},
+		{image: "gcr.io/"},
+	} {
+		t.Run(tst.image, func(t *testing.T) {
+			ref, err := parseImageRef(tst.image)
+			if (err == nil) != tst.ok {
+				t.Fatalf("parseImageRef() err: %v", err)
+			}
+			if err != nil {
+				return
+			}
+			if ref.registry != tst.registry || ref.repository != tst.repository || ref.reference() != tst.reference {
+				t.Errorf("unexpected ref: %+v", ref)
+			}
+		})
+	}
+}
+
+func TestIsGoogleRegistry(t *testing.T) {
+	for registry, expected := range map[string]bool{
+		"gcr.io":                   true,
+		"eu.gcr.io":                true,
+		"europe-docker.pkg.dev":    true,
+		"registry-1.docker.io":     false,
+		"attacker-gcr.io":          false,
+		"gcr.io.attacker.com:5000": false,
+	} {
+		if isGoogleRegistry(registry) != expected {
+			t.Errorf("isGoogleRegistry(%s) expected: %t", registry, expected)
+		}
+	}
+}
+
+const testManifest = `{"schemaVersion":2}`
+
+// fakeRegistry serves manifests behind bearer token auth, the token endpoint wants
+// the deploying identity's access token for Google registries
+func fakeRegistry(t *testing.T, digestHeader bool) (srv *httptest.Server, tokenAuth *[]string) {
+	tokenAuth = &[]string{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		user, pass, _ := r.BasicAuth()
+		*tokenAuth = append(*tokenAuth, user+":"+pass)
+		if r.FormValue("scope") != "repository:my-project/repo/my-image:pull" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		fmt.Fprint(w, `{"token":"registry-token"}`)
+	})
+	mux.HandleFunc("/v2/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer registry-token" {
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="http://%s/token",service="fake-registry",scope="repository:my-project/repo/my-image:pull"`, r.Host))
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if !strings.Contains(r.Header.Get("Accept"), "application/vnd.oci.image.index.v1+json") {
+			t.Errorf("expected image indexes to be accepted, got: %s", r.Header.Get("Accept"))
+		}
+		if r.URL.Path != "/v2/my-project/repo/my-image/manifests/v1" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if digestHeader {
+			w.Header().Set("Docker-Content-Digest", "sha256:0123abcd")
+		}
+		fmt.Fprint(w, testManifest)
+	})
+	srv = httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return srv, tokenAuth
+}
+
+func TestResolveImageDigest(t *testing.T) {
+	logFile := fakeGCloud(t, fakeResponse{match: "print-access-token", output: "access-token\n"})
+	srv, tokenAuth := fakeRegistry(t, true)
+	registry := strings.TrimPrefix(srv.URL, "http://")
+
+	orig := googleRegistries
+	googleRegistries = []string{"127.0.0.1"}
+	defer func() { googleRegistries = orig }()
+
+	cfg := &Config{
+		Action: "deploy", ServiceName: "my-service", ImageName: registry + "/my-project/repo/my-image:v1",
+		Project: "my-project", Runtime: "managed", Token: validGCPKey, ResolveDigest: true,
+	}
+	if err := runConfig(cfg); err != nil {
+		t.Fatalf("runConfig() err: %s", err)
+	}
+
+	calls := readCalls(t, logFile)
+	expected := "--image " + registry + "/my-project/repo/my-image@sha256:0123abcd "
+	if deploy := calls[len(calls)-1]; !strings.Contains(deploy, expected) {
+		t.Errorf("expected digest to be deployed, got: %s", deploy)
+	}
+	if len(*tokenAuth) != 1 || (*tokenAuth)[0] != "oauth2accesstoken:access-token" {
+		t.Errorf("expected the access token to be used for the registry, got: %v", *tokenAuth)
+	}
+}
+
+func TestManifestDigest(t *testing.T) {
+	// the access token must only ever go to Google registries
+	b := &GCloudBackend{env: NewEnv("/tmp", nil, nil, nil, false)}
+
+	t.Run("digest-header", func(t *testing.T) {
+		srv, tokenAuth := fakeRegistry(t, true)
+		ref, _ := parseImageRef(strings.TrimPrefix(srv.URL, "http://") + "/my-project/repo/my-image:v1")
+		if digest, err := manifestDigest(b, ref); err != nil || digest != "sha256:0123abcd" {
+			t.Errorf("unexpected digest: %s, err: %v", digest, err)
+		}
+		if len(*tokenAuth) != 1 || (*tokenAuth)[0] != ":" {
+			t.Errorf("expected anonymous token request, got: %v", *tokenAuth)
+		}
+	})
+
+	t.Run("hashed-manifest", func(t *testing.T) {
+		srv, _ := fakeRegistry(t, false)
+		ref, _ := parseImageRef(strings.TrimPrefix(srv.URL, "http://") + "/my-project/repo/my-image:v1")
+		expected := fmt.Sprintf("sha256:%x", sha256.Sum256([]byte(testManifest)))
+		if digest, err := manifestDigest(b, ref); err != nil || digest != expected {
+			t.Errorf("unexpected digest: %s, err: %v", digest, err)
+		}
+	})
+
+	t.Run("not-found", func(t *testing.T) {
+		srv, _ := fakeRegistry(t, true)
+		ref, _ := parseImageRef(strings.TrimPrefix(srv.URL, "http://") + "/my-project/repo/my-image:v2")
+		if _, err := manifestDigest(b, ref); err == nil {
+			t.Errorf("expected lookup to fail")
+		} else if _, ok := err.(*imageNotFoundError); !ok {
+			t.Errorf("expected image not found error, got: %s", err)
+		}
+	})
+}
+
+func TestImageCheck(t *testing.T) {
+	srv, _ := fakeRegistry(t, true)
+	registry := strings.TrimPrefix(srv.URL, "http://")
+
+	checkImage = imageExists
+	defer func() { checkImage = func(Backend, string) error { return nil } }()
+
+	for _, tst := range []struct {
+		image          string
+		skipImageCheck bool
+		expectedErr    string
+		expectedCalls  int
+	}{
+		{image: registry + "/my-project/repo/my-image:v1", expectedCalls: 3},
+		{image: registry + "/my-project/repo/my-imag:v1", expectedErr: "image not found: [" + registry + "/my-project/repo/my-imag:v1]", expectedCalls: 2},
+		{image: registry + "/my-project/repo/my-imag:v1", skipImageCheck: true, expectedCalls: 3},
+	} {
+		t.Run(tst.image, func(t *testing.T) {
+			logFile := fakeGCloud(t)
+			cfg := &Config{
+				Action: "deploy", ServiceName: "my-service", ImageName: tst.image, SkipImageCheck: tst.skipImageCheck,
+				Project: "my-project", Runtime: "managed", Token: validGCPKey,
+			}
+			err := runConfig(cfg)
+			if tst.expectedErr == "" && err != nil {
+				t.Fatalf("runConfig() err: %s", err)
+			} else if tst.expectedErr != "" && (err == nil || !strings.Contains(err.Error(), tst.expectedErr)) {
+				t.Fatalf("expected err: %s, got: %v", tst.expectedErr, err)
+			}
+
+			// a failed check stops before the deploy
+			if calls := readCalls(t, logFile); len(calls) != tst.expectedCalls {
+				t.Errorf("unexpected calls: %v", calls)
+			}
+		})
+	}
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const knativeServingAPIVersion = "serving.knative.dev/v1"
+
+// renderService returns the Knative service manifest that the replace action applies, built from
+// the settings on top of the service_yaml template if there is one
+func renderService(cfg *Config) (string, error) {
+	svc := map[string]interface{}{}
+	if cfg.ServiceYAML != "" {
+		b, err := ioutil.ReadFile(filepath.Join(cfg.Dir, cfg.ServiceYAML))
+		if err != nil {
+			return "", fmt.Errorf("failed to read service_yaml: %s", err)
+		}
+		v, err := parseYAML(b)
+		if err != nil {
+			return "", fmt.Errorf("failed to parse service_yaml: %s", err)
+		}
+		var ok bool
+		if svc, ok = v.(map[string]interface{}); !ok {
+			return "", fmt.Errorf("service_yaml isn't a Knative service")
+		}
+	}
+
+	if err := applyServiceSettings(cfg, svc); err != nil {
+		return "", err
+	}
+	return renderYAML(svc)
+}
+
+// applyServiceSettings sets what's configured in cfg on the Knative service, everything else
+// in the template is left as it is
+func applyServiceSettings(cfg *Config, svc map[string]interface{}) error {
+	if v, ok := svc["apiVersion"]; ok && v != knativeServingAPIVersion {
+		return fmt.Errorf("unsupported apiVersion in service_yaml: [%v], expected %s", v, knativeServingAPIVersion)
+	}
+	if v, ok := svc["kind"]; ok && v != "Service" {
+		return fmt.Errorf("unsupported kind in service_yaml: [%v], expected Service", v)
+	}
+	if cfg.NoTraffic {
+		return fmt.Errorf("no_traffic isn't supported by replace, set spec.traffic in service_yaml instead")
+	}
+	svc["apiVersion"] = knativeServingAPIVersion
+	svc["kind"] = "Service"
+	object(svc, "metadata")["name"] = cfg.ServiceName
+
+	spec := object(svc, "spec")
+	for k, v := range deployLabels(cfg) {
+		object(object(svc, "metadata"), "labels")[k] = v
+		object(object(object(spec, "template"), "metadata"), "labels")[k] = v
+	}
+	if _, err := revisionSuffixArgs(cfg); err != nil {
+		return err
+	} else if cfg.RevisionSuffix != "" {
+		object(object(spec, "template"), "metadata")["name"] = cfg.ServiceName + "-" + cfg.RevisionSuffix
+	}
+	tmplSpec := object(object(spec, "template"), "spec")
+
+	containers, _ := tmplSpec["containers"].([]interface{})
+	if len(containers) == 0 {
+		containers = []interface{}{map[string]interface{}{}}
+	}
+	tmplSpec["containers"] = containers
+	c, ok := containers[0].(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("invalid container in service_yaml")
+	}
+
+	if cfg.ImageName != "" {
+		c["image"] = cfg.ImageName
+	}
+	if c["image"] == nil || c["image"] == "" {
+		return fmt.Errorf("Missing image, neither image nor service_yaml set it")
+	}
+
+	if cfg.Memory != "" {
+		object(object(c, "resources"), "limits")["memory"] = cfg.Memory
+	}
+	if cfg.Concurrency != "" {
+		n, err := strconv.Atoi(cfg.Concurrency)
+		if err != nil {
+			return fmt.Errorf("invalid concurrency: [%s]", cfg.Concurrency)
+		}
+		tmplSpec["containerConcurrency"] = n
+	}
+	if cfg.Timeout != "" {
+		d, err := apiDuration(cfg.Timeout)
+		if err != nil {
+			return err
+		}
+		secs, _ := strconv.Atoi(strings.TrimSuffix(d, "s"))
+		tmplSpec["timeoutSeconds"] = secs
+	}
+	if cfg.SvcAccount != "" {
+		tmplSpec["serviceAccountName"] = cfg.SvcAccount
+	}
+
+	setKnativeEnv(cfg, tmplSpec, c)
+
+	if _, ok := spec["traffic"]; !ok {
+		spec["traffic"] = []interface{}{map[string]interface{}{"latestRevision": true, "percent": 100}}
+	}
+	if cfg.Tag != "" {
+		traffic, _ := spec["traffic"].([]interface{})
+		spec["traffic"] = append(traffic, map[string]interface{}{"latestRevision": true, "tag": cfg.Tag})
+	}
+	return nil
+}
+
+// setKnativeEnv adds the env vars and secrets to the container, replacing entries with the same name
+func setKnativeEnv(cfg *Config, tmplSpec, c map[string]interface{}) {
+	set := map[string]interface{}{}
+	for _, kv := range cfg.EnvSecrets {
+		s := strings.SplitN(kv, "=", 2)
+		set[s[0]] = map[string]interface{}{"name": s[0], "value": s[1]}
+	}
+	for k, v := range cfg.Environment {
+		set[k] = map[string]interface{}{"name": k, "value": v}
+	}
+
+	// a file secret replaces the template's mount of the same file, like a removed one
+	removed := map[string]bool{}
+	for _, k := range append(append([]string{}, cfg.RemoveEnv...), cfg.RemoveSecrets...) {
+		removed[k] = true
+	}
+	for k := range cfg.Secrets {
+		if strings.HasPrefix(k, "/") {
+			removed[k] = true
+		}
+	}
+	if len(removed) > 0 {
+		removeSecretMounts(tmplSpec, c, removed)
+	}
+
+	used := map[string]bool{}
+	volumes, _ := tmplSpec["volumes"].([]interface{})
+	for _, v := range volumes {
+		if vm, ok := v.(map[string]interface{}); ok {
+			used[fmt.Sprint(vm["name"])] = true
+		}
+	}
+	for i, k := range sortedKeys(cfg.Secrets) {
+		ref := strings.SplitN(cfg.Secrets[k], ":", 2)
+		version := "latest"
+		if len(ref) == 2 {
+			version = ref[1]
+		}
+
+		// same as gcloud: keys starting with "/" are mounted as files, everything else is an env var
+		if !strings.HasPrefix(k, "/") {
+			set[k] = map[string]interface{}{
+				"name":      k,
+				"valueFrom": map[string]interface{}{"secretKeyRef": map[string]interface{}{"name": ref[0], "key": version}},
+			}
+			continue
+		}
+
+		vol := fmt.Sprintf("secret-%d", i)
+		for n := i + 1; used[vol]; n++ {
+			vol = fmt.Sprintf("secret-%d", n)
+		}
+		used[vol] = true
+		volumes, _ := tmplSpec["volumes"].([]interface{})
+		tmplSpec["volumes"] = append(volumes, map[string]interface{}{
+			"name": vol,
+			"secret": map[string]interface{}{
+				"secretName": ref[0],
+				"items":      []interface{}{map[string]interface{}{"key": version, "path": filepath.Base(k)}},
+			},
+		})
+		mounts, _ := c["volumeMounts"].([]interface{})
+		c["volumeMounts"] = append(mounts, map[string]interface{}{"name": vol, "mountPath": filepath.Dir(k), "readOnly": true})
+	}
+	if len(set)+len(removed) == 0 {
+		return
+	}
+
+	env, _ := c["env"].([]interface{})
+	var merged []interface{}
+	for _, e := range env {
+		if em, ok := e.(map[string]interface{}); ok && (set[fmt.Sprint(em["name"])] != nil || removed[fmt.Sprint(em["name"])]) {
+			continue
+		}
+		merged = append(merged, e)
+	}
+	names := make([]string, 0, len(set))
+	for k := range set {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	for _, k := range names {
+		merged = append(merged, set[k])
+	}
+	setOrDelete(c, "env", merged)
+}
+
+// removeSecretMounts drops the mounts of the template's secret volumes whose files are removed,
+// and the volumes that aren't mounted anymore
+func removeSecretMounts(tmplSpec, c map[string]interface{}, removed map[string]bool) {
+	volumes, _ := tmplSpec["volumes"].([]interface{})
+	secretPaths := map[string][]string{}
+	for _, v := range volumes {
+		vm, _ := v.(map[string]interface{})
+		secret, _ := vm["secret"].(map[string]interface{})
+		items, _ := secret["items"].([]interface{})
+		for _, it := range items {
+			if im, ok := it.(map[string]interface{}); ok {
+				secretPaths[fmt.Sprint(vm["name"])] = append(secretPaths[fmt.Sprint(vm["name"])], fmt.Sprint(im["path"]))
+			}
+		}
+	}
+
+	mounts, _ := c["volumeMounts"].([]interface{})
+	var kept []interface{}
+	dropped := map[string]bool{}
+	for _, m := range mounts {
+		mm, _ := m.(map[string]interface{})
+		name := fmt.Sprint(mm["name"])
+		drop := false
+		for _, p := range secretPaths[name] {
+			if removed[path.Join(fmt.Sprint(mm["mountPath"]), p)] {
+				drop = true
+			}
+		}
+		if drop {
+			dropped[name] = true
+			continue
+		}
+		kept = append(kept, m)
+	}
+	if len(dropped) == 0 {
+		return
+	}
+	setOrDelete(c, "volumeMounts", kept)
+
+	var keptVolumes []interface{}
+	for _, v := range volumes {
+		if vm, ok := v.(map[string]interface{}); ok && dropped[fmt.Sprint(vm["name"])] {
+			continue
+		}
+		keptVolumes = append(keptVolumes, v)
+	}
+	setOrDelete(tmplSpec, "volumes", keptVolumes)
+}
+
+// setOrDelete sets m[key] to list, or deletes key if list is empty instead of rendering "[]"
+func setOrDelete(m map[string]interface{}, key string, list []interface{}) {
+	if len(list) == 0 {
+		delete(m, key)
+		return
+	}
+	m[key] = list
+}
+
+// runReplace renders the service, applies it with "gcloud run services replace" and makes the
+// service public if allow_unauthenticated is set, the manifest leaves IAM alone
+func runReplace(b Backend, cfg *Config, creds *Credentials) error {
+	manifest, err := renderService(cfg)
+	if err != nil {
+		return err
+	}
+
+	// the manifest can contain env_secret values, it's written to the private credentials dir which
+	// is removed on every exit, including when the plugin gets terminated
+	f, err := ioutil.TempFile(creds.Dir, "service-*.yaml")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.WriteString(manifest); err != nil {
+		f.Close()
+		return fmt.Errorf("error writing service file: %s", err)
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	rcfg := *cfg
+	rcfg.ReplaceFile = f.Name()
+	plan, err := CreateExecutionPlan(&rcfg)
+	if err != nil {
+		return err
+	}
+	if err := ExecutePlan(b, &rcfg, plan); err != nil {
+		return err
+	}
+
+	if cfg.AllowUnauthenticated {
+		b.Logf("Allowing unauthenticated access to %s", cfg.ServiceName)
+		iam := append([]string{"--quiet", "run", "services", "add-iam-policy-binding", cfg.ServiceName, "--member", "allUsers", "--role", "roles/run.invoker"}, locationArgs(cfg)...)
+		if err := ExecutePlan(b, cfg, iam); err != nil {
+			return err
+		}
+	}
+
+	return verifyDeployment(b, cfg)
+}
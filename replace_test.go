@@ -0,0 +1,273 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRenderService(t *testing.T) {
+	cfg := &Config{
+		Action: "replace", ServiceName: "my-service", ImageName: "my-image", Memory: "512Mi",
+		Concurrency: "80", Timeout: "5m", SvcAccount: "runtime@my-project.iam.gserviceaccount.com", Tag: "blue",
+		Environment: map[string]string{"LOG_LEVEL": "debug"},
+		Secrets:     map[string]string{"API_KEY": "api-key:2", "/etc/tls/cert.pem": "tls-cert"},
+		EnvSecrets:  []string{"PASSWORD=hunter2"},
+	}
+	rendered, err := renderService(cfg)
+	if err != nil {
+		t.Fatalf("renderService() err: %s", err)
+	}
+
+	expected := `apiVersion: serving.knative.dev/v1
+kind: Service
+metadata:
+  name: my-service
+spec:
+  template:
+    spec:
+      containerConcurrency: 80
+      containers:
+        - env:
+            - name: API_KEY
+              valueFrom:
+                secretKeyRef:
+                  key: "2"
+                  name: api-key
+            - name: LOG_LEVEL
+              value: debug
+            - name: PASSWORD
+              value: hunter2
+          image: my-image
+          resources:
+            limits:
+              memory: 512Mi
+          volumeMounts:
+            - mountPath: /etc/tls
+              name: secret-0
+              readOnly: true
+      serviceAccountName: runtime@my-project.iam.gserviceaccount.com
+      timeoutSeconds: 300
+      volumes:
+        - name: secret-0
+          secret:
+            items:
+              - key: latest
+                path: cert.pem
+            secretName: tls-cert
+  traffic:
+    - latestRevision: true
+      percent: 100
+    - latestRevision: true
+      tag: blue
+`
+	if rendered != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, rendered)
+	}
+}
+
+func TestRenderServiceTemplate(t *testing.T) {
+	dir := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(dir, "service.yaml"), []byte(exportedService), 0600); err != nil {
+		t.Fatalf("WriteFile() err: %s", err)
+	}
+
+	cfg := &Config{
+		Action: "replace", Dir: dir, ServiceYAML: "service.yaml", ServiceName: "my-service", Memory: "1Gi",
+		Environment: map[string]string{"GREETING": "hi"},
+	}
+	rendered, err := renderService(cfg)
+	if err != nil {
+		t.Fatalf("renderService() err: %s", err)
+	}
+
+	v, err := parseYAML([]byte(rendered))
+	if err != nil {
+		t.Fatalf("parseYAML() err: %s", err)
+	}
+	svc := v.(map[string]interface{})
+	container := svc["spec"].(map[string]interface{})["template"].(map[string]interface{})["spec"].(map[string]interface{})["containers"].([]interface{})[0].(map[string]interface{})
+
+	// the template keeps everything that isn't configured, the env var set by the settings is replaced
+	for _, tst := range []struct {
+		value    interface{}
+		expected interface{}
+	}{
+		{container["image"], "us-docker.pkg.dev/my-project/repo/my-image@sha256:0123abcd"},
+		{container["resources"], map[string]interface{}{"limits": map[string]interface{}{"cpu": "1000m", "memory": "1Gi"}}},
+		{len(container["env"].([]interface{})), 4},
+		{container["env"].([]interface{})[3], map[string]interface{}{"name": "GREETING", "value": "hi"}},
+		{container["ports"], []interface{}{map[string]interface{}{"containerPort": 8080, "name": "http1"}}},
+		{len(svc["spec"].(map[string]interface{})["traffic"].([]interface{})), 2},
+	} {
+		if !reflect.DeepEqual(tst.value, tst.expected) {
+			t.Errorf("expected: %#v, got: %#v", tst.expected, tst.value)
+		}
+	}
+
+	for name, doc := range map[string]string{
+		"job":        "apiVersion: run.googleapis.com/v1\nkind: Job\n",
+		"no-image":   "apiVersion: serving.knative.dev/v1\nkind: Service\n",
+		"not-a-map":  "- a\n- b\n",
+		"no-traffic": exportedService,
+	} {
+		if err := ioutil.WriteFile(filepath.Join(dir, "service.yaml"), []byte(doc), 0600); err != nil {
+			t.Fatalf("WriteFile() err: %s", err)
+		}
+		cfg := &Config{Action: "replace", Dir: dir, ServiceYAML: "service.yaml", ServiceName: "my-service", NoTraffic: name == "no-traffic"}
+		if _, err := renderService(cfg); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+
+	// a file secret replaces the template's mount of the file, the new volume gets a name that isn't used
+	cfg = &Config{
+		Action: "replace", Dir: dir, ServiceName: "my-service", ImageName: "my-image",
+		Secrets: map[string]string{"/etc/tls/cert.pem": "tls-cert", "/etc/tls-key/key.pem": "tls-key"},
+	}
+	mounted, err := renderService(cfg)
+	if err != nil {
+		t.Fatalf("renderService() err: %s", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "service.yaml"), []byte(mounted), 0600); err != nil {
+		t.Fatalf("WriteFile() err: %s", err)
+	}
+	cfg = &Config{
+		Action: "replace", Dir: dir, ServiceYAML: "service.yaml", ServiceName: "my-service",
+		Secrets: map[string]string{"/etc/tls/cert.pem": "new-tls:2"},
+	}
+	if rendered, err = renderService(cfg); err != nil {
+		t.Fatalf("renderService() err: %s", err)
+	}
+	if v, err = parseYAML([]byte(rendered)); err != nil {
+		t.Fatalf("parseYAML() err: %s", err)
+	}
+	spec := v.(map[string]interface{})["spec"].(map[string]interface{})["template"].(map[string]interface{})["spec"].(map[string]interface{})
+	volumes := map[string]string{}
+	for _, vol := range spec["volumes"].([]interface{}) {
+		vm := vol.(map[string]interface{})
+		volumes[vm["name"].(string)] = vm["secret"].(map[string]interface{})["secretName"].(string)
+	}
+	mounts := map[string]string{}
+	for _, m := range spec["containers"].([]interface{})[0].(map[string]interface{})["volumeMounts"].([]interface{}) {
+		mm := m.(map[string]interface{})
+		mounts[mm["mountPath"].(string)] = mm["name"].(string)
+	}
+	if expected := map[string]string{"secret-0": "tls-key", "secret-1": "new-tls"}; !reflect.DeepEqual(volumes, expected) {
+		t.Errorf("expected volumes: %v, got: %v", expected, volumes)
+	}
+	if expected := map[string]string{"/etc/tls-key": "secret-0", "/etc/tls": "secret-1"}; !reflect.DeepEqual(mounts, expected) {
+		t.Errorf("expected mounts: %v, got: %v", expected, mounts)
+	}
+}
+
+func TestRenderServiceRemove(t *testing.T) {
+	dir := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(dir, "service.yaml"), []byte(exportedService), 0600); err != nil {
+		t.Fatalf("WriteFile() err: %s", err)
+	}
+	cfg := &Config{
+		Action: "replace", Dir: dir, ServiceYAML: "service.yaml", ServiceName: "my-service",
+		Secrets: map[string]string{"/etc/tls/cert.pem": "tls-cert"},
+	}
+	mounted, err := renderService(cfg)
+	if err != nil {
+		t.Fatalf("renderService() err: %s", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "service.yaml"), []byte(mounted), 0600); err != nil {
+		t.Fatalf("WriteFile() err: %s", err)
+	}
+
+	cfg = &Config{
+		Action: "replace", Dir: dir, ServiceYAML: "service.yaml", ServiceName: "my-service", EnvMode: EnvModeMerge,
+		RemoveEnv: []string{"EMPTY"}, RemoveSecrets: []string{"API_KEY", "/etc/tls/cert.pem"},
+	}
+	rendered, err := renderService(cfg)
+	if err != nil {
+		t.Fatalf("renderService() err: %s", err)
+	}
+	v, err := parseYAML([]byte(rendered))
+	if err != nil {
+		t.Fatalf("parseYAML() err: %s", err)
+	}
+	spec := v.(map[string]interface{})["spec"].(map[string]interface{})["template"].(map[string]interface{})["spec"].(map[string]interface{})
+	container := spec["containers"].([]interface{})[0].(map[string]interface{})
+
+	var names []string
+	for _, e := range container["env"].([]interface{}) {
+		names = append(names, e.(map[string]interface{})["name"].(string))
+	}
+	if expected := []string{"GREETING", "SCRIPT"}; !reflect.DeepEqual(names, expected) {
+		t.Errorf("expected env vars: %q, got: %q", expected, names)
+	}
+	if spec["volumes"] != nil || container["volumeMounts"] != nil {
+		t.Errorf("expected the secret volume to be removed, got:\n%s", rendered)
+	}
+}
+
+func TestRunReplace(t *testing.T) {
+	logFile := fakeGCloud(t)
+
+	cfg := &Config{
+		Action: "replace", Project: "my-project", Runtime: "managed", Region: "us-central1", Token: validGCPKey,
+		ServiceName: "my-service", ImageName: "my-image", AllowUnauthenticated: true,
+	}
+	if err := runConfig(cfg); err != nil {
+		t.Fatalf("runConfig() err: %s", err)
+	}
+
+	calls := readCalls(t, logFile)
+	if len(calls) != 4 {
+		t.Fatalf("unexpected calls: %v", calls)
+	}
+	if !strings.HasPrefix(calls[2], "--quiet run services replace ") || !strings.Contains(calls[2], ".yaml --project my-project --platform managed --region us-central1") {
+		t.Errorf("unexpected replace call: %s", calls[2])
+	}
+	// the manifest can hold secrets, it's written next to the key file so it's removed with the credentials
+	keyFile := strings.Fields(calls[1])[len(strings.Fields(calls[1]))-1]
+	manifest := strings.Fields(calls[2])[4]
+	if filepath.Dir(manifest) != filepath.Dir(keyFile) {
+		t.Errorf("expected the manifest in the credentials dir %s, got: %s", filepath.Dir(keyFile), manifest)
+	}
+	if _, err := os.Stat(manifest); !os.IsNotExist(err) {
+		t.Errorf("expected the manifest to be removed, got: %v", err)
+	}
+	if calls[3] != "--quiet run services add-iam-policy-binding my-service --member allUsers --role roles/run.invoker --project my-project --platform managed --region us-central1" {
+		t.Errorf("unexpected iam call: %s", calls[3])
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	logFile := fakeGCloud(t)
+
+	logs := &bytes.Buffer{}
+	log.SetOutput(logs)
+	defer log.SetOutput(os.Stderr)
+
+	cfg := &Config{
+		Action: "replace", Project: "my-project", Runtime: "managed", Token: validGCPKey, DryRun: true,
+		Regions: []string{"us-central1", "europe-west1"}, ServiceName: "my-service", ImageName: "my-image",
+		EnvSecrets: []string{"PASSWORD=hunter2"},
+	}
+	if err := runConfig(cfg); err != nil {
+		t.Fatalf("runConfig() err: %s", err)
+	}
+
+	if _, err := os.Stat(logFile); !os.IsNotExist(err) {
+		t.Errorf("expected gcloud not to run, got: %v", readCalls(t, logFile))
+	}
+	out := logs.String()
+	for _, expected := range []string{"Dry run, rendered my-service.yaml:\n", "  name: my-service\n", "value: " + RedactedValue, `"services", "replace", "my-service.yaml"`, `"europe-west1"`} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("expected %q in the logs, got:\n%s", expected, out)
+		}
+	}
+	if strings.Contains(out, "hunter2") {
+		t.Errorf("secret leaked into the logs:\n%s", out)
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+)
+
+// servingTraffic returns the current traffic split of the service in "--to-revisions" format,
+// or an empty string if there is none, e.g. because the service doesn't exist yet
+func servingTraffic(b Backend, cfg *Config) string {
+	svc, err := b.DescribeService(cfg, cfg.ServiceName)
+	if err != nil {
+		b.Logf("No previous traffic split to roll back to: %s", err)
+		return ""
+	}
+	split := trafficSplit(svc.Status.Traffic)
+	b.Logf("Traffic split before deploy: %s", split)
+	return split
+}
+
+// revertTraffic restores the given traffic split and returns the error that caused the revert
+func revertTraffic(b Backend, cfg *Config, split string, cause error) error {
+	b.Logf("%s, reverting traffic to: %s", cause, split)
+
+	if err := runPlan(b, trafficConfig(cfg, "to-revisions", split)); err != nil {
+		return fmt.Errorf("%s, reverting traffic failed too: %s", cause, err)
+	}
+	b.Logf("Restored traffic split: %s", split)
+	return cause
+}
+
+// previousRevision returns the newest ready revision that was created before
+// the newest revision currently serving traffic
+func previousRevision(b Backend, cfg *Config) (string, error) {
+	svc, err := b.DescribeService(cfg, cfg.ServiceName)
+	if err != nil {
+		return "", err
+	}
+	serving := map[string]bool{}
+	for _, t := range svc.Status.Traffic {
+		if t.Percent > 0 {
+			serving[t.RevisionName] = true
+		}
+	}
+
+	revisions, err := b.ListRevisions(cfg)
+	if err != nil {
+		return "", err
+	}
+	sort.Slice(revisions, func(i, j int) bool {
+		return revisions[i].Metadata.CreationTimestamp.After(revisions[j].Metadata.CreationTimestamp)
+	})
+
+	foundServing := false
+	for _, r := range revisions {
+		switch {
+		case foundServing && r.Ready():
+			return r.Metadata.Name, nil
+		case serving[r.Metadata.Name]:
+			foundServing = true
+		}
+	}
+	return "", fmt.Errorf("no previous revision of service %s to roll back to", cfg.ServiceName)
+}
+
+// runRollback routes all traffic to cfg.Revision or, if it's not set, to the previous revision
+func runRollback(b Backend, cfg *Config) error {
+	rcfg := *cfg
+	if rcfg.Revision == "" {
+		rev, err := previousRevision(b, cfg)
+		if err != nil {
+			return err
+		}
+		rcfg.Revision = rev
+	}
+	b.Logf("Rolling back service %s to revision %s", cfg.ServiceName, rcfg.Revision)
+
+	return runPlan(b, &rcfg)
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+const (
+	revisionsList = `[
+		{"metadata":{"name":"my-service-00003","creationTimestamp":"2023-05-03T10:00:00Z"},"status":{"conditions":[{"type":"Ready","status":"True"}]}},
+		{"metadata":{"name":"my-service-00001","creationTimestamp":"2023-05-01T10:00:00Z"},"status":{"conditions":[{"type":"Ready","status":"True"}]}},
+		{"metadata":{"name":"my-service-00002","creationTimestamp":"2023-05-02T10:00:00Z"},"status":{"conditions":[{"type":"Ready","status":"False"}]}}
+	]`
+)
+
+func TestRollback(t *testing.T) {
+	cfg := &Config{Action: "rollback", ServiceName: "my-service", Project: "my-project", Runtime: "managed"}
+
+	t.Run("previous-revision", func(t *testing.T) {
+		logFile := fakeGCloud(t,
+			fakeResponse{match: "services describe", output: `{"status":{"traffic":[{"revisionName":"my-service-00003","percent":100}]}}`},
+			fakeResponse{match: "revisions list", output: revisionsList},
+		)
+		if err := runConfig(cfg); err != nil {
+			t.Fatalf("runConfig() err: %s", err)
+		}
+
+		// my-service-00002 isn't ready so my-service-00001 is the one to go back to
+		calls := readCalls(t, logFile)
+		if last := calls[len(calls)-1]; !strings.Contains(last, "services update-traffic my-service --to-revisions my-service-00001=100") {
+			t.Errorf("unexpected rollback call: %s", last)
+		}
+	})
+
+	t.Run("no-previous-revision", func(t *testing.T) {
+		fakeGCloud(t,
+			fakeResponse{match: "services describe", output: `{"status":{"traffic":[{"revisionName":"my-service-00001","percent":100}]}}`},
+			fakeResponse{match: "revisions list", output: revisionsList},
+		)
+		if err := runConfig(cfg); err == nil {
+			t.Errorf("expected rollback to fail without a previous revision")
+		}
+	})
+
+	t.Run("explicit-revision", func(t *testing.T) {
+		logFile := fakeGCloud(t)
+		rcfg := *cfg
+		rcfg.Revision = "my-service-00002"
+		if err := runConfig(&rcfg); err != nil {
+			t.Fatalf("runConfig() err: %s", err)
+		}
+		calls := strings.Join(readCalls(t, logFile), "\n")
+		if strings.Contains(calls, "describe") || !strings.Contains(calls, "--to-revisions my-service-00002=100") {
+			t.Errorf("unexpected calls:\n%s", calls)
+		}
+	})
+}
+
+func TestRollbackOnFailure(t *testing.T) {
+	cfg := &Config{Action: "deploy", ServiceName: "my-service", ImageName: "my-image", Project: "my-project", Runtime: "managed", RollbackOnFailure: true}
+
+	t.Run("failed-deploy", func(t *testing.T) {
+		logFile := fakeGCloud(t,
+			fakeResponse{match: "services describe", output: describeTwoRevisions},
+			fakeResponse{match: "run deploy", exit: 1},
+		)
+		if err := runConfig(cfg); err == nil {
+			t.Fatalf("expected deploy to fail")
+		}
+		calls := readCalls(t, logFile)
+		if last := calls[len(calls)-1]; !strings.Contains(last, "--to-revisions=my-service-00001=90,my-service-00002=10") {
+			t.Errorf("expected the prior traffic split to be restored, got: %s", last)
+		}
+	})
+
+	t.Run("new-service", func(t *testing.T) {
+		logFile := fakeGCloud(t,
+			fakeResponse{match: "services describe", exit: 1},
+			fakeResponse{match: "run deploy", exit: 1},
+		)
+		if err := runConfig(cfg); err == nil {
+			t.Fatalf("expected deploy to fail")
+		}
+		for _, c := range readCalls(t, logFile) {
+			if strings.Contains(c, "update-traffic") {
+				t.Errorf("nothing to roll back to, got: %s", c)
+			}
+		}
+	})
+
+	t.Run("successful-deploy", func(t *testing.T) {
+		logFile := fakeGCloud(t, fakeResponse{match: "services describe", output: describeTwoRevisions})
+		if err := runConfig(cfg); err != nil {
+			t.Fatalf("runConfig() err: %s", err)
+		}
+		for _, c := range readCalls(t, logFile) {
+			if strings.Contains(c, "update-traffic") {
+				t.Errorf("didn't expect a rollback, got: %s", c)
+			}
+		}
+	})
+}
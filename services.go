@@ -0,0 +1,194 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+)
+
+// ServiceEntry is one of the services deployed by a step with the "services" setting. Unset
+// fields fall back to the top-level settings, maps are merged with the entry's values winning.
+type ServiceEntry struct {
+	Name                 string      `json:"name"`
+	Image                string      `json:"image"`
+	Environment          settingsMap `json:"environment"`
+	Secrets              settingsMap `json:"secrets"`
+	Memory               string      `json:"memory"`
+	Concurrency          string      `json:"concurrency"`
+	Timeout              string      `json:"timeout"`
+	SvcAccount           string      `json:"svc_account"`
+	AllowUnauthenticated *bool       `json:"allow_unauthenticated"`
+	Tag                  string      `json:"tag"`
+	AdditionalFlags      settingsMap `json:"addl_flags"`
+
+	// services that have to be deployed successfully before this one
+	DependsOn []string `json:"depends_on"`
+}
+
+// parseServicesConfig reads the services setting and orders the services so that
+// every service comes after the ones it depends on
+func parseServicesConfig(cfg *Config) error {
+	servicesStr := os.Getenv("PLUGIN_SERVICES")
+	if strings.TrimSpace(servicesStr) == "" {
+		return nil
+	}
+
+	var entries []ServiceEntry
+	if err := json.Unmarshal([]byte(servicesStr), &entries); err != nil {
+		return fmt.Errorf("failed to parse services: [%s]", err)
+	}
+	if len(entries) == 0 {
+		return fmt.Errorf("services is empty, list at least one service or unset it")
+	}
+	if cfg.Action == "preview" || cfg.Action == "preview-cleanup" {
+		return fmt.Errorf("%s doesn't support services", cfg.Action)
+	}
+
+	byName := map[string]ServiceEntry{}
+	for i := range entries {
+		if err := interpolateServiceEntry(&entries[i]); err != nil {
+			return err
+		}
+		e := entries[i]
+		if e.Name == "" {
+			return fmt.Errorf("Missing service name in services")
+		}
+		if _, ok := byName[e.Name]; ok {
+			return fmt.Errorf("duplicate service: [%s]", e.Name)
+		}
+		if e.Image == "" && cfg.ImageName == "" && deploysImage(cfg.Action) {
+			return fmt.Errorf("Missing image for service: [%s]", e.Name)
+		}
+		if e.SvcAccount != "" && !emailRe.MatchString(e.SvcAccount) {
+			return fmt.Errorf("invalid svc_account of service %s, not an email: [%s]", e.Name, e.SvcAccount)
+		}
+		byName[e.Name] = e
+	}
+
+	// depth first, visiting the services in the order they're listed so independent services keep their order
+	const (
+		visiting = 1
+		visited  = 2
+	)
+	state := map[string]int{}
+	var visit func(e ServiceEntry, path []string) error
+	visit = func(e ServiceEntry, path []string) error {
+		switch state[e.Name] {
+		case visiting:
+			return fmt.Errorf("services depend on each other: [%s]", strings.Join(append(path, e.Name), " -> "))
+		case visited:
+			return nil
+		}
+		state[e.Name] = visiting
+		for _, dep := range e.DependsOn {
+			d, ok := byName[dep]
+			if !ok {
+				return fmt.Errorf("service %s depends on unknown service: [%s]", e.Name, dep)
+			}
+			if err := visit(d, append(path, e.Name)); err != nil {
+				return err
+			}
+		}
+		state[e.Name] = visited
+		cfg.Services = append(cfg.Services, e)
+		return nil
+	}
+	for _, e := range entries {
+		if err := visit(e, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// serviceConfigs returns the configs for all services of cfg, or cfg itself without the services setting
+func serviceConfigs(cfg *Config) []*Config {
+	if len(cfg.Services) == 0 {
+		return []*Config{cfg}
+	}
+	var configs []*Config
+	for _, e := range cfg.Services {
+		configs = append(configs, serviceConfig(cfg, e))
+	}
+	return configs
+}
+
+// serviceConfig returns a copy of cfg for one of its services
+func serviceConfig(cfg *Config, e ServiceEntry) *Config {
+	scfg := *cfg
+	scfg.Services = nil
+	scfg.ServiceName = e.Name
+	if isJobAction(cfg.Action) {
+		scfg.JobName = e.Name
+	}
+
+	for _, o := range []struct {
+		setting *string
+		value   string
+	}{
+		{&scfg.ImageName, e.Image},
+		{&scfg.Memory, e.Memory},
+		{&scfg.Concurrency, e.Concurrency},
+		{&scfg.Timeout, e.Timeout},
+		{&scfg.SvcAccount, e.SvcAccount},
+		{&scfg.Tag, e.Tag},
+	} {
+		if o.value != "" {
+			*o.setting = o.value
+		}
+	}
+	if e.AllowUnauthenticated != nil {
+		scfg.AllowUnauthenticated = *e.AllowUnauthenticated
+	}
+
+	scfg.Environment = mergeSettings(cfg.Environment, e.Environment)
+	scfg.Secrets = mergeSettings(cfg.Secrets, e.Secrets)
+	scfg.AdditionalFlags = mergeSettings(cfg.AdditionalFlags, e.AdditionalFlags)
+	return &scfg
+}
+
+// mergeSettings returns the values of shared overridden by the values of override
+func mergeSettings(shared, override map[string]string) map[string]string {
+	if len(override) == 0 {
+		return shared
+	}
+	merged := map[string]string{}
+	for k, v := range shared {
+		merged[k] = v
+	}
+	for k, v := range override {
+		merged[k] = v
+	}
+	return merged
+}
+
+// runServices runs the action for every service in dependency order. A service whose
+// dependencies didn't succeed is skipped, the others are run either way.
+func runServices(b Backend, cfg *Config, creds *Credentials) error {
+	results := make([]runResult, len(cfg.Services))
+	succeeded := map[string]bool{}
+	for i, e := range cfg.Services {
+		results[i].name = e.Name
+
+		var failedDeps []string
+		for _, dep := range e.DependsOn {
+			if !succeeded[dep] {
+				failedDeps = append(failedDeps, dep)
+			}
+		}
+		if len(failedDeps) > 0 {
+			log.Printf("Skipping service %s, its dependencies didn't succeed: %s", e.Name, strings.Join(failedDeps, ", "))
+			continue
+		}
+
+		log.Printf("Running %s for service %s (%d/%d)", cfg.Action, e.Name, i+1, len(cfg.Services))
+		results[i].started = true
+		if results[i].err = runService(b, serviceConfig(cfg, e), creds); results[i].err == nil {
+			succeeded[e.Name] = true
+		}
+	}
+
+	return summary("services", results)
+}
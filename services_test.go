@@ -0,0 +1,120 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestParseServicesConfig(t *testing.T) {
+	for _, tst := range []struct {
+		name          string
+		services      string
+		image         string
+		expectedOk    bool
+		expectedOrder []string
+	}{
+		{
+			name:          "shared-image",
+			services:      `[{"name":"api"},{"name":"worker"}]`,
+			image:         "my-image",
+			expectedOk:    true,
+			expectedOrder: []string{"api", "worker"},
+		},
+		{
+			name:          "dependencies",
+			services:      `[{"name":"admin","image":"admin","depends_on":["api"]},{"name":"api","image":"api","depends_on":["migrations"]},{"name":"migrations","image":"migrations"},{"name":"worker","image":"worker"}]`,
+			expectedOk:    true,
+			expectedOrder: []string{"migrations", "api", "admin", "worker"},
+		},
+		{
+			name:          "interpolated-dependency",
+			services:      `[{"name":"api-${DRONE_BRANCH}","image":"api"},{"name":"worker","image":"worker","depends_on":["api-${DRONE_BRANCH}"]}]`,
+			expectedOk:    true,
+			expectedOrder: []string{"api-main", "worker"},
+		},
+		{name: "empty", services: `[]`},
+		{name: "missing-image", services: `[{"name":"api","image":"api"},{"name":"worker"}]`},
+		{name: "missing-name", services: `[{"image":"api"}]`},
+		{name: "duplicate", services: `[{"name":"api","image":"api"},{"name":"api","image":"api"}]`},
+		{name: "unknown-dependency", services: `[{"name":"api","image":"api","depends_on":["db"]}]`},
+		{name: "cycle", services: `[{"name":"api","image":"api","depends_on":["worker"]},{"name":"worker","image":"worker","depends_on":["api"]}]`},
+		{name: "invalid-svc-account", services: `[{"name":"api","image":"api","svc_account":"api"}]`},
+		{name: "not-a-list", services: `{"name":"api"}`},
+		{name: "numeric-env", services: `[{"name":"api","image":"api","environment":{"PORT":8080,"DEBUG":true}}]`, expectedOk: true, expectedOrder: []string{"api"}},
+		{name: "nested-env", services: `[{"name":"api","image":"api","environment":{"PORT":{"value":8080}}}]`},
+	} {
+		t.Run(tst.name, func(t *testing.T) {
+			os.Clearenv()
+			os.Setenv("PLUGIN_SERVICES", tst.services)
+			os.Setenv("DRONE_BRANCH", "main")
+			cfg := &Config{Action: "deploy", ImageName: tst.image}
+			err := parseServicesConfig(cfg)
+			if (err == nil) != tst.expectedOk {
+				t.Fatalf("parseServicesConfig() err: %v", err)
+			}
+
+			var order []string
+			for _, e := range cfg.Services {
+				order = append(order, e.Name)
+			}
+			if strings.Join(order, ",") != strings.Join(tst.expectedOrder, ",") {
+				t.Errorf("unexpected order: %v", order)
+			}
+		})
+	}
+}
+
+func TestServiceConfig(t *testing.T) {
+	public := true
+	cfg := &Config{
+		Action: "deploy", ImageName: "shared-image", Memory: "256Mi",
+		Environment:     map[string]string{"LOG_LEVEL": "info", "REGION": "us"},
+		AdditionalFlags: map[string]string{"cpu": "1"},
+	}
+	scfg := serviceConfig(cfg, ServiceEntry{
+		Name: "api", Memory: "1Gi", AllowUnauthenticated: &public,
+		Environment: map[string]string{"LOG_LEVEL": "debug"},
+	})
+
+	if scfg.ServiceName != "api" || scfg.ImageName != "shared-image" || scfg.Memory != "1Gi" || !scfg.AllowUnauthenticated {
+		t.Errorf("unexpected config: %+v", scfg)
+	}
+	if scfg.Environment["LOG_LEVEL"] != "debug" || scfg.Environment["REGION"] != "us" || scfg.AdditionalFlags["cpu"] != "1" {
+		t.Errorf("expected settings to be merged, got: %v %v", scfg.Environment, scfg.AdditionalFlags)
+	}
+	if cfg.Environment["LOG_LEVEL"] != "info" {
+		t.Errorf("shared settings must not change, got: %v", cfg.Environment)
+	}
+}
+
+func TestRunServices(t *testing.T) {
+	logFile := fakeGCloud(t, fakeResponse{match: "deploy api ", exit: 1})
+
+	os.Clearenv()
+	os.Setenv("PLUGIN_SERVICES", `[
+		{"name":"worker","image":"worker-image","depends_on":["api"]},
+		{"name":"api","image":"api-image","memory":"1Gi"},
+		{"name":"admin","image":"admin-image"}
+	]`)
+	cfg := &Config{Action: "deploy", Project: "my-project", Runtime: "managed", Token: validGCPKey, Memory: "256Mi"}
+	if err := parseServicesConfig(cfg); err != nil {
+		t.Fatalf("parseServicesConfig() err: %s", err)
+	}
+
+	err := runConfig(cfg)
+	if err == nil || err.Error() != "2 of 3 services didn't succeed: [api, worker]" {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	// worker is skipped as api failed, admin doesn't depend on it
+	calls := readCalls(t, logFile)
+	if len(calls) != 4 {
+		t.Fatalf("unexpected calls: %v", calls)
+	}
+	for i, expected := range []string{"deploy api --image api-image --no-allow-unauthenticated --memory 1Gi", "deploy admin --image admin-image --no-allow-unauthenticated --memory 256Mi"} {
+		if !strings.Contains(calls[2+i], expected) {
+			t.Errorf("expected %s, got: %s", expected, calls[2+i])
+		}
+	}
+}
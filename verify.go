@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultVerifyTimeout = 2 * time.Minute
+)
+
+// using vars instead of consts so tests can override these
+var (
+	verifyInitialBackoff = time.Second
+	verifyMaxBackoff     = 15 * time.Second
+	verifyClient         = &http.Client{Timeout: 10 * time.Second}
+)
+
+func parseVerifyConfig(cfg *Config) error {
+	var err error
+	if cfg.VerifyPath, err = interpolatedSettingValue("verify_path"); err != nil {
+		return err
+	}
+	if cfg.VerifyBody, err = interpolatedSettingValue("verify_body"); err != nil {
+		return err
+	}
+	if cfg.VerifyPath != "" && !strings.HasPrefix(cfg.VerifyPath, "/") {
+		cfg.VerifyPath = "/" + cfg.VerifyPath
+	}
+
+	cfg.VerifyStatus = http.StatusOK
+	if s := os.Getenv("PLUGIN_VERIFY_STATUS"); s != "" {
+		status, err := strconv.Atoi(s)
+		if err != nil || status < 100 || status > 599 {
+			return fmt.Errorf("invalid verify_status: [%s]", s)
+		}
+		cfg.VerifyStatus = status
+	}
+
+	cfg.VerifyTimeout = DefaultVerifyTimeout
+	if s := os.Getenv("PLUGIN_VERIFY_TIMEOUT"); s != "" {
+		d, err := time.ParseDuration(s)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("invalid verify_timeout: [%s]", s)
+		}
+		cfg.VerifyTimeout = d
+	}
+	return nil
+}
+
+// verifyDeployment probes cfg.VerifyPath on the service, or on the tagged revision if cfg.Tag is set,
+// it's a no-op if no verify_path is configured
+func verifyDeployment(b Backend, cfg *Config) error {
+	if cfg.VerifyPath == "" {
+		return nil
+	}
+
+	svc, err := b.DescribeService(cfg, cfg.ServiceName)
+	if err != nil {
+		return err
+	}
+	url := svc.Status.URL
+	if cfg.Tag != "" {
+		url = svc.TagURL(cfg.Tag)
+	}
+	if url == "" {
+		return fmt.Errorf("couldn't find the URL of service %s to verify", cfg.ServiceName)
+	}
+
+	token := ""
+	if !cfg.AllowUnauthenticated {
+		if token, err = b.IdentityToken(url); err != nil {
+			return fmt.Errorf("failed to get an identity token to verify the deployment: %s", err)
+		}
+	}
+
+	return VerifyURL(strings.TrimRight(url, "/")+cfg.VerifyPath, token, cfg, b.Logf)
+}
+
+// VerifyURL polls url with exponential backoff until it responds with cfg.VerifyStatus and
+// a body containing cfg.VerifyBody or cfg.VerifyTimeout has passed, the attempts are logged with logf
+func VerifyURL(url, token string, cfg *Config, logf func(format string, args ...interface{})) error {
+	deadline := time.Now().Add(cfg.VerifyTimeout)
+	backoff := verifyInitialBackoff
+
+	for attempt := 1; ; attempt++ {
+		err := probe(url, token, cfg)
+		if err == nil {
+			logf("Verified %s after %d attempt(s)", url, attempt)
+			return nil
+		}
+		logf("Verifying %s, attempt %d failed: %s", url, attempt, err)
+
+		if time.Now().Add(backoff).After(deadline) {
+			return fmt.Errorf("deployment didn't become healthy within %s, last error: %s", cfg.VerifyTimeout, err)
+		}
+		sleep(backoff)
+
+		if backoff *= 2; backoff > verifyMaxBackoff {
+			backoff = verifyMaxBackoff
+		}
+	}
+}
+
+func probe(url, token string, cfg *Config) error {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := verifyClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode != cfg.VerifyStatus {
+		return fmt.Errorf("expected status %d, got %d", cfg.VerifyStatus, resp.StatusCode)
+	}
+	if cfg.VerifyBody != "" && !strings.Contains(string(body), cfg.VerifyBody) {
+		return fmt.Errorf("response body doesn't contain [%s]", cfg.VerifyBody)
+	}
+	return nil
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// versionServer mimics the /version endpoint of the tst app, failing the first failures requests
+func versionServer(t *testing.T, version string, failures int32) (*httptest.Server, *int32) {
+	var requests int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) <= failures {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if r.URL.Path != "/version" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if r.Header.Get("Authorization") != "" && r.Header.Get("Authorization") != "Bearer id-token" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		fmt.Fprintf(w, "version: [%s]", version)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &requests
+}
+
+func TestVerifyURL(t *testing.T) {
+	verifyInitialBackoff = 5 * time.Millisecond
+	defer func() { verifyInitialBackoff = time.Second }()
+
+	for _, tst := range []struct {
+		name       string
+		failures   int32
+		cfg        Config
+		expectedOk bool
+	}{
+		{name: "healthy", cfg: Config{VerifyPath: "/version", VerifyStatus: 200, VerifyBody: "version: [abc]"}, expectedOk: true},
+		{name: "eventually-healthy", failures: 3, cfg: Config{VerifyPath: "/version", VerifyStatus: 200}, expectedOk: true},
+		{name: "wrong-body", cfg: Config{VerifyPath: "/version", VerifyStatus: 200, VerifyBody: "version: [def]"}},
+		{name: "wrong-status", cfg: Config{VerifyPath: "/version", VerifyStatus: 204}},
+		{name: "expected-404", cfg: Config{VerifyPath: "/missing", VerifyStatus: 404}, expectedOk: true},
+		{name: "never-healthy", failures: 1000, cfg: Config{VerifyPath: "/version", VerifyStatus: 200}},
+	} {
+		t.Run(tst.name, func(t *testing.T) {
+			srv, requests := versionServer(t, "abc", tst.failures)
+			tst.cfg.VerifyTimeout = 200 * time.Millisecond
+
+			err := VerifyURL(srv.URL+tst.cfg.VerifyPath, "", &tst.cfg, log.Printf)
+			if tst.expectedOk && err != nil {
+				t.Errorf("VerifyURL() err: %s", err)
+			} else if !tst.expectedOk && err == nil {
+				t.Errorf("VerifyURL() should have failed")
+			}
+			if !tst.expectedOk && atomic.LoadInt32(requests) < 2 {
+				t.Errorf("expected retries, got %d request(s)", *requests)
+			}
+		})
+	}
+}
+
+func TestVerifyDeployment(t *testing.T) {
+	verifyInitialBackoff = 5 * time.Millisecond
+	defer func() { verifyInitialBackoff = time.Second }()
+
+	srv, _ := versionServer(t, "abc", 0)
+
+	cfg := &Config{
+		Action: "deploy", ServiceName: "my-service", ImageName: "my-image", Project: "my-project", Runtime: "managed",
+		VerifyPath: "/version", VerifyStatus: 200, VerifyBody: "abc", VerifyTimeout: 100 * time.Millisecond,
+	}
+
+	logFile := fakeGCloud(t,
+		fakeResponse{match: "services describe", output: `{"status":{"url":"` + srv.URL + `"}}`},
+		fakeResponse{match: "print-identity-token", output: "id-token\n"},
+	)
+	if err := runConfig(cfg); err != nil {
+		t.Fatalf("runConfig() err: %s", err)
+	}
+	if calls := strings.Join(readCalls(t, logFile), "\n"); !strings.Contains(calls, "print-identity-token --audiences "+srv.URL) {
+		t.Errorf("expected an identity token for the service, got calls:\n%s", calls)
+	}
+
+	cfg.VerifyBody = "def"
+	if err := runConfig(cfg); err == nil {
+		t.Errorf("expected verification to fail")
+	}
+}
+
+func TestCanaryRevertsOnFailedVerification(t *testing.T) {
+	verifyInitialBackoff = 5 * time.Millisecond
+	sleep = func(time.Duration) {}
+	defer func() { verifyInitialBackoff = time.Second; sleep = time.Sleep }()
+
+	// healthy for the first check of the tagged revision, broken afterwards
+	var requests int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) > 1 {
+			w.WriteHeader(http.StatusBadGateway)
+		}
+	}))
+	defer srv.Close()
+
+	logFile := fakeGCloud(t, fakeResponse{
+		match:  "services describe",
+		output: `{"status":{"traffic":[{"revisionName":"my-service-00001","percent":100},{"revisionName":"my-service-00002","tag":"canary","url":"` + srv.URL + `"}]}}`,
+	})
+
+	cfg := &Config{
+		Action: "canary", ServiceName: "my-service", ImageName: "my-image", Project: "my-project", Runtime: "managed",
+		AllowUnauthenticated: true, Tag: "canary", CanarySteps: []int{10, 100},
+		VerifyPath: "/", VerifyStatus: 200, VerifyTimeout: 20 * time.Millisecond,
+	}
+	if err := runConfig(cfg); err == nil {
+		t.Fatalf("expected the canary rollout to fail")
+	}
+
+	calls := readCalls(t, logFile)
+	if last := calls[len(calls)-1]; !strings.Contains(last, "--to-revisions=my-service-00001=100") {
+		t.Errorf("expected traffic revert as last call, got: %s", last)
+	}
+	for _, c := range calls {
+		if strings.Contains(c, "--to-latest") {
+			t.Errorf("rollout should have stopped at the first step, got: %s", c)
+		}
+	}
+}
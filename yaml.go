@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// The Knative manifests gcloud reads and exports are YAML. Values are represented like encoding/json
+// does it: map[string]interface{}, []interface{}, string, bool and nil, with int for integers and
+// float64 for other numbers.
+
+// parseYAML reads a single YAML document
+func parseYAML(data []byte) (interface{}, error) {
+	var v interface{}
+	if err := yaml.Unmarshal(data, &v); err != nil {
+		return nil, err
+	}
+	return normalizeYAML(v)
+}
+
+// normalizeYAML converts what yaml.v3 decodes into the types above
+func normalizeYAML(v interface{}) (interface{}, error) {
+	switch val := v.(type) {
+	case map[string]interface{}:
+		for k, item := range val {
+			n, err := normalizeYAML(item)
+			if err != nil {
+				return nil, err
+			}
+			val[k] = n
+		}
+		return val, nil
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(val))
+		for k, item := range val {
+			n, err := normalizeYAML(item)
+			if err != nil {
+				return nil, err
+			}
+			m[fmt.Sprint(k)] = n
+		}
+		return m, nil
+	case []interface{}:
+		for i, item := range val {
+			n, err := normalizeYAML(item)
+			if err != nil {
+				return nil, err
+			}
+			val[i] = n
+		}
+		return val, nil
+	case int64:
+		return int(val), nil
+	case uint64:
+		return float64(val), nil
+	case time.Time:
+		return val.Format(time.RFC3339Nano), nil
+	case nil, string, bool, int, float64:
+		return val, nil
+	}
+	return nil, fmt.Errorf("unsupported YAML value: %v", v)
+}
+
+// renderYAML writes v in block style with sorted keys, strings that would be read back as another
+// type, like "80", "true" or "0x1F", are quoted
+func renderYAML(v interface{}) (string, error) {
+	b := &bytes.Buffer{}
+	enc := yaml.NewEncoder(b)
+	enc.SetIndent(2)
+	if err := enc.Encode(v); err != nil {
+		return "", err
+	}
+	if err := enc.Close(); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
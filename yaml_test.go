@@ -0,0 +1,190 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+// trimmed down output of "gcloud run services describe --format=export"
+const exportedService = `apiVersion: serving.knative.dev/v1
+kind: Service
+metadata:
+  annotations:
+    run.googleapis.com/ingress: all
+    run.googleapis.com/client-name: gcloud # set by gcloud
+  labels:
+    cloud.googleapis.com/location: us-central1
+  name: my-service
+spec:
+  template:
+    metadata:
+      annotations:
+        autoscaling.knative.dev/maxScale: '100'
+        run.googleapis.com/startup-cpu-boost: 'true'
+    spec:
+      containerConcurrency: 80
+      containers:
+      - env:
+        - name: GREETING
+          value: "hello: world"
+        - name: EMPTY
+          value: ''
+        - name: SCRIPT
+          value: |
+            echo one
+            echo two
+        - name: API_KEY
+          valueFrom:
+            secretKeyRef:
+              key: latest
+              name: api-key
+        image: us-docker.pkg.dev/my-project/repo/my-image@sha256:0123abcd
+        ports:
+        - containerPort: 8080
+          name: http1
+        resources:
+          limits:
+            cpu: 1000m
+            memory: 512Mi
+      serviceAccountName: runtime@my-project.iam.gserviceaccount.com
+      timeoutSeconds: 300
+  traffic:
+  - latestRevision: true
+    percent: 100
+  - {percent: 0, revisionName: my-service-00001, tag: blue}
+`
+
+func TestParseYAML(t *testing.T) {
+	v, err := parseYAML([]byte(exportedService))
+	if err != nil {
+		t.Fatalf("parseYAML() err: %s", err)
+	}
+
+	svc := v.(map[string]interface{})
+	spec := svc["spec"].(map[string]interface{})["template"].(map[string]interface{})["spec"].(map[string]interface{})
+	container := spec["containers"].([]interface{})[0].(map[string]interface{})
+
+	for _, tst := range []struct {
+		value    interface{}
+		expected interface{}
+	}{
+		{svc["metadata"].(map[string]interface{})["annotations"].(map[string]interface{})["run.googleapis.com/client-name"], "gcloud"},
+		{spec["containerConcurrency"], 80},
+		{spec["timeoutSeconds"], 300},
+		{container["image"], "us-docker.pkg.dev/my-project/repo/my-image@sha256:0123abcd"},
+		{container["env"].([]interface{})[0], map[string]interface{}{"name": "GREETING", "value": "hello: world"}},
+		{container["env"].([]interface{})[1], map[string]interface{}{"name": "EMPTY", "value": ""}},
+		{container["env"].([]interface{})[2], map[string]interface{}{"name": "SCRIPT", "value": "echo one\necho two\n"}},
+		{container["ports"], []interface{}{map[string]interface{}{"containerPort": 8080, "name": "http1"}}},
+		{svc["spec"].(map[string]interface{})["traffic"], []interface{}{
+			map[string]interface{}{"latestRevision": true, "percent": 100},
+			map[string]interface{}{"percent": 0, "revisionName": "my-service-00001", "tag": "blue"},
+		}},
+	} {
+		if !reflect.DeepEqual(tst.value, tst.expected) {
+			t.Errorf("expected: %#v, got: %#v", tst.expected, tst.value)
+		}
+	}
+}
+
+func TestYAMLRoundTrip(t *testing.T) {
+	v, err := parseYAML([]byte(exportedService))
+	if err != nil {
+		t.Fatalf("parseYAML() err: %s", err)
+	}
+	rendered, err := renderYAML(v)
+	if err != nil {
+		t.Fatalf("renderYAML() err: %s", err)
+	}
+	again, err := parseYAML([]byte(rendered))
+	if err != nil {
+		t.Fatalf("parseYAML() err: %s, rendered:\n%s", err, rendered)
+	}
+	if !reflect.DeepEqual(v, again) {
+		t.Errorf("round trip changed the document, rendered:\n%s", rendered)
+	}
+}
+
+func TestRenderYAML(t *testing.T) {
+	rendered, err := renderYAML(map[string]interface{}{
+		"kind": "Service",
+		"spec": map[string]interface{}{
+			"containers": []interface{}{
+				map[string]interface{}{
+					"env": []interface{}{
+						map[string]interface{}{"name": "PORT_NAME", "value": "80"},
+						map[string]interface{}{"name": "FLAG", "value": "true"},
+						map[string]interface{}{"name": "TEXT", "value": "a: b # c"},
+						map[string]interface{}{"name": "LINES", "value": "one\ntwo"},
+						map[string]interface{}{"name": "HEX", "value": "0x1F"},
+						map[string]interface{}{"name": "OCTAL", "value": "0o17"},
+						map[string]interface{}{"name": "NULL", "value": "~"},
+					},
+					"image": "my-image",
+					"args":  []interface{}{},
+				},
+			},
+			"containerConcurrency": 80,
+			"annotations":          map[string]interface{}{},
+		},
+	})
+	if err != nil {
+		t.Fatalf("renderYAML() err: %s", err)
+	}
+
+	expected := `kind: Service
+spec:
+  annotations: {}
+  containerConcurrency: 80
+  containers:
+    - args: []
+      env:
+        - name: PORT_NAME
+          value: "80"
+        - name: FLAG
+          value: "true"
+        - name: TEXT
+          value: 'a: b # c'
+        - name: LINES
+          value: |-
+            one
+            two
+        - name: HEX
+          value: "0x1F"
+        - name: OCTAL
+          value: "0o17"
+        - name: "NULL"
+          value: "~"
+      image: my-image
+`
+	if rendered != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, rendered)
+	}
+
+	// gcloud has to read the env var values back as strings
+	v, err := parseYAML([]byte(rendered))
+	if err != nil {
+		t.Fatalf("parseYAML() err: %s", err)
+	}
+	env := v.(map[string]interface{})["spec"].(map[string]interface{})["containers"].([]interface{})[0].(map[string]interface{})["env"].([]interface{})
+	for _, e := range env {
+		if value := e.(map[string]interface{})["value"]; reflect.TypeOf(value).Kind() != reflect.String {
+			t.Errorf("expected a string, got: %#v", value)
+		}
+	}
+}
+
+func TestParseYAMLErrors(t *testing.T) {
+	for _, doc := range []string{
+		"a: 1\n  b: 2\n",
+		"a: 1\na: 2\n",
+		"a: [1, 2\n",
+		"a: \"unterminated\n",
+		"a:\n\t- 1\n",
+		"- 1\nb: 2\n",
+	} {
+		if _, err := parseYAML([]byte(doc)); err == nil {
+			t.Errorf("expected an error for: %q", doc)
+		}
+	}
+}